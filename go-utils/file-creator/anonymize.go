@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// AnonymizeKeyEnv names the environment variable read when -key is not set.
+const AnonymizeKeyEnv = "FILE_CREATOR_ANONYMIZE_KEY"
+
+// PseudonymDomain is the reserved top-level domain of pseudonymous domains.
+const PseudonymDomain = "example"
+
+var addressPattern = regexp.MustCompile(`[^\s,;<>"()]+@[^\s,;<>"()]+`)
+
+// Anonymizer rewrites usage rows without personal data. Addresses and subjects
+// are replaced consistently for a key: the same value always gets the same
+// pseudonym, so repeated senders and domain relationships survive.
+type Anonymizer struct {
+	key []byte
+
+	// Added to every parsed sentTimestamp.
+	Shift time.Duration
+}
+
+// NewAnonymizer constructs an Anonymizer keyed with key.
+func NewAnonymizer(key string) *Anonymizer {
+	return &Anonymizer{key: []byte(key)}
+}
+
+func (a *Anonymizer) sum(kind, value string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(kind + ":" + value)) // nolint:errcheck
+	return mac.Sum(nil)
+}
+
+// Domain returns the pseudonym of a domain, case insensitively.
+func (a *Anonymizer) Domain(domain string) string {
+	return "d" + hex.EncodeToString(a.sum("domain", strings.ToLower(domain)))[:10] + "." + PseudonymDomain
+}
+
+// Address returns the pseudonym of an email address: the local part is keyed
+// on the whole address and the domain on the domain alone.
+func (a *Anonymizer) Address(address string) string {
+	local := "u" + hex.EncodeToString(a.sum("local", strings.ToLower(address)))[:10]
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return local
+	}
+	return local + "@" + a.Domain(address[at+1:])
+}
+
+// Addresses replaces every address in s, and scrambles the rest such as
+// display names.
+func (a *Anonymizer) Addresses(s string) string {
+	var out strings.Builder
+	last := 0
+	for _, m := range addressPattern.FindAllStringIndex(s, -1) {
+		out.WriteString(a.Text(s[last:m[0]]))
+		out.WriteString(a.Address(s[m[0]:m[1]]))
+		last = m[1]
+	}
+	out.WriteString(a.Text(s[last:]))
+	return out.String()
+}
+
+// Text scrambles s keeping its length in characters and their classes:
+// letters stay upper or lower case letters, digits stay digits, and
+// everything else is kept.
+func (a *Anonymizer) Text(s string) string {
+	if s == "" {
+		return s
+	}
+	rnd := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(a.sum("text", s)))))
+
+	runes := []rune(s)
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			runes[i] = rune('A' + rnd.Intn(26))
+		case unicode.IsLetter(r):
+			runes[i] = rune('a' + rnd.Intn(26))
+		case unicode.IsDigit(r):
+			runes[i] = rune('0' + rnd.Intn(10))
+		}
+	}
+	return string(runes)
+}
+
+// Timestamp shifts a DateFormat timestamp; others are kept.
+func (a *Anonymizer) Timestamp(s string) string {
+	t, err := usagegen.ParseDate(s)
+	if a.Shift == 0 || err != nil {
+		return s
+	}
+	return usagegen.FormatDate(t.Add(a.Shift))
+}
+
+// Anonymize copies the usage CSV from r to w, rewriting the columns of header
+// by name and leaving the others, such as the policies, intact.
+// It returns the number of rows written.
+func (a *Anonymizer) Anonymize(r io.Reader, w io.Writer) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	writer := csv.NewWriter(w)
+
+	columns, err := reader.Read()
+	if err == io.EOF {
+		return 0, fmt.Errorf("empty file, expected a header")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := writer.Write(columns); err != nil {
+		return 0, err
+	}
+
+	rewrite := make([]func(string) string, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "senderAddress", "recipientAddress":
+			rewrite[i] = a.Addresses
+		case "subject":
+			rewrite[i] = a.Text
+		case "sentTimestamp":
+			rewrite[i] = a.Timestamp
+		}
+	}
+
+	rows := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, err
+		}
+		for i := range record {
+			if i < len(rewrite) && rewrite[i] != nil {
+				record[i] = rewrite[i](record[i])
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+
+	writer.Flush()
+	return rows, writer.Error()
+}
+
+// runAnonymize runs the anonymize subcommand: anonymize [flags] <in> <out>
+// It returns the exit code: 0 on success, 2 on usage or IO errors.
+func runAnonymize(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("anonymize", flag.ContinueOnError)
+	key := fs.String("key", os.Getenv(AnonymizeKeyEnv), "Secret key of the pseudonyms; defaults to $"+AnonymizeKeyEnv)
+	shift := fs.Duration("shift", 0, "Shift the timestamps by this duration, e.g. -720h")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: file-creator anonymize [flags] <in> <out>")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	if *key == "" {
+		// Unkeyed hashes of addresses can be reversed with a dictionary.
+		fmt.Fprintln(fs.Output(), "a key is required, with -key or $"+AnonymizeKeyEnv)
+		return 2
+	}
+	in, out := fs.Arg(0), fs.Arg(1)
+
+	a := NewAnonymizer(*key)
+	a.Shift = *shift
+
+	src, err := os.Open(in)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return 2
+	}
+	defer src.Close()
+
+	dst, err := os.Create(out)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return 2
+	}
+
+	rows, err := a.Anonymize(src, dst)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(fs.Output(), "%s: %v\n", in, err)
+		os.Remove(out) // nolint:errcheck
+		return 2
+	}
+
+	fmt.Fprintf(stdout, "Anonymized %d rows from [%s] to [%s]\n", rows, in, out)
+	return 0
+}
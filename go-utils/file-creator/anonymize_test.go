@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+)
+
+func TestAnonymizer_Anonymize(t *testing.T) {
+	in := strings.Join(header, ",") + "\n" +
+		`alice@acme.com,bob@partner.org,9/10/2018 5:0,Q3 Invoice #42,"PolicyType1, PolicyType2","PolicyName1, PolicyName2",ZixPort` + "\n" +
+		`Alice@ACME.com,"Carol Smith <carol@partner.org>; dave@other.net",31/10/2018 23:30,Re: Q3 Invoice #42,PolicyType1,PolicyName1,ZixPort` + "\n" +
+		`eve@acme.com,bob@partner.org,not a date,Q3 Invoice #42,PolicyType2,PolicyName2,ZixPort` + "\n"
+
+	a := NewAnonymizer("secret")
+	a.Shift = 2 * time.Hour
+
+	var out bytes.Buffer
+	rows, err := a.Anonymize(strings.NewReader(in), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 {
+		t.Errorf("rows = %d, want 3", rows)
+	}
+
+	got, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, _ := csv.NewReader(strings.NewReader(in)).ReadAll() // nolint:errcheck
+	if strings.Join(got[0], ",") != strings.Join(header, ",") {
+		t.Errorf("header = %v", got[0])
+	}
+
+	for _, row := range got[1:] {
+		if strings.Contains(strings.Join(row, ","), "acme") || strings.Contains(strings.Join(row, ","), "partner") || strings.Contains(row[1], "Carol") {
+			t.Errorf("row still has personal data: %v", row)
+		}
+	}
+
+	// The same sender, in any case, and the same recipient get the same pseudonym.
+	if got[1][0] != got[2][0] {
+		t.Errorf("sender pseudonyms differ: %q, %q", got[1][0], got[2][0])
+	}
+	if got[1][1] != got[3][1] {
+		t.Errorf("recipient pseudonyms differ: %q, %q", got[1][1], got[3][1])
+	}
+	// Other senders of the same domain keep the domain, but not the local part.
+	if got[3][0] == got[1][0] || domainOf(got[3][0]) != domainOf(got[1][0]) {
+		t.Errorf("eve@acme.com = %q, alice@acme.com = %q", got[3][0], got[1][0])
+	}
+	if want := "<" + a.Address("carol@partner.org") + ">; " + a.Address("dave@other.net"); !strings.HasSuffix(got[2][1], want) {
+		t.Errorf("recipient list = %q, want suffix %q", got[2][1], want)
+	}
+	if domainOf(a.Address("carol@partner.org")) != domainOf(got[1][1]) {
+		t.Errorf("partner.org pseudonyms differ")
+	}
+
+	if got[1][2] != "9/10/2018 7:0" || got[2][2] != "1/11/2018 1:30" || got[3][2] != "not a date" {
+		t.Errorf("timestamps = %q, %q, %q", got[1][2], got[2][2], got[3][2])
+	}
+
+	for i, row := range got[1:] {
+		subject := original[i+1][3]
+		if row[3] == subject || len(row[3]) != len(subject) {
+			t.Errorf("subject %q scrambled to %q", subject, row[3])
+		}
+		for j, r := range row[3] {
+			o := rune(subject[j])
+			if unicode.IsUpper(r) != unicode.IsUpper(o) || unicode.IsLower(r) != unicode.IsLower(o) ||
+				unicode.IsDigit(r) != unicode.IsDigit(o) || (!unicode.IsLetter(o) && !unicode.IsDigit(o) && r != o) {
+				t.Errorf("subject %q scrambled to %q changes character %d", subject, row[3], j)
+			}
+		}
+		if strings.Join(row[4:], ",") != strings.Join(original[i+1][4:], ",") {
+			t.Errorf("policies changed: %v", row[4:])
+		}
+	}
+	if got[1][3] != got[3][3] {
+		t.Errorf("the same subject scrambled differently: %q, %q", got[1][3], got[3][3])
+	}
+
+	if NewAnonymizer("other").Address("alice@acme.com") == a.Address("alice@acme.com") {
+		t.Error("pseudonyms do not depend on the key")
+	}
+}
+
+func TestRunAnonymize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anonymize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in.csv")
+	out := filepath.Join(dir, "out.csv")
+	content := strings.Join(header, ",") + "\n" + `a@b.com,c@d.com,9/10/2018 5:0,Hi,PolicyType1,PolicyName1,ZixPort` + "\n"
+	if err := ioutil.WriteFile(in, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Unsetenv(AnonymizeKeyEnv) // nolint:errcheck
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"anonymized", []string{"-key", "k", "-shift", "-24h", in, out}, 0},
+		{"missing key", []string{in, out}, 2},
+		{"missing output", []string{"-key", "k", in}, 2},
+		{"missing input", []string{"-key", "k", filepath.Join(dir, "missing.csv"), out}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			if got := runAnonymize(tt.args, &stdout); got != tt.want {
+				t.Errorf("exit code = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := NewValidator().Validate(out, bytes.NewReader(b)); !report.Valid || !strings.Contains(string(b), "8/10/2018 5:0") {
+		t.Errorf("anonymized file is not a valid usage file: %s %+v", b, report.Errors)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// ExistingFile describes a usage file being appended to.
+type ExistingFile struct {
+	// Data rows, excluding the header.
+	Rows int
+
+	// Highest row index found in the generated sender addresses; rows that
+	// were not generated count as the next index.
+	LastIndex int
+
+	// Whether the file has a header, i.e. is not empty.
+	HasHeader bool
+
+	// Whether the last line lacks its line break.
+	MissingNewline bool
+}
+
+// ScanExisting reads the usage file at path to continue it. A missing file is
+// reported as empty; a file whose header does not match header is refused.
+func ScanExisting(path string) (*ExistingFile, error) {
+	existing := &ExistingFile{}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return existing, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	got, err := reader.Read()
+	if err == io.EOF {
+		return existing, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read header: %v", err)
+	}
+	if strings.Join(got, ",") != strings.Join(header, ",") {
+		return nil, fmt.Errorf("header %q does not match the expected columns %q", got, header)
+	}
+	existing.HasHeader = true
+	reader.FieldsPerRecord = len(header)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		existing.Rows++
+
+		var index, domain int
+		if n, _ := fmt.Sscanf(record[0], usagegen.SenderAddress, &index, &domain); n == 2 && index > existing.LastIndex {
+			existing.LastIndex = index
+		} else if n != 2 {
+			existing.LastIndex++
+		}
+	}
+
+	last := make([]byte, 1)
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+			return nil, err
+		}
+		existing.MissingNewline = last[0] != '\n'
+	}
+
+	return existing, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanExisting(t *testing.T) {
+	head := strings.Join(header, ",") + "\n"
+	row := func(i string) string {
+		return "sender" + i + "@sender" + i + ".com,receiver" + i + "@receiver" + i + ".com,1/10/2018 1:1,Hello " + i + `,"PolicyType1, PolicyType2","PolicyName1, PolicyName2",ZixPort` + "\n"
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    ExistingFile
+		wantErr bool
+	}{
+		{"empty file", "", ExistingFile{}, false},
+		{"header only", head, ExistingFile{HasHeader: true}, false},
+		{"generated rows with spam", head + row("1") + row("2") + row("2") + row("3"), ExistingFile{Rows: 4, LastIndex: 3, HasHeader: true}, false},
+		{"foreign row continues the index", head + row("5") + "a@b.com,c@d.com,1/10/2018 1:1,x,y,z,ZixPort\n", ExistingFile{Rows: 2, LastIndex: 6, HasHeader: true}, false},
+		{"missing final newline", head + strings.TrimSuffix(row("1"), "\n"), ExistingFile{Rows: 1, LastIndex: 1, HasHeader: true, MissingNewline: true}, false},
+		{"different columns", "senderAddress,recipientAddress\n", ExistingFile{}, true},
+		{"reordered columns", strings.Replace(head, "subject,policyTypes", "policyTypes,subject", 1), ExistingFile{}, true},
+		{"short row", head + "a@b.com,c@d.com\n", ExistingFile{}, true},
+	}
+
+	dir, err := ioutil.TempDir("", "append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i))+".csv")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ScanExisting(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+	if got, err := ScanExisting(filepath.Join(dir, "missing.csv")); err != nil || *got != (ExistingFile{}) {
+		t.Errorf("missing file: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fbatroni/fusemail/go-utils/mailcorpus"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// Mail log formats.
+const (
+	LogExim    = "exim"
+	LogPostfix = "postfix"
+)
+
+const (
+	eximTimeFormat   = "2006-01-02 15:04:05"
+	syslogTimeFormat = "Jan _2 15:04:05"
+	eximTLS          = "X=TLS1.2:ECDHE-RSA-AES256-GCM-SHA384:256"
+	remoteAccepted   = "250 2.0.0 Ok: queued"
+	remoteDeferred   = "451 4.7.1 Greylisted, please try again later"
+	remoteRejected   = "550 5.1.1 <%s>: Recipient address rejected: User unknown"
+)
+
+// Delivery outcomes of a logged message.
+const (
+	outcomeDelivered = iota
+	outcomeDeferred
+	outcomeBounced
+)
+
+// MailLogName returns the mail log name for a report and format.
+func MailLogName(fileName, format string) string {
+	return strings.TrimSuffix(fileName, ".csv") + "." + format + ".log"
+}
+
+type logLine struct {
+	time time.Time
+	text string
+}
+
+// MailLogWriter logs usage rows as the traffic of the receiving mail server
+// mx.Domain, in Exim mainlog or Postfix maillog format. A share of the
+// messages are deferred once or bounced, per DeferRate and BounceRate.
+// Lines are buffered and written in time order on Close.
+type MailLogWriter struct {
+	Format     string
+	Domain     string
+	BounceRate float64
+	DeferRate  float64
+
+	Delivered int
+	Deferred  int
+	Bounced   int
+
+	// Outcomes and delays are drawn from their own source, so logs of
+	// different formats built from the same seed describe the same traffic.
+	outcomes *rand.Rand
+	rnd      *rand.Rand
+	ids      *mailcorpus.MessageIDs
+	file     *os.File
+	lines    []logLine
+
+	qmgrPid    int
+	cleanupPid int
+}
+
+// NewMailLogWriter opens the log for the report at path, appending to it if
+// appendFile is set. Bounce messages get their ids from ids.
+func NewMailLogWriter(path, format, domain string, ids *mailcorpus.MessageIDs, seed int64, appendFile bool) (*MailLogWriter, error) {
+	if format != LogExim && format != LogPostfix {
+		return nil, fmt.Errorf("unknown mail log format %q", format)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendFile {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(MailLogName(path, format), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	rnd := rand.New(rand.NewSource(seed + 1))
+	return &MailLogWriter{
+		Format:     format,
+		Domain:     domain,
+		outcomes:   rand.New(rand.NewSource(seed)),
+		rnd:        rnd,
+		ids:        ids,
+		file:       file,
+		qmgrPid:    rnd.Intn(30000) + 500,
+		cleanupPid: rnd.Intn(30000) + 500,
+	}, nil
+}
+
+// Write logs the message msgID of size bytes, for a usage row received at date.
+func (l *MailLogWriter) Write(date time.Time, msgID string, size int, record usagegen.Record) {
+	outcome := outcomeDelivered
+	switch r := l.outcomes.Float64(); {
+	case r < l.BounceRate:
+		outcome = outcomeBounced
+		l.Bounced++
+	case r < l.BounceRate+l.DeferRate:
+		outcome = outcomeDeferred
+		l.Deferred++
+	default:
+		l.Delivered++
+	}
+
+	// Remote delivery attempt, and the retry of deferred messages.
+	attempt := date.Add(time.Duration(l.outcomes.Intn(2800)+200) * time.Millisecond)
+	retry := attempt.Add(time.Duration(l.outcomes.Intn(55)+5) * time.Minute)
+
+	if l.Format == LogExim {
+		l.exim(date, attempt, retry, msgID, size, record, outcome)
+	} else {
+		l.postfix(date, attempt, retry, msgID, size, record, outcome)
+	}
+}
+
+func (l *MailLogWriter) exim(date, attempt, retry time.Time, id string, size int, record usagegen.Record, outcome int) {
+	sender, recipient := record[0], record[1]
+	senderHost, recipientHost := domainOf(sender), "mx."+domainOf(recipient)
+	remote := fmt.Sprintf("R=dnslookup T=remote_smtp H=%s [%s]", recipientHost, hostIP("198.51.100", recipientHost))
+	line := func(t time.Time, format string, args ...interface{}) {
+		l.add(t, t.Format(eximTimeFormat)+" "+fmt.Sprintf(format, args...))
+	}
+
+	line(date, "%s <= %s H=%s [%s] P=esmtps %s CV=no S=%d id=%s@%s",
+		id, sender, senderHost, hostIP("203.0.113", senderHost), eximTLS, size, id, l.Domain)
+
+	switch outcome {
+	case outcomeDeferred:
+		line(attempt, "%s == %s %s defer (-44): SMTP error from remote mail server after RCPT TO:<%s>: %s",
+			id, recipient, remote, recipient, remoteDeferred)
+		attempt = retry
+		fallthrough
+	case outcomeDelivered:
+		line(attempt, "%s => %s %s %s CV=yes C=\"%s\"", id, recipient, remote, eximTLS, remoteAccepted)
+		line(attempt, "%s Completed", id)
+	case outcomeBounced:
+		line(attempt, "%s ** %s %s: SMTP error from remote mail server after RCPT TO:<%s>: "+remoteRejected,
+			id, recipient, remote, recipient, recipient)
+
+		bounceID := l.ids.ID(attempt)
+		senderMX := "mx." + senderHost
+		line(attempt, "%s <= <> R=%s U=Debian-exim P=local S=%d", bounceID, id, size+1200)
+		line(attempt, "%s => %s R=dnslookup T=remote_smtp H=%s [%s] %s CV=yes C=\"%s\"",
+			bounceID, sender, senderMX, hostIP("203.0.113", senderMX), eximTLS, remoteAccepted)
+		line(attempt, "%s Completed", bounceID)
+		line(attempt, "%s Completed", id)
+	}
+}
+
+func (l *MailLogWriter) postfix(date, attempt, retry time.Time, id string, size int, record usagegen.Record, outcome int) {
+	sender, recipient := record[0], record[1]
+	senderHost, recipientHost := domainOf(sender), "mx."+domainOf(recipient)
+	client := fmt.Sprintf("%s[%s]", senderHost, hostIP("203.0.113", senderHost))
+	relay := fmt.Sprintf("%s[%s]", recipientHost, hostIP("198.51.100", recipientHost))
+
+	host := "mx"
+	smtpdPid, smtpPid := l.rnd.Intn(30000)+500, l.rnd.Intn(30000)+500
+	line := func(t time.Time, process string, pid int, format string, args ...interface{}) {
+		l.add(t, fmt.Sprintf("%s %s postfix/%s[%d]: ", t.Format(syslogTimeFormat), host, process, pid)+fmt.Sprintf(format, args...))
+	}
+	delivery := func(t time.Time, qid, to, relay, dsn, status, reply string) {
+		total := t.Sub(date).Seconds()
+		line(t, "smtp", smtpPid, "%s: to=<%s>, relay=%s:25, delay=%.2f, delays=%.2f/0.01/%.2f/%.2f, dsn=%s, status=%s (%s)",
+			qid, to, relay, total, total*0.2, total*0.3, total*0.5-0.01, dsn, status, reply)
+	}
+
+	qid := l.queueID()
+	line(date, "smtpd", smtpdPid, "connect from %s", client)
+	line(date, "smtpd", smtpdPid, "%s: client=%s", qid, client)
+	line(date, "cleanup", l.cleanupPid, "%s: message-id=<%s@%s>", qid, id, l.Domain)
+	line(date, "qmgr", l.qmgrPid, "%s: from=<%s>, size=%d, nrcpt=1 (queue active)", qid, sender, size)
+	line(date, "smtpd", smtpdPid, "disconnect from %s ehlo=1 starttls=1 mail=1 rcpt=1 data=1 quit=1 commands=6", client)
+
+	switch outcome {
+	case outcomeDeferred:
+		delivery(attempt, qid, recipient, relay, "4.7.1", "deferred",
+			fmt.Sprintf("host %s said: %s (in reply to RCPT TO command)", relay, remoteDeferred))
+		line(retry, "qmgr", l.qmgrPid, "%s: from=<%s>, size=%d, nrcpt=1 (queue active)", qid, sender, size)
+		attempt = retry
+		fallthrough
+	case outcomeDelivered:
+		delivery(attempt, qid, recipient, relay, "2.0.0", "sent", remoteAccepted)
+		line(attempt, "qmgr", l.qmgrPid, "%s: removed", qid)
+	case outcomeBounced:
+		delivery(attempt, qid, recipient, relay, "5.1.1", "bounced",
+			fmt.Sprintf("host %s said: "+remoteRejected+" (in reply to RCPT TO command)", relay, recipient))
+
+		bounceQID := l.queueID()
+		senderMX := "mx." + senderHost
+		line(attempt, "cleanup", l.cleanupPid, "%s: message-id=<%s.%s@%s>", bounceQID, attempt.Format("20060102150405"), bounceQID, l.Domain)
+		line(attempt, "bounce", smtpPid+1, "%s: sender non-delivery notification: %s", qid, bounceQID)
+		line(attempt, "qmgr", l.qmgrPid, "%s: from=<>, size=%d, nrcpt=1 (queue active)", bounceQID, size+1200)
+		line(attempt, "qmgr", l.qmgrPid, "%s: removed", qid)
+		delivery(attempt, bounceQID, sender, fmt.Sprintf("%s[%s]", senderMX, hostIP("203.0.113", senderMX)), "2.0.0", "sent", remoteAccepted)
+		line(attempt, "qmgr", l.qmgrPid, "%s: removed", bounceQID)
+	}
+}
+
+func (l *MailLogWriter) queueID() string {
+	return fmt.Sprintf("%010X", l.rnd.Int63n(1<<40))
+}
+
+func (l *MailLogWriter) add(t time.Time, text string) {
+	l.lines = append(l.lines, logLine{t, text})
+}
+
+// Close writes the buffered lines in time order and closes the log.
+func (l *MailLogWriter) Close() error {
+	sort.SliceStable(l.lines, func(i, j int) bool {
+		return l.lines[i].time.Before(l.lines[j].time)
+	})
+
+	w := bufio.NewWriter(l.file)
+	for _, line := range l.lines {
+		w.WriteString(line.text) // nolint:errcheck
+		w.WriteByte('\n')        // nolint:errcheck
+	}
+	l.lines = nil
+
+	err := w.Flush()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func domainOf(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+// hostIP returns a stable documentation-range address for host in network/24.
+func hostIP(network, host string) string {
+	h := fnv.New32a()
+	h.Write([]byte(host)) // nolint:errcheck
+	return fmt.Sprintf("%s.%d", network, h.Sum32()%254+1)
+}
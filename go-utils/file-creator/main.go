@@ -1,14 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/fbatroni/fusemail/go-utils/mailcorpus"
+	"github.com/fbatroni/fusemail/go-utils/nsqpub"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
 )
 
 // import (
@@ -17,92 +21,221 @@ import (
 // 	"fmt"
 // )
 
-const (
-	SenderAddress   = "sender%d@sender%d.com"
-	ReceiverAddress = "receiver%d@receiver%d.com"
-	DateFormat      = "%d/%d/%d %d:%d"
-	Subject         = "Hello %d"
-	PolicyTypes     = "PolicyType1, PolicyType2"
-	PolicyNames     = "PolicyName1, PolicyName2"
-	DeliveryMethod  = "ZixPort"
-)
-
 var (
 	fileName         string
 	numberOfRows     int
 	numberOfSpamRows int
 	spamStartLine    int
-	append           bool
-	header           = []string{"senderAddress", "recipientAddress", "sentTimestamp", "subject", "policyTypes", "policyNames", "deliveryMethod"}
+	appendMode       bool
+	corpusFormat     string
+	mailDomain       string
+	mailLogFormats   string
+	bounceRate       float64
+	deferRate        float64
+	numberOfShards   int
+	maxRowsPerFile   int
+	maxBytesPerFile  int64
+	writeSummary     bool
+	nsqdAddress      string
+	nsqTopic         string
+	nsqBatchSize     int
+	nsqRate          float64
+	nsqDefer         time.Duration
+	timestampLayout  string
+	timeZone         string
+	utcOffset        bool
+	timestampMix     bool
+	dstMode          string
+	dstRate          float64
+	addressMix       string
+	csvDelimiter     string
+	csvEncoding      string
+	csvAlwaysQuote   bool
+	csvCRLF          bool
+	csvBOM           bool
+
+	messageIDs *mailcorpus.MessageIDs
+	corpus     *mailcorpus.Writer
+	mailLogs   []*MailLogWriter
+	publisher  *UsagePublisher
+	spam       []SpamInjection
+	timestamps []*usagegen.TimestampFormat
+	addresses  usagegen.AddressMix
+	dialect    usagegen.Dialect
+	header     = usagegen.Header
 )
 
-type Record []string
-
-// Example of running: -output mock-zix-usage -rows 20 -spams 5 -spams-start 5 -append -
+// Example of running: -output mock-zix-usage -rows 20 -spams 5 -spams-start 5 -append -corpus zip -logs exim,postfix -summary
+// Publishing the rows to NSQ: -output mock-zix-usage -rows 100000 -nsqd 127.0.0.1:4151 -nsq-topic zix_usage -nsq-rate 500
+// Timestamps a fragile parser may trip on: -output mock-zix-usage -rows 1000 -timezone Europe/Paris -timestamp-mix -dst overlap -dst-rate 0.1
+// Addresses a dedup may trip on: -output mock-zix-usage -rows 1000 -addresses plus=0.2,idn=0.1,punycode=0.1,case=0.1
+// Fixtures for charset detection: -output mock-zix-usage -rows 1000 -addresses utf8=0.3 -delimiter semicolon -crlf -encoding windows-1252
+// Validating a usage file: validate -format json ./output/mock-zix-usage.csv
+// Anonymizing a real export: anonymize -key secret -shift -720h export.csv ./output/fixture.csv
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "anonymize" {
+		os.Exit(runAnonymize(os.Args[2:], os.Stdout))
+	}
+
 	flag.StringVar(&fileName, "output", "", "Name of the output file")
 	flag.IntVar(&numberOfRows, "rows", 0, "Number of rows")
 	flag.IntVar(&numberOfSpamRows, "spams", 0, "Number of Spam")
-	flag.IntVar(&spamStartLine, "spams-start", 1, "Line in which spam starts")
-	flag.BoolVar(&append, "append", false, "Indicates if should append to the file or override")
-
+	flag.IntVar(&spamStartLine, "spams-start", 1, "Line in which spam starts, counted from the last existing row with -append")
+	flag.BoolVar(&appendMode, "append", false, "Indicates if should continue the existing file or override; refused if its header does not match")
+	flag.StringVar(&corpusFormat, "corpus", "", "Also generate an .eml message per written row, packed as zip or mbox; not with -append")
+	flag.StringVar(&mailLogFormats, "logs", "", "Also log the written rows as mail server traffic, as comma separated exim and/or postfix")
+	flag.Float64Var(&bounceRate, "bounce-rate", 0.02, "Share of logged messages that bounce")
+	flag.Float64Var(&deferRate, "defer-rate", 0.05, "Share of logged messages that are deferred once before delivery")
+	flag.IntVar(&numberOfShards, "shards", 1, "Number of shards generated in parallel, named <output>-<shard>-<part>.csv with an index")
+	flag.IntVar(&maxRowsPerFile, "max-rows", 0, "Rotate sharded output to a new part after this many rows")
+	flag.Int64Var(&maxBytesPerFile, "max-bytes", 0, "Rotate sharded output to a new part before it exceeds this many bytes")
+	flag.BoolVar(&writeSummary, "summary", false, "Also write the expected aggregates of the output as <output>.summary.json")
+	flag.StringVar(&mailDomain, "mail-domain", "zix.example", "Domain of the receiving mail host in Message-ID and Received headers and mail logs")
+	flag.StringVar(&nsqdAddress, "nsqd", "", "Also publish the written rows as JSON messages to this nsqd HTTP address")
+	flag.StringVar(&nsqTopic, "nsq-topic", "zix_usage", "NSQ topic of the published rows")
+	flag.IntVar(&nsqBatchSize, "nsq-batch", 100, "Rows published per /mpub request; one /pub per row if 1")
+	flag.Float64Var(&nsqRate, "nsq-rate", 0, "Rows published per second, unlimited if 0")
+	flag.DurationVar(&nsqDefer, "nsq-defer", 0, "Delay the delivery of the published rows by nsqd; rows are then published one /pub at a time")
+
+	flag.StringVar(&timestampLayout, "timestamp-layout", "", "Go time layout, or strftime pattern if it contains %, of the sent timestamps; "+usagegen.DefaultLayout+" if empty")
+	flag.StringVar(&timeZone, "timezone", "", "IANA time zone of the sent timestamps, UTC if empty")
+	flag.BoolVar(&utcOffset, "utc-offset", false, "Append the UTC offset to the sent timestamps, as +02:00")
+	flag.BoolVar(&timestampMix, "timestamp-mix", false, "Mix the timestamp layouts of known vendors across rows")
+	flag.StringVar(&dstMode, "dst", "", "Also generate sent timestamps in the DST gap or overlap of the time zone")
+	flag.Float64Var(&dstRate, "dst-rate", 0.05, "Share of the rows sent in the DST gap or overlap with -dst")
+	flag.StringVar(&addressMix, "addresses", "", "Comma separated kind=rate edge-case addresses among "+strings.Join(usagegen.AddressKinds, ", ")+", or all=rate; plain if empty")
+	flag.StringVar(&csvDelimiter, "delimiter", "comma", "Field delimiter: comma, semicolon, tab or pipe")
+	flag.StringVar(&csvEncoding, "encoding", usagegen.EncodingUTF8, "Character encoding: utf-8, windows-1252, iso-8859-1 or utf-16le; characters out of it are written as ?")
+	flag.BoolVar(&csvAlwaysQuote, "always-quote", false, "Quote every field, not only those that need it")
+	flag.BoolVar(&csvCRLF, "crlf", false, "End lines with CRLF rather than LF")
+	flag.BoolVar(&csvBOM, "bom", false, "Start the file with a byte order mark, in utf-8 or utf-16le")
 	flag.Parse()
 
+	parseTimestamps()
+
+	var err error
+	addresses, err = usagegen.ParseAddressMix(addressMix)
+	checkError("Invalid address mix", err)
+
+	dialect, err = usagegen.ParseDialect(csvDelimiter, csvEncoding, csvAlwaysQuote, csvCRLF, csvBOM)
+	checkError("Invalid CSV dialect", err)
+	if appendMode && !dialect.IsDefault() {
+		checkError("Invalid options", fmt.Errorf("-append is not supported with -delimiter, -encoding, -always-quote, -crlf or -bom"))
+	}
+	// The mail logs are appended to, but a zip or mbox archive and its index
+	// cannot be continued.
+	if appendMode && corpusFormat != "" {
+		checkError("Invalid options", fmt.Errorf("-append is not supported with -corpus"))
+	}
+
 	fmt.Printf("Creating file [%s] with %d rows with %d spams (starting at line %d)\n", fileName, numberOfRows, numberOfSpamRows, spamStartLine)
 
+	if numberOfShards > 1 || maxRowsPerFile > 0 || maxBytesPerFile > 0 {
+		writeShards()
+		return
+	}
+
+	path := fmt.Sprintf("./output/%s.csv", fileName)
+
 	var file *os.File
-	var rowsOffset = 0
+	existing := &ExistingFile{}
 
-	if append {
+	if appendMode {
 		var err error
-		file, err = os.OpenFile(fmt.Sprintf("./output/%s.csv", fileName), os.O_WRONLY|os.O_APPEND, 0644)
-
-		reader := io.Reader(file)
-		rowsOffset, err = countFileLines(reader)
+		existing, err = ScanExisting(path)
+		checkError("Cannot append to file", err)
 
-		fmt.Printf("Rows cont %d \n", rowsOffset)
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		checkError("Cannot open file", err)
-		if err != nil {
-			os.Exit(1)
+
+		if existing.MissingNewline {
+			_, err = file.WriteString("\n")
+			checkError("Cannot terminate the last row", err)
 		}
 
+		fmt.Printf("Continuing after %d rows (last index %d)\n", existing.Rows, existing.LastIndex)
+
 	} else {
 		var err error
 		// Creating the new file
-		file, err = os.Create(fmt.Sprintf("./output/%s.csv", fileName))
+		file, err = os.Create(path)
 		checkError("Cannot create file", err)
-		if err != nil {
-			os.Exit(1)
-		}
 	}
 
 	defer file.Close()
 
-	csvWriter := csv.NewWriter(file)
-
-	//Writes the header
-	headerErr := csvWriter.Write(header)
-	checkError("Cannot write the Header", headerErr)
+	seed := time.Now().UnixNano()
+	if corpusFormat != "" || mailLogFormats != "" {
+		messageIDs = mailcorpus.NewMessageIDs(seed)
+	}
 
-	rowsCount := 0
+	if corpusFormat != "" {
+		var err error
+		corpus, err = mailcorpus.NewWriter(path, corpusFormat, mailDomain)
+		checkError("Cannot create message corpus", err)
+	}
 
-	for i := (1 + rowsOffset); rowsCount < numberOfRows; i++ {
+	if mailLogFormats != "" {
+		if bounceRate < 0 || deferRate < 0 || bounceRate+deferRate > 1 {
+			checkError("Invalid rates", fmt.Errorf("bounce rate %v and defer rate %v must not be negative and add up to at most 1", bounceRate, deferRate))
+		}
+		for _, format := range strings.Split(mailLogFormats, ",") {
+			l, err := NewMailLogWriter(path, strings.TrimSpace(format), mailDomain, messageIDs, seed, appendMode)
+			checkError("Cannot create mail log", err)
+			l.BounceRate = bounceRate
+			l.DeferRate = deferRate
+			mailLogs = append(mailLogs, l)
+		}
+	}
 
-		sendDate := createRandomDateAsString()
+	if nsqdAddress != "" {
+		var err error
+		publisher, err = NewUsagePublisher(nsqpub.Options{
+			Addr:      nsqdAddress,
+			Topic:     nsqTopic,
+			BatchSize: nsqBatchSize,
+			Rate:      nsqRate,
+			Defer:     nsqDefer,
+		})
+		checkError("Cannot setup NSQ publishing", err)
+	}
 
-		if numberOfSpamRows > 0 && spamStartLine == i {
+	csvWriter := newRecordWriter(file)
 
-			for y := 1; y <= numberOfSpamRows; y++ {
-				writeCSVLine(i, sendDate, csvWriter)
-				rowsCount++
-			}
+	//Writes the header
+	if !existing.HasHeader {
+		headerErr := csvWriter.Write(header)
+		checkError("Cannot write the Header", headerErr)
+	}
 
-		} else {
-			writeCSVLine(i, sendDate, csvWriter)
-			rowsCount++
+	// Appended rows continue the index, and the spam start line counts from it.
+	g := usagegen.New(usagegen.Options{
+		Rows:       numberOfRows,
+		Seed:       seed,
+		Spams:      numberOfSpamRows,
+		SpamStart:  spamStartLine,
+		FirstIndex: existing.LastIndex + 1,
+		Formats:    timestamps,
+		DST:        dstMode,
+		DSTRate:    dstRate,
+		Addresses:  addresses,
+	})
+	for g.Next() {
+		row := g.Row()
+		err := csvWriter.Write(row.Record)
+		checkError("Cannot write the record ["+row.Record.String()+"]", err)
+
+		if row.Spam {
+			addSpamRow(row.Index, existing.Rows+row.Number)
+		}
+		writeMessage(existing.Rows+row.Number, row.Date, row.Record)
+		if publisher != nil {
+			publisher.Write(existing.Rows+row.Number, row.Record)
 		}
-
 	}
 
 	// Write any buffered data to the underlying writer (standard output).
@@ -111,74 +244,150 @@ func main() {
 	wErr := csvWriter.Error()
 	checkError("Error after flushing flushing", wErr)
 
-}
+	if corpus != nil {
+		checkError("Cannot write the message corpus", corpus.Close())
+		fmt.Printf("Wrote %d messages to [%s]\n", corpus.Messages, mailcorpus.ArchiveName(fileName, corpusFormat))
+	}
 
-func createRandomDateAsString() string {
+	for _, l := range mailLogs {
+		checkError("Cannot write the mail log", l.Close())
+		fmt.Printf("Logged %d delivered, %d deferred and %d bounced messages to [%s]\n", l.Delivered, l.Deferred, l.Bounced, MailLogName(fileName, l.Format))
+	}
 
-	year := 2018
-	month := 10
-	day := rand.Intn(30) + 1
+	if publisher != nil {
+		err := publisher.Close()
+		stats := publisher.Stats()
+		fmt.Printf("Published %d messages to topic [%s] in %d requests\n", stats.Published, publisher.Topic, stats.Requests)
+		checkError("Cannot publish to nsqd", err)
+	}
 
-	hour := rand.Intn(12) + 1
-	minute := rand.Intn(59)
-	// second := rand.Intn(59)
+	if writeSummary {
+		checkError("Cannot close file", file.Close())
 
-	// var meridiem string
-	// mChoose := rand.Intn(2)
-	// if mChoose == 0 {
-	// 	meridiem = "AM"
-	// } else {
-	// 	meridiem = "PM"
-	// }
+		// Spam injected by earlier runs is only known from their summary.
+		if appendMode && existing.HasHeader {
+			if previous, err := LoadSummary(summaryPath()); err == nil {
+				spam = append(previous.Spam, spam...)
+			}
+		}
+		saveSummary([]string{path})
+	}
+
+}
+
+// recordWriter writes CSV records, as csv.Writer and usagegen.DialectWriter do.
+type recordWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
 
-	return fmt.Sprintf(DateFormat, day, month, year, hour, minute)
+// newRecordWriter returns a writer of records to w, in the dialect.
+func newRecordWriter(w io.Writer) recordWriter {
+	if dialect.IsDefault() {
+		return csv.NewWriter(w)
+	}
+	return dialect.NewWriter(w)
 }
 
-func writeCSVLine(index int, sendDate string, w *csv.Writer) {
-	record := Record{
-		fmt.Sprintf(SenderAddress, index, index),
-		fmt.Sprintf(ReceiverAddress, index, index),
-		sendDate,
-		fmt.Sprintf(Subject, index),
-		PolicyTypes,
-		PolicyNames,
-		DeliveryMethod,
-	}
-	err := w.Write(record)
-	checkError("Cannot write the record ["+record.toString()+"]", err)
+// parseTimestamps sets up the formats of the sent timestamps. The summary
+// counts rows per day, so it only reads the default format.
+func parseTimestamps() {
+	var err error
+	timestamps, err = usagegen.ParseFormats(timestampLayout, timeZone, utcOffset, timestampMix)
+	checkError("Invalid timestamp options", err)
+
+	err = usagegen.CheckDST(usagegen.Options{Formats: timestamps, DST: dstMode, DSTRate: dstRate})
+	checkError("Invalid timestamp options", err)
+
+	if writeSummary && (timestamps != nil || dstMode != "") {
+		checkError("Invalid options", fmt.Errorf("-summary is not supported with -timestamp-layout, -timezone, -utc-offset, -timestamp-mix or -dst"))
+	}
 }
 
-func countFileLines(r io.Reader) (int, error) {
-	buf := make([]byte, 32*1024)
-	count := 0
-	lineSep := []byte{'\n'}
+// writeShards writes the rows as sharded, rotated files with an index.
+func writeShards() {
+	if appendMode || corpusFormat != "" || mailLogFormats != "" || nsqdAddress != "" {
+		checkError("Invalid options", fmt.Errorf("-append, -corpus, -logs and -nsqd are not supported with -shards, -max-rows or -max-bytes"))
+	}
 
-	for {
-		c, err := r.Read(buf)
-		fmt.Println("Count lines")
-		count += bytes.Count(buf[:c], lineSep)
+	files, err := WriteShards("./output", fileName, numberOfRows, numberOfShards, maxRowsPerFile, maxBytesPerFile, time.Now().UnixNano())
+	checkError("Cannot write the shards", err)
 
-		switch {
-		case err == io.EOF:
-			return count, nil
+	fmt.Printf("Wrote %d files, listed in [%s]\n", len(files), ShardIndexName(fileName))
 
-		case err != nil:
-			return count, err
+	if writeSummary {
+		paths := make([]string, len(files))
+		for i, f := range files {
+			paths[i] = "./output/" + f.Name
 		}
+		if numberOfSpamRows > 0 && spamStartLine <= numberOfRows {
+			rows := numberOfSpamRows
+			if spamStartLine+rows-1 > numberOfRows {
+				rows = numberOfRows - spamStartLine + 1
+			}
+			spam = append(spam, spamInjection(spamStartLine, spamStartLine, rows, 0))
+		}
+		saveSummary(paths)
 	}
 }
 
-func checkError(msg string, err error) {
-	if err != nil {
-		log.Fatalln(msg, err)
+// spamInjection describes rows spam rows of index starting at row firstRow,
+// on the file line after it plus lineOffset; no lines for a zero lineOffset.
+func spamInjection(index, firstRow, rows, lineOffset int) SpamInjection {
+	injection := SpamInjection{Index: index, Rows: rows, FirstRow: firstRow, LastRow: firstRow + rows - 1}
+	if lineOffset > 0 {
+		injection.FirstLine = injection.FirstRow + lineOffset
+		injection.LastLine = injection.LastRow + lineOffset
 	}
+	return injection
 }
 
-func (r Record) toString() string {
-	var buffer bytes.Buffer
-	for _, column := range r {
-		buffer.WriteString(column)
+// addSpamRow records a spam row of index at row of the file.
+func addSpamRow(index, row int) {
+	if n := len(spam) - 1; n >= 0 && spam[n].Index == index && spam[n].LastRow == row-1 {
+		spam[n].Rows++
+		spam[n].LastRow++
+		spam[n].LastLine++
+		return
+	}
+	spam = append(spam, spamInjection(index, row, 1, 1))
+}
+
+func summaryPath() string {
+	return "./output/" + SummaryName(fileName)
+}
+
+// saveSummary writes the summary of the written files and the injected spam.
+func saveSummary(paths []string) {
+	summary, err := BuildSummary(paths, spam)
+	checkError("Cannot summarize the output", err)
+	checkError("Cannot write the summary", WriteSummary(summaryPath(), summary))
+	fmt.Printf("Summarized %d rows in [%s]\n", summary.Rows, SummaryName(fileName))
+}
+
+// writeMessage adds the message of a written row to the corpus and mail logs, if any.
+func writeMessage(row int, sendDate time.Time, record usagegen.Record) {
+	if messageIDs == nil {
+		return
+	}
+	sent, msgID := messageIDs.Next(sendDate)
+
+	if corpus != nil {
+		err := corpus.Write(row, sent, msgID, record)
+		checkError("Cannot write the message for ["+record.String()+"]", err)
 	}
 
-	return buffer.String()
+	if len(mailLogs) > 0 {
+		size := len(mailcorpus.BuildMessage(mailDomain, row, sent, msgID, record))
+		for _, l := range mailLogs {
+			l.Write(sent, msgID, size, record)
+		}
+	}
+}
+
+func checkError(msg string, err error) {
+	if err != nil {
+		log.Fatalln(msg, err)
+	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/fbatroni/fusemail/go-utils/nsqpub"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// UsageMessage is a written row, as published to NSQ.
+type UsageMessage struct {
+	Row              int    `json:"row"`
+	SenderAddress    string `json:"senderAddress"`
+	RecipientAddress string `json:"recipientAddress"`
+	SentTimestamp    string `json:"sentTimestamp"`
+	Subject          string `json:"subject"`
+	PolicyTypes      string `json:"policyTypes"`
+	PolicyNames      string `json:"policyNames"`
+	DeliveryMethod   string `json:"deliveryMethod"`
+}
+
+// NewUsageMessage returns the message of record, written at row of the file.
+func NewUsageMessage(row int, record usagegen.Record) UsageMessage {
+	return UsageMessage{
+		Row:              row,
+		SenderAddress:    record[0],
+		RecipientAddress: record[1],
+		SentTimestamp:    record[2],
+		Subject:          record[3],
+		PolicyTypes:      record[4],
+		PolicyNames:      record[5],
+		DeliveryMethod:   record[6],
+	}
+}
+
+// UsagePublisher publishes the written rows to an nsqd. Failed publications
+// are logged as they happen and reported by Close, without stopping the run.
+type UsagePublisher struct {
+	Topic string
+
+	publisher *nsqpub.Publisher
+	lastErr   error
+}
+
+// NewUsagePublisher constructs a UsagePublisher.
+func NewUsagePublisher(opts nsqpub.Options) (*UsagePublisher, error) {
+	p, err := nsqpub.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &UsagePublisher{Topic: opts.Topic, publisher: p}, nil
+}
+
+// Write publishes the message of record, written at row of the file.
+func (u *UsagePublisher) Write(row int, record usagegen.Record) {
+	msg, err := json.Marshal(NewUsageMessage(row, record))
+	if err == nil {
+		err = u.publisher.Publish(msg)
+	}
+	u.failed(err)
+}
+
+func (u *UsagePublisher) failed(err error) {
+	if err != nil {
+		log.Println("Cannot publish to nsqd", err)
+		u.lastErr = err
+	}
+}
+
+// Close publishes the pending messages, and returns an error if any failed.
+func (u *UsagePublisher) Close() error {
+	u.failed(u.publisher.Flush())
+	if stats := u.Stats(); stats.Failed > 0 {
+		return fmt.Errorf("%d of %d messages not published, last error: %v", stats.Failed, stats.Failed+stats.Published, u.lastErr)
+	}
+	return nil
+}
+
+// Stats returns the counts so far.
+func (u *UsagePublisher) Stats() nsqpub.Stats {
+	return u.publisher.Stats()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fbatroni/fusemail/go-utils/nsqpub"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+func TestUsagePublisher(t *testing.T) {
+	fake := &nsqpub.FakeNSQD{}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	u, err := NewUsagePublisher(nsqpub.Options{Addr: ts.URL, Topic: "zix_usage", BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for row := 1; row <= 3; row++ {
+		u.Write(row, usagegen.NewRecord(row, 2, "1/10/2018 0:0"))
+	}
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := fake.Messages()
+	if len(got) != 3 || fake.Requests() != 2 {
+		t.Fatalf("%d messages in %d requests", len(got), fake.Requests())
+	}
+	for i, m := range got {
+		var msg UsageMessage
+		if err := json.Unmarshal(m.Body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if want := NewUsageMessage(i+1, usagegen.NewRecord(i+1, 2, "1/10/2018 0:0")); msg != want || m.Topic != "zix_usage" {
+			t.Errorf("message %d = %+v on %s", i, msg, m.Topic)
+		}
+	}
+}
+
+func TestUsagePublisher_Error(t *testing.T) {
+	ts := httptest.NewServer(&nsqpub.FakeNSQD{FailStatus: http.StatusInternalServerError})
+	defer ts.Close()
+
+	u, err := NewUsagePublisher(nsqpub.Options{Addr: ts.URL, Topic: "zix_usage", BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for row := 1; row <= 3; row++ {
+		u.Write(row, usagegen.NewRecord(row, 1, "1/10/2018 0:0"))
+	}
+	if err := u.Close(); err == nil || u.Stats().Failed != 3 {
+		t.Errorf("Close() = %v, stats %+v", err, u.Stats())
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// ShardName formats the names of sharded files: <name>-<shard>-<part>.csv.
+const ShardName = "%s-%03d-%04d.csv"
+
+var shardIndexHeader = []string{"file", "shard", "part", "rows", "bytes", "sha256"}
+
+// ShardFile is an entry of the shard index.
+type ShardFile struct {
+	Name   string
+	Shard  int
+	Part   int
+	Rows   int
+	Bytes  int64
+	SHA256 string
+}
+
+// ShardIndexName returns the name of the index listing the files of a sharded output.
+func ShardIndexName(name string) string {
+	return name + ".index.csv"
+}
+
+// WriteShards writes rows rows into dir split in shards generated in parallel,
+// each rotated at maxRows rows or maxBytes bytes if set, and writes the index.
+func WriteShards(dir, name string, rows, shards, maxRows int, maxBytes int64, seed int64) ([]ShardFile, error) {
+	if shards < 1 {
+		shards = 1
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		files []ShardFile
+		first error
+	)
+	workers := make(chan struct{}, runtime.NumCPU())
+
+	for shard := 0; shard < shards; shard++ {
+		// Contiguous row ranges, so numbering matches an unsharded file.
+		lo, hi := rows*shard/shards, rows*(shard+1)/shards
+
+		wg.Add(1)
+		go func(shard, lo, hi int) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			w := &rotatingWriter{dir: dir, name: name, shard: shard + 1, maxRows: maxRows, maxBytes: maxBytes}
+			err := w.writeRows(lo, hi, seed+int64(shard))
+
+			mu.Lock()
+			defer mu.Unlock()
+			files = append(files, w.files...)
+			if err != nil && first == nil {
+				first = err
+			}
+		}(shard, lo, hi)
+	}
+	wg.Wait()
+
+	if first != nil {
+		return files, first
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Shard != files[j].Shard {
+			return files[i].Shard < files[j].Shard
+		}
+		return files[i].Part < files[j].Part
+	})
+	return files, writeShardIndex(filepath.Join(dir, ShardIndexName(name)), files)
+}
+
+func writeShardIndex(path string, files []ShardFile) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write(shardIndexHeader) // nolint:errcheck
+	for _, f := range files {
+		w.Write([]string{ // nolint:errcheck
+			f.Name,
+			strconv.Itoa(f.Shard),
+			strconv.Itoa(f.Part),
+			strconv.Itoa(f.Rows),
+			strconv.FormatInt(f.Bytes, 10),
+			f.SHA256,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// rotatingWriter writes the rows of a shard, starting a new part with its own
+// header when the current one reaches maxRows or would exceed maxBytes.
+type rotatingWriter struct {
+	dir      string
+	name     string
+	shard    int
+	maxRows  int
+	maxBytes int64
+
+	files []ShardFile
+	file  *os.File
+	out   *bufio.Writer
+	sum   hash.Hash
+
+	// Each row is encoded here first, to know its size before writing it.
+	row    bytes.Buffer
+	enc    recordWriter
+	header []byte
+}
+
+func (w *rotatingWriter) writeRows(lo, hi int, seed int64) error {
+	w.enc = newRecordWriter(&w.row)
+	w.enc.Write(header) // nolint:errcheck
+	w.enc.Flush()
+	w.header = append([]byte(nil), w.row.Bytes()...)
+
+	g := usagegen.New(usagegen.Options{
+		Rows:      hi,
+		Skip:      lo,
+		Seed:      seed,
+		Spams:     numberOfSpamRows,
+		SpamStart: spamStartLine,
+		Formats:   timestamps,
+		DST:       dstMode,
+		DSTRate:   dstRate,
+		Addresses: addresses,
+	})
+	for g.Next() {
+		if err := w.write(g.Row().Record); err != nil {
+			return err
+		}
+	}
+	return w.close()
+}
+
+func (w *rotatingWriter) write(record usagegen.Record) error {
+	w.row.Reset()
+	w.enc.Write(record) // nolint:errcheck
+	w.enc.Flush()
+	if err := w.enc.Error(); err != nil {
+		return err
+	}
+
+	if w.file == nil || w.full(int64(w.row.Len())) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	current := &w.files[len(w.files)-1]
+	current.Rows++
+	current.Bytes += int64(w.row.Len())
+	_, err := w.out.Write(w.row.Bytes())
+	return err
+}
+
+// full reports whether the current part cannot take another row of size bytes.
+// A part always gets at least one row.
+func (w *rotatingWriter) full(size int64) bool {
+	current := w.files[len(w.files)-1]
+	if current.Rows == 0 {
+		return false
+	}
+	return (w.maxRows > 0 && current.Rows >= w.maxRows) ||
+		(w.maxBytes > 0 && current.Bytes+size > w.maxBytes)
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	part := len(w.files) + 1
+	name := fmt.Sprintf(ShardName, w.name, w.shard, part)
+	file, err := os.Create(filepath.Join(w.dir, name))
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.sum = sha256.New()
+	w.out = bufio.NewWriterSize(io.MultiWriter(file, w.sum), 64*1024)
+	w.files = append(w.files, ShardFile{Name: name, Shard: w.shard, Part: part, Bytes: int64(len(w.header))})
+
+	_, err = w.out.Write(w.header)
+	return err
+}
+
+func (w *rotatingWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.out.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.files[len(w.files)-1].SHA256 = hex.EncodeToString(w.sum.Sum(nil))
+	w.file = nil
+	return err
+}
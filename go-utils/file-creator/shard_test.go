@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+func TestWriteShards(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     int
+		shards   int
+		maxRows  int
+		maxBytes int64
+		files    int
+	}{
+		{"shards only", 100, 4, 0, 0, 4},
+		{"rotated by rows", 100, 2, 20, 0, 6},
+		{"rotated by bytes", 100, 1, 0, 4000, 0},
+		{"fewer rows than shards", 2, 4, 0, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "shards")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			files, err := WriteShards(dir, "usage", tt.rows, tt.shards, tt.maxRows, tt.maxBytes, 42)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.files > 0 && len(files) != tt.files {
+				t.Errorf("wrote %d files, want %d", len(files), tt.files)
+			}
+
+			f, _ := os.Open(filepath.Join(dir, ShardIndexName("usage")))
+			defer f.Close()
+			index, err := csv.NewReader(f).ReadAll()
+			if err != nil || len(index) != len(files)+1 {
+				t.Fatalf("index: %v, %d lines", err, len(index))
+			}
+
+			rows, next := 0, 1
+			for _, entry := range index[1:] {
+				b, _ := ioutil.ReadFile(filepath.Join(dir, entry[0]))
+				sum := sha256.Sum256(b)
+				if entry[5] != hex.EncodeToString(sum[:]) || entry[4] != strconv.Itoa(len(b)) {
+					t.Errorf("%s: index size or checksum does not match the file", entry[0])
+				}
+				if tt.maxBytes > 0 && int64(len(b)) > tt.maxBytes {
+					t.Errorf("%s: %d bytes exceeds %d", entry[0], len(b), tt.maxBytes)
+				}
+
+				content, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+				if err != nil || content[0][0] != header[0] {
+					t.Fatalf("%s: no header: %v", entry[0], err)
+				}
+				if n, _ := strconv.Atoi(entry[3]); n != len(content)-1 || (tt.maxRows > 0 && n > tt.maxRows) {
+					t.Errorf("%s: index rows %s, file has %d", entry[0], entry[3], len(content)-1)
+				}
+				for _, record := range content[1:] {
+					if want := usagegen.NewRecord(next, next, "")[0]; record[0] != want {
+						t.Fatalf("%s: sender %s, want %s", entry[0], record[0], want)
+					}
+					next++
+					rows++
+				}
+			}
+			if rows != tt.rows {
+				t.Errorf("wrote %d rows, want %d", rows, tt.rows)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// SummaryName returns the name of the ground-truth summary of a generated file.
+func SummaryName(name string) string {
+	return name + ".summary.json"
+}
+
+// SpamInjection describes a run of spam rows repeating the same index.
+// Rows are numbered from 1 across all files; lines are set for single files.
+type SpamInjection struct {
+	Index     int `json:"index"`
+	Rows      int `json:"rows"`
+	FirstRow  int `json:"firstRow"`
+	LastRow   int `json:"lastRow"`
+	FirstLine int `json:"firstLine,omitempty"`
+	LastLine  int `json:"lastLine,omitempty"`
+}
+
+// Distinct holds the number of distinct values of the summarized rows.
+type Distinct struct {
+	Senders          int `json:"senders"`
+	Recipients       int `json:"recipients"`
+	SenderDomains    int `json:"senderDomains"`
+	RecipientDomains int `json:"recipientDomains"`
+	Subjects         int `json:"subjects"`
+	Days             int `json:"days"`
+}
+
+// Summary holds the expected aggregates of generated data, to assert on in
+// pipeline tests.
+type Summary struct {
+	Files                  []string        `json:"files"`
+	Rows                   int             `json:"rows"`
+	RowsPerSenderDomain    map[string]int  `json:"rowsPerSenderDomain"`
+	RowsPerRecipientDomain map[string]int  `json:"rowsPerRecipientDomain"`
+	RowsPerDay             map[string]int  `json:"rowsPerDay"`
+	SpamRows               int             `json:"spamRows"`
+	Spam                   []SpamInjection `json:"spam"`
+	Distinct               Distinct        `json:"distinct"`
+}
+
+// BuildSummary aggregates the rows of usage files, in order.
+func BuildSummary(paths []string, spam []SpamInjection) (*Summary, error) {
+	s := &Summary{
+		Files:                  []string{},
+		RowsPerSenderDomain:    make(map[string]int),
+		RowsPerRecipientDomain: make(map[string]int),
+		RowsPerDay:             make(map[string]int),
+		Spam:                   []SpamInjection{},
+	}
+	senders := make(map[string]bool)
+	recipients := make(map[string]bool)
+	subjects := make(map[string]bool)
+
+	for _, path := range paths {
+		if err := s.add(path, senders, recipients, subjects); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, injection := range spam {
+		s.Spam = append(s.Spam, injection)
+		s.SpamRows += injection.Rows
+	}
+
+	s.Distinct = Distinct{
+		Senders:          len(senders),
+		Recipients:       len(recipients),
+		SenderDomains:    len(s.RowsPerSenderDomain),
+		RecipientDomains: len(s.RowsPerRecipientDomain),
+		Subjects:         len(subjects),
+		Days:             len(s.RowsPerDay),
+	}
+	return s, nil
+}
+
+func (s *Summary) add(path string, senders, recipients, subjects map[string]bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := dialect.NewReader(file)
+	reader.FieldsPerRecord = len(header)
+	reader.ReuseRecord = true
+	if _, err := reader.Read(); err != nil {
+		return fmt.Errorf("%s: cannot read header: %v", path, err)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		s.Rows++
+		senders[record[0]] = true
+		recipients[record[1]] = true
+		subjects[record[3]] = true
+		s.RowsPerSenderDomain[strings.ToLower(domainOf(record[0]))]++
+		s.RowsPerRecipientDomain[strings.ToLower(domainOf(record[1]))]++
+
+		if date, err := usagegen.ParseDate(record[2]); err == nil {
+			s.RowsPerDay[date.Format("2006-01-02")]++
+		}
+	}
+
+	s.Files = append(s.Files, path[strings.LastIndex(path, "/")+1:])
+	return nil
+}
+
+// LoadSummary reads a summary written by WriteSummary.
+func LoadSummary(path string) (*Summary, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Summary{}
+	return s, json.Unmarshal(b, s)
+}
+
+// WriteSummary writes s as indented JSON.
+func WriteSummary(path string, s *Summary) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
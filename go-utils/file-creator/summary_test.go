@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+func TestBuildSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, records ...usagegen.Record) string {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		w := csv.NewWriter(file)
+		w.Write(header) // nolint:errcheck
+		for _, r := range records {
+			w.Write(r) // nolint:errcheck
+		}
+		w.Flush()
+		return path
+	}
+
+	// Index 2 is spam, repeated 3 times from row 2.
+	a := write("a.csv", usagegen.NewRecord(1, 1, "1/10/2018 1:5"), usagegen.NewRecord(2, 2, "2/10/2018 3:4"), usagegen.NewRecord(2, 2, "2/10/2018 3:4"))
+	b := write("b.csv", usagegen.NewRecord(2, 2, "2/10/2018 3:4"), usagegen.NewRecord(3, 3, "30/10/2018 12:0"))
+	spam := []SpamInjection{spamInjection(2, 2, 3, 0)}
+
+	got, err := BuildSummary([]string{a, b}, spam)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Summary{
+		Files:                  []string{"a.csv", "b.csv"},
+		Rows:                   5,
+		RowsPerSenderDomain:    map[string]int{"sender1.com": 1, "sender2.com": 3, "sender3.com": 1},
+		RowsPerRecipientDomain: map[string]int{"receiver1.com": 1, "receiver2.com": 3, "receiver3.com": 1},
+		RowsPerDay:             map[string]int{"2018-10-01": 1, "2018-10-02": 3, "2018-10-30": 1},
+		SpamRows:               3,
+		Spam:                   []SpamInjection{{Index: 2, Rows: 3, FirstRow: 2, LastRow: 4}},
+		Distinct:               Distinct{Senders: 3, Recipients: 3, SenderDomains: 3, RecipientDomains: 3, Subjects: 3, Days: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	path := filepath.Join(dir, SummaryName("a"))
+	if err := WriteSummary(path, got); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSummary(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, want) {
+		t.Errorf("loaded %+v\nwant %+v", loaded, want)
+	}
+
+	if _, err := BuildSummary([]string{filepath.Join(dir, "missing.csv")}, nil); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestSpamInjection(t *testing.T) {
+	got := spamInjection(5, 7, 4, 1)
+	want := SpamInjection{Index: 5, Rows: 4, FirstRow: 7, LastRow: 10, FirstLine: 8, LastLine: 11}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
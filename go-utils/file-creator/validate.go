@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// ValidationError is a problem found at a line and column of a usage file.
+type ValidationError struct {
+	Line    int    `json:"line"`
+	Column  string `json:"column,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) String() string {
+	switch {
+	case e.Column == "":
+		return fmt.Sprintf("%d: %s", e.Line, e.Message)
+	case e.Value == "":
+		return fmt.Sprintf("%d: %s: %s", e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%d: %s: %s (%q)", e.Line, e.Column, e.Message, e.Value)
+}
+
+// ValidationReport is the result of validating a usage file.
+type ValidationReport struct {
+	File       string            `json:"file"`
+	Rows       int               `json:"rows"`
+	Valid      bool              `json:"valid"`
+	ErrorCount int               `json:"errorCount"`
+	Errors     []ValidationError `json:"errors"`
+
+	maxErrors int
+}
+
+func (r *ValidationReport) add(e ValidationError) {
+	r.ErrorCount++
+	if r.maxErrors <= 0 || len(r.Errors) < r.maxErrors {
+		r.Errors = append(r.Errors, e)
+	}
+}
+
+// Validator checks usage files against header and the allowed enum values.
+type Validator struct {
+	PolicyTypes     []string
+	PolicyNames     []string
+	DeliveryMethods []string
+
+	// Errors listed in the report; all are counted. Zero for no limit.
+	MaxErrors int
+
+	// Dialect of the files, the encoding/csv default if zero.
+	Dialect usagegen.Dialect
+
+	// Formats of the sent timestamps, one of which each must match;
+	// DateFormat if none.
+	Formats []*usagegen.TimestampFormat
+}
+
+// NewValidator constructs a Validator accepting the values file-creator generates.
+func NewValidator() *Validator {
+	return &Validator{
+		PolicyTypes:     splitList(usagegen.PolicyTypes),
+		PolicyNames:     splitList(usagegen.PolicyNames),
+		DeliveryMethods: []string{usagegen.DeliveryMethod},
+		MaxErrors:       100,
+	}
+}
+
+// Validate reads a usage CSV from r and reports every schema violation.
+// Lines are counted as records, plus one for the header.
+func (v *Validator) Validate(name string, r io.Reader) *ValidationReport {
+	report := &ValidationReport{File: name, Errors: []ValidationError{}, maxErrors: v.MaxErrors}
+
+	reader := v.Dialect.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	got, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("empty file, expected a header")
+		}
+		report.add(ValidationError{Line: 1, Message: err.Error()})
+		return report
+	}
+	v.checkHeader(report, got)
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				line = perr.Line
+			}
+			report.add(ValidationError{Line: line, Message: err.Error()})
+			break
+		}
+		report.Rows++
+		v.checkRecord(report, line, record)
+	}
+
+	report.Valid = report.ErrorCount == 0
+	return report
+}
+
+func (v *Validator) checkHeader(report *ValidationReport, got []string) {
+	for i, want := range header {
+		switch {
+		case i >= len(got):
+			report.add(ValidationError{Line: 1, Column: want, Message: "missing column"})
+		case got[i] != want:
+			report.add(ValidationError{Line: 1, Column: want, Value: got[i], Message: fmt.Sprintf("column %d should be %s", i+1, want)})
+		}
+	}
+	if len(got) > len(header) {
+		for _, extra := range got[len(header):] {
+			report.add(ValidationError{Line: 1, Column: extra, Value: extra, Message: "unexpected column"})
+		}
+	}
+}
+
+func (v *Validator) checkRecord(report *ValidationReport, line int, record []string) {
+	if len(record) != len(header) {
+		report.add(ValidationError{Line: line, Message: fmt.Sprintf("%d columns, expected %d", len(record), len(header))})
+		return
+	}
+
+	fail := func(column int, message string) {
+		report.add(ValidationError{Line: line, Column: header[column], Value: record[column], Message: message})
+	}
+
+	for _, column := range []int{0, 1} {
+		if err := checkAddress(record[column]); err != nil {
+			fail(column, err.Error())
+		}
+	}
+	if err := v.checkTimestamp(record[2]); err != nil {
+		fail(2, err.Error())
+	}
+	if err := checkList(record[4], v.PolicyTypes); err != nil {
+		fail(4, err.Error())
+	}
+	if err := checkList(record[5], v.PolicyNames); err != nil {
+		fail(5, err.Error())
+	}
+	if !contains(v.DeliveryMethods, record[6]) {
+		fail(6, fmt.Sprintf("not one of %s", strings.Join(v.DeliveryMethods, ", ")))
+	}
+}
+
+// checkAddress accepts a bare addr-spec, without display name or angle brackets.
+func checkAddress(s string) error {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return fmt.Errorf("invalid email address: %v", strings.TrimPrefix(err.Error(), "mail: "))
+	}
+	if addr.Name != "" || addr.Address != unquoteLocal(s) {
+		return fmt.Errorf("expected a bare email address")
+	}
+	return nil
+}
+
+// unquoteLocal returns s with its local part unquoted if a quoted string, as
+// net/mail parses it: "sender 1"@sender1.com is sender 1@sender1.com.
+func unquoteLocal(s string) string {
+	at := strings.LastIndex(s, "@")
+	if at < 2 || s[0] != '"' || s[at-1] != '"' {
+		return s
+	}
+	var local []byte
+	for i := 1; i < at-1; i++ {
+		if s[i] == '\\' && i+1 < at-1 {
+			i++
+		}
+		local = append(local, s[i])
+	}
+	return string(local) + s[at:]
+}
+
+// checkTimestamp accepts timestamps of existing dates and times in one of the
+// formats, DateFormat if none.
+func (v *Validator) checkTimestamp(s string) error {
+	if len(v.Formats) == 0 {
+		_, err := usagegen.ParseDate(s)
+		return err
+	}
+	var err error
+	for _, f := range v.Formats {
+		if _, err = f.Parse(s); err == nil {
+			return nil
+		}
+	}
+	if len(v.Formats) > 1 {
+		return fmt.Errorf("timestamp matches none of the %d formats", len(v.Formats))
+	}
+	return err
+}
+
+// checkList accepts a comma separated list of allowed values.
+func checkList(s string, allowed []string) error {
+	for _, value := range splitList(s) {
+		if !contains(allowed, value) {
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	values := strings.Split(s, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runValidate runs the validate subcommand: validate [flags] <file>...
+// It returns the exit code: 0 if all files are valid, 1 if not, 2 on usage or read errors.
+func runValidate(args []string, stdout io.Writer) int {
+	v := NewValidator()
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	format := fs.String("format", "text", "Report format: text or json")
+	policyTypes := fs.String("policy-types", strings.Join(v.PolicyTypes, ","), "Allowed policy types, comma separated")
+	policyNames := fs.String("policy-names", strings.Join(v.PolicyNames, ","), "Allowed policy names, comma separated")
+	deliveryMethods := fs.String("delivery-methods", strings.Join(v.DeliveryMethods, ","), "Allowed delivery methods, comma separated")
+	fs.IntVar(&v.MaxErrors, "max-errors", v.MaxErrors, "Maximum errors listed per file; all are counted. Zero for no limit")
+	delimiter := fs.String("delimiter", "comma", "Field delimiter: comma, semicolon, tab or pipe")
+	encoding := fs.String("encoding", usagegen.EncodingUTF8, "Character encoding: utf-8, windows-1252, iso-8859-1 or utf-16le; a byte order mark is skipped")
+	layout := fs.String("timestamp-layout", "", "Go time layout, or strftime pattern if it contains %, of the sent timestamps; "+usagegen.DefaultLayout+" if empty")
+	zone := fs.String("timezone", "", "IANA time zone of the sent timestamps, UTC if empty")
+	offset := fs.Bool("utc-offset", false, "Sent timestamps end with their UTC offset, as +02:00")
+	mix := fs.Bool("timestamp-mix", false, "Accept the timestamp layouts of every known vendor")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: file-creator validate [flags] <file>...")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || (*format != "text" && *format != "json") {
+		fs.Usage()
+		return 2
+	}
+	v.PolicyTypes = splitList(*policyTypes)
+	v.PolicyNames = splitList(*policyNames)
+	v.DeliveryMethods = splitList(*deliveryMethods)
+
+	var err error
+	if v.Dialect, err = usagegen.ParseDialect(*delimiter, *encoding, false, false, false); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return 2
+	}
+	if v.Formats, err = usagegen.ParseFormats(*layout, *zone, *offset, *mix); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return 2
+	}
+
+	var reports []*ValidationReport
+	code := 0
+	for _, name := range fs.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return 2
+		}
+		report := v.Validate(name, file)
+		file.Close()
+
+		reports = append(reports, report)
+		if !report.Valid {
+			code = 1
+		}
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports) // nolint:errcheck
+		return code
+	}
+
+	for _, report := range reports {
+		for _, e := range report.Errors {
+			fmt.Fprintf(stdout, "%s:%s\n", report.File, e)
+		}
+		status := "valid"
+		if !report.Valid {
+			status = fmt.Sprintf("%d errors", report.ErrorCount)
+		}
+		fmt.Fprintf(stdout, "%s: %d rows, %s\n", report.File, report.Rows, status)
+	}
+	return code
+}
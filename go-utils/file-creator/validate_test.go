@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+func TestValidator_Validate(t *testing.T) {
+	head := strings.Join(header, ",") + "\n"
+	valid := `sender1@sender1.com,receiver1@receiver1.com,9/10/2018 5:0,Hello 1,"PolicyType1, PolicyType2","PolicyName1, PolicyName2",ZixPort` + "\n"
+
+	tests := []struct {
+		name    string
+		content string
+		want    []string // "line:column" of each error
+	}{
+		{"valid", head + valid + valid, nil},
+		{"empty", "", []string{"1:"}},
+		{"reordered header", strings.Replace(head, "subject,policyTypes", "policyTypes,subject", 1) + valid, []string{"1:subject", "1:policyTypes"}},
+		{"missing column", "senderAddress,recipientAddress,sentTimestamp,subject,policyTypes,policyNames\n", []string{"1:deliveryMethod"}},
+		{"extra column", strings.TrimSuffix(head, "\n") + ",extra\n", []string{"1:extra"}},
+		{"short row", head + "a@b.com,c@d.com\n", []string{"2:"}},
+		{"bad addresses", head + strings.Replace(strings.Replace(valid, "sender1@sender1.com", "sender1", 1), "receiver1@receiver1.com", "Receiver <r@r.com>", 1), []string{"2:senderAddress", "2:recipientAddress"}},
+		{"bad timestamps", head + strings.Replace(valid, "9/10/2018 5:0", "2018-10-09 05:00", 1) + strings.Replace(valid, "9/10/2018 5:0", "31/9/2018 5:0", 1), []string{"2:sentTimestamp", "3:sentTimestamp"}},
+		{"unknown enums", head + strings.Replace(strings.Replace(valid, "PolicyType2", "PolicyType3", 1), "ZixPort", "Fax", 1), []string{"2:policyTypes", "2:deliveryMethod"}},
+		{"broken quoting", head + valid + `a@b.com,"unterminated` + "\n", []string{"3:"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := NewValidator().Validate("usage.csv", strings.NewReader(tt.content))
+
+			var got []string
+			for _, e := range report.Errors {
+				got = append(got, strconv.Itoa(e.Line)+":"+e.Column)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("errors = %v, want %v (%v)", got, tt.want, report.Errors)
+			}
+			if report.Valid != (len(tt.want) == 0) || report.ErrorCount != len(tt.want) {
+				t.Errorf("valid = %v with %d errors", report.Valid, report.ErrorCount)
+			}
+		})
+	}
+}
+
+func TestValidator_AddressKinds(t *testing.T) {
+	mix, err := usagegen.ParseAddressMix("all=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := usagegen.WriteCSV(&buf, usagegen.Options{Rows: 400, Seed: 7, Senders: 30, Domains: 30, Addresses: mix}); err != nil {
+		t.Fatal(err)
+	}
+	if report := NewValidator().Validate("usage.csv", &buf); !report.Valid {
+		t.Errorf("edge-case addresses rejected: %v", report.Errors)
+	}
+}
+
+func TestValidator_Dialect(t *testing.T) {
+	d, err := usagegen.ParseDialect("semicolon", "utf-16le", true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := usagegen.WriteCSV(&buf, usagegen.Options{Rows: 50, Seed: 8, Dialect: d}); err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewValidator()
+	if report := v.Validate("usage.csv", bytes.NewReader(buf.Bytes())); report.Valid {
+		t.Error("UTF-16 file valid as the default dialect")
+	}
+	v.Dialect = d
+	if report := v.Validate("usage.csv", bytes.NewReader(buf.Bytes())); !report.Valid || report.Rows != 50 {
+		t.Errorf("%d rows, errors %v", report.Rows, report.Errors)
+	}
+}
+
+func TestValidator_Formats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		layout string
+		zone   string
+		offset bool
+		mix    bool
+		args   []string
+	}{
+		{"strftime layout", "%m/%d/%Y %I:%M %p", "America/New_York", false, false, []string{"-timestamp-layout", "%m/%d/%Y %I:%M %p", "-timezone", "America/New_York"}},
+		{"go layout with offset", "2 Jan 2006 15:04", "Asia/Kolkata", true, false, []string{"-timestamp-layout", "2 Jan 2006 15:04", "-timezone", "Asia/Kolkata", "-utc-offset"}},
+		{"mixed layouts", "", "Europe/Paris", false, true, []string{"-timestamp-mix", "-timezone", "Europe/Paris"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formats, err := usagegen.ParseFormats(tt.layout, tt.zone, tt.offset, tt.mix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "usage.csv")
+			file, _ := os.Create(path)
+			if _, err := usagegen.WriteCSV(file, usagegen.Options{Rows: 200, Seed: 5, Formats: formats}); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+
+			var out bytes.Buffer
+			if code := runValidate(append(tt.args, path), &out); code != 0 {
+				t.Errorf("exit %d: %s", code, out.String())
+			}
+			if code := runValidate([]string{path}, &out); code != 1 {
+				t.Errorf("exit %d without the layout flags", code)
+			}
+		})
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.csv")
+	invalid := filepath.Join(dir, "invalid.csv")
+	ioutil.WriteFile(valid, []byte(strings.Join(header, ",")+"\n"), 0644) // nolint:errcheck
+	ioutil.WriteFile(invalid, []byte("senderAddress\n"), 0644)            // nolint:errcheck
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		out  string
+	}{
+		{"valid file", []string{valid}, 0, "0 rows, valid"},
+		{"invalid file as json", []string{"-format", "json", valid, invalid}, 1, `"errorCount": 6`},
+		{"missing file", []string{filepath.Join(dir, "missing.csv")}, 2, ""},
+		{"no file", nil, 2, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			code := runValidate(tt.args, &out)
+			if code != tt.code || !strings.Contains(out.String(), tt.out) {
+				t.Errorf("exit %d, want %d; output %q should contain %q", code, tt.code, out.String(), tt.out)
+			}
+		})
+	}
+}
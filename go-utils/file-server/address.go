@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// AddressOptions configures the edge-case addresses of the reports and event
+// streams.
+type AddressOptions struct {
+	Mix string `long:"address-mix" env:"ADDRESS_MIX" description:"comma separated kind=rate edge-case addresses among utf8, idn, punycode, plus, quoted, long, case and subdomain, or all=rate; plain if empty; per request with ?addresses="`
+}
+
+// addressMix is the address mix of the reports without ?addresses= and of
+// the event streams.
+var addressMix usagegen.AddressMix
+
+// NewAddressMix returns the address mix of the options.
+func NewAddressMix(opts AddressOptions) (usagegen.AddressMix, error) {
+	return usagegen.ParseAddressMix(opts.Mix)
+}
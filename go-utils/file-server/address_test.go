@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateReport_Addresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addresses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	params, err := ParseReportParams(url.Values{"rows": {"300"}, "seed": {"5"}, "addresses": {"idn=0.5,punycode=0.5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := generateReport(dir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idn, punycode := 0, 0
+	for _, record := range records[1:] {
+		for _, address := range record[:2] {
+			switch {
+			case strings.Contains(address, "@xn--"):
+				punycode++
+			case strings.ContainsAny(address, "üпδ例"):
+				idn++
+			default:
+				t.Fatalf("plain address %q", address)
+			}
+		}
+	}
+	if idn == 0 || punycode == 0 {
+		t.Errorf("%d IDN and %d punycode addresses", idn, punycode)
+	}
+
+	for _, spec := range []string{"emoji=0.1", "plus=2", "plus=0.6,case=0.6"} {
+		if _, err := ParseReportParams(url.Values{"addresses": {spec}}); err == nil {
+			t.Errorf("addresses=%s accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Report authentication modes.
+const (
+	AuthNone   = "none"
+	AuthBasic  = "basic"
+	AuthDigest = "digest"
+	AuthForm   = "form"
+)
+
+// AuthOptions configures HTTP authentication on report endpoints.
+type AuthOptions struct {
+	Mode      string        `long:"auth-mode" env:"AUTH_MODE" default:"none" choice:"none" choice:"basic" choice:"digest" choice:"form" description:"authentication required by /report and /files"`
+	Users     []string      `long:"auth-user" env:"AUTH_USERS" env-delim:"," description:"accepted credentials as user:password"`
+	Realm     string        `long:"auth-realm" env:"AUTH_REALM" default:"file-server" description:"authentication realm"`
+	Algorithm string        `long:"auth-digest-algorithm" env:"AUTH_DIGEST_ALGORITHM" default:"MD5" choice:"MD5" choice:"SHA-256" description:"digest algorithm"`
+	NonceTTL  time.Duration `long:"auth-nonce-ttl" env:"AUTH_NONCE_TTL" default:"5m" description:"digest nonce lifetime; older nonces are rejected as stale"`
+
+	Form FormLoginOptions `group:"Form Login Options"`
+}
+
+// Authenticator guards handlers with HTTP Basic or Digest authentication,
+// or with a session started through the HTML login form.
+//
+// Digest nonces are "<unix nanos>:<hmac>" in base64, so expired nonces can
+// still be recognized and answered with stale=true instead of a plain
+// failure. Nonce counts are tracked to reject replays.
+type Authenticator struct {
+	Options AuthOptions
+	users   map[string]string
+	secret  []byte
+	opaque  string
+
+	mu     sync.Mutex
+	counts map[string]uint64 // Last nonce count seen, per nonce.
+}
+
+// NewAuthenticator constructs an Authenticator from options.
+func NewAuthenticator(opts AuthOptions) (*Authenticator, error) {
+	a := &Authenticator{
+		Options: opts,
+		users:   make(map[string]string),
+		secret:  make([]byte, 32),
+		counts:  make(map[string]uint64),
+	}
+
+	for _, u := range opts.Users {
+		parts := strings.SplitN(u, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid auth user %q, expected user:password", u)
+		}
+		a.users[parts[0]] = parts[1]
+	}
+	if opts.Mode != AuthNone && len(a.users) == 0 {
+		return nil, errors.New("auth mode " + opts.Mode + " requires at least one user")
+	}
+
+	if _, err := io.ReadFull(rand.Reader, a.secret); err != nil {
+		return nil, err
+	}
+	a.opaque = hex.EncodeToString(a.secret[:8])
+
+	return a, nil
+}
+
+// Wrap requires authentication before calling next, according to Mode.
+func (a *Authenticator) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch a.Options.Mode {
+		case AuthBasic:
+			if !a.checkBasic(r) {
+				a.challengeBasic(w)
+				return
+			}
+		case AuthDigest:
+			if ok, stale := a.checkDigest(r); !ok {
+				a.challengeDigest(w, stale)
+				return
+			}
+		case AuthForm:
+			if !HasSession(r) {
+				a.redirectToLogin(w, r)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (a *Authenticator) checkBasic(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	want, found := a.users[user]
+	return found && subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+}
+
+func (a *Authenticator) challengeBasic(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, a.Options.Realm))
+	w.WriteHeader(http.StatusUnauthorized)
+	io.WriteString(w, HttpErrors[http.StatusUnauthorized])
+}
+
+func (a *Authenticator) challengeDigest(w http.ResponseWriter, stale bool) {
+	challenge := fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=%s, nonce=%q, opaque=%q`,
+		a.Options.Realm, a.Options.Algorithm, a.newNonce(clock.Now()), a.opaque)
+	if stale {
+		challenge += ", stale=true"
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+	io.WriteString(w, HttpErrors[http.StatusUnauthorized])
+}
+
+func (a *Authenticator) newNonce(now time.Time) string {
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	return base64.StdEncoding.EncodeToString([]byte(ts + ":" + a.sign(ts)))
+}
+
+func (a *Authenticator) sign(ts string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(ts)) // nolint:errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonceIssued returns when the nonce was issued, if it was issued by a.
+func (a *Authenticator) nonceIssued(nonce string) (time.Time, bool) {
+	raw, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil {
+		return time.Time{}, false
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(a.sign(parts[0]))) {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// checkDigest validates the Digest authorization of r.
+// stale is true when the credentials are right but the nonce expired.
+func (a *Authenticator) checkDigest(r *http.Request) (ok bool, stale bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false, false
+	}
+	params := parseAuthParams(auth[len("Digest "):])
+
+	// The challenge asks for qop="auth", whose nonce count is what detects
+	// replays, so RFC 2069 responses without it are refused.
+	if params["qop"] != "auth" || params["nc"] == "" || params["cnonce"] == "" {
+		return false, false
+	}
+
+	pass, found := a.users[params["username"]]
+	if !found || params["realm"] != a.Options.Realm || params["uri"] != r.RequestURI {
+		return false, false
+	}
+
+	issued, valid := a.nonceIssued(params["nonce"])
+	if !valid {
+		return false, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(params["response"]), []byte(a.digestResponse(params, pass, r.Method))) != 1 {
+		return false, false
+	}
+
+	if clock.Since(issued) > a.Options.NonceTTL {
+		a.mu.Lock()
+		delete(a.counts, params["nonce"])
+		a.mu.Unlock()
+		return false, true
+	}
+
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil {
+		return false, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if nc <= a.counts[params["nonce"]] {
+		return false, false // Replayed nonce count.
+	}
+	a.counts[params["nonce"]] = nc
+	a.expireCounts()
+
+	return true, false
+}
+
+// expireCounts drops nonce counts of expired nonces. Must hold a.mu.
+func (a *Authenticator) expireCounts() {
+	for nonce := range a.counts {
+		if issued, _ := a.nonceIssued(nonce); clock.Since(issued) > a.Options.NonceTTL {
+			delete(a.counts, nonce)
+		}
+	}
+}
+
+// digestResponse computes the expected response as per RFC 7616.
+func (a *Authenticator) digestResponse(params map[string]string, pass, method string) string {
+	var h func() hash.Hash = md5.New
+	if a.Options.Algorithm == "SHA-256" {
+		h = sha256.New
+	}
+	sum := func(s string) string {
+		d := h()
+		io.WriteString(d, s) // nolint:errcheck
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	ha1 := sum(params["username"] + ":" + a.Options.Realm + ":" + pass)
+	ha2 := sum(method + ":" + params["uri"])
+	return sum(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+}
+
+// parseAuthParams parses comma separated key=value or key="value" pairs.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // Closing quote.
+			}
+			val = b.String()
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = val
+	}
+
+	return params
+}
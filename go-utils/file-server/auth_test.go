@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestAuthorization answers a digest challenge as a client would.
+func digestAuthorization(challenge, user, pass, method, uri, nc string) string {
+	params := parseAuthParams(strings.TrimPrefix(challenge, "Digest "))
+	ha1 := md5Hex(user + ":" + params["realm"] + ":" + pass)
+	ha2 := md5Hex(method + ":" + uri)
+	response := md5Hex(strings.Join([]string{ha1, params["nonce"], nc, "abcdef", "auth", ha2}, ":"))
+	return fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, qop=auth, nc=%s, cnonce="abcdef", response=%q, opaque=%q`,
+		user, params["realm"], params["nonce"], uri, nc, response, params["opaque"])
+}
+
+func TestAuthenticator_Basic(t *testing.T) {
+	a, err := NewAuthenticator(AuthOptions{Mode: AuthBasic, Users: []string{"zix:secret"}, Realm: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.Wrap(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		user, pass string
+		wantStatus int
+	}{
+		{"valid credentials", "zix", "secret", http.StatusOK},
+		{"wrong password", "zix", "nope", http.StatusUnauthorized},
+		{"unknown user", "other", "secret", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/report", nil)
+			r.SetBasicAuth(tt.user, tt.pass)
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), `Basic realm="test"`) {
+				t.Errorf("challenge = %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAuthenticator_Digest(t *testing.T) {
+	a, err := NewAuthenticator(AuthOptions{
+		Mode:      AuthDigest,
+		Users:     []string{"zix:secret"},
+		Realm:     "test",
+		Algorithm: "MD5",
+		NonceTTL:  time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.Wrap(func(w http.ResponseWriter, r *http.Request) {})
+
+	do := func(authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/report", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	challenge := do("").Header().Get("WWW-Authenticate")
+	if !strings.HasPrefix(challenge, "Digest ") {
+		t.Fatalf("challenge = %q", challenge)
+	}
+
+	if w := do(digestAuthorization(challenge, "zix", "secret", "GET", "/report", "00000001")); w.Code != http.StatusOK {
+		t.Errorf("valid digest: status = %d", w.Code)
+	}
+	if w := do(digestAuthorization(challenge, "zix", "secret", "GET", "/report", "00000001")); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed nonce count: status = %d", w.Code)
+	}
+	if w := do(digestAuthorization(challenge, "zix", "secret", "GET", "/report", "00000002")); w.Code != http.StatusOK {
+		t.Errorf("next nonce count: status = %d", w.Code)
+	}
+	if w := do(digestAuthorization(challenge, "zix", "nope", "GET", "/report", "00000003")); w.Code != http.StatusUnauthorized ||
+		strings.Contains(w.Header().Get("WWW-Authenticate"), "stale=true") {
+		t.Errorf("wrong password: status = %d, challenge = %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	// An RFC 2069 response, without qop, nc and cnonce, replays freely.
+	params := parseAuthParams(strings.TrimPrefix(challenge, "Digest "))
+	rfc2069 := fmt.Sprintf(`Digest username="zix", realm="test", nonce=%q, uri="/report", response=%q`, params["nonce"],
+		md5Hex(md5Hex("zix:test:secret")+":"+params["nonce"]+":"+md5Hex("GET:/report")))
+	if w := do(rfc2069); w.Code != http.StatusUnauthorized {
+		t.Errorf("digest without qop: status = %d", w.Code)
+	}
+
+	old := fmt.Sprintf(`Digest realm="test", nonce=%q`, a.newNonce(time.Now().Add(-2*time.Minute)))
+	w := do(digestAuthorization(old, "zix", "secret", "GET", "/report", "00000001"))
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "stale=true") {
+		t.Errorf("expired nonce: status = %d, challenge = %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// ClockOptions configures the virtual clock of the mock, read for report
+// names and windows, manifests, emails, session cookies, nonces and CSRF tokens.
+type ClockOptions struct {
+	Start        string        `long:"clock-start" env:"CLOCK_START" description:"RFC 3339 time the clock is frozen at on startup; runs from the wall clock if empty"`
+	Offset       time.Duration `long:"clock-offset" env:"CLOCK_OFFSET" default:"0" description:"offset of the clock from the wall clock, e.g. -24h"`
+	Admin        bool          `long:"clock-admin" env:"CLOCK_ADMIN" description:"serve /admin/clock to freeze, advance or offset the clock"`
+	ReportWindow string        `long:"report-window" env:"REPORT_WINDOW" description:"send dates of the reports: YYYY-MM, YYYY-MM-DD, or relative to the clock: today, yesterday, this-month, last-month, last-<n>h, last-<n>d; October 2018 if empty; per request with ?window="`
+}
+
+// Report window specs relative to the clock.
+const (
+	WindowToday     = "today"
+	WindowYesterday = "yesterday"
+	WindowThisMonth = "this-month"
+	WindowLastMonth = "last-month"
+)
+
+var windowLastPattern = regexp.MustCompile(`^last-(\d+)([hd])$`)
+
+// clock is the time of the mock, the wall clock unless set up otherwise.
+var clock = &Clock{}
+
+// Clock is a virtual clock: the wall clock shifted by an offset, or frozen.
+// The zero value runs with the wall clock.
+type Clock struct {
+	mu     sync.Mutex
+	offset time.Duration
+	frozen bool
+	at     time.Time
+
+	// wall defaults to time.Now.
+	wall func() time.Time
+}
+
+// ClockState describes a Clock, as served by /admin/clock.
+type ClockState struct {
+	Now    time.Time `json:"now"`
+	Wall   time.Time `json:"wall"`
+	Offset string    `json:"offset"`
+	Frozen bool      `json:"frozen"`
+}
+
+// NewClock constructs a Clock offset, or frozen at the start, as configured.
+func NewClock(opts ClockOptions) (*Clock, error) {
+	c := &Clock{}
+	c.SetOffset(opts.Offset)
+	if opts.Start != "" {
+		start, err := time.Parse(time.RFC3339, opts.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clock start %q: %v", opts.Start, err)
+		}
+		c.Freeze()
+		c.Set(start)
+	}
+	if _, err := ParseWindow(opts.ReportWindow, c.Now()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Clock) wallNow() time.Time {
+	if c.wall == nil {
+		return time.Now()
+	}
+	return c.wall()
+}
+
+// Now returns the current virtual time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now()
+}
+
+func (c *Clock) now() time.Time {
+	if c.frozen {
+		return c.at
+	}
+	return c.wallNow().Add(c.offset)
+}
+
+// IsWall reports whether the clock runs with the wall clock.
+func (c *Clock) IsWall() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.frozen && c.offset == 0
+}
+
+// Since returns the virtual time elapsed since t.
+func (c *Clock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Freeze stops the clock at the current virtual time.
+func (c *Clock) Freeze() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.at = c.now()
+	c.frozen = true
+}
+
+// Unfreeze restarts the clock from the time it was frozen at.
+func (c *Clock) Unfreeze() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen {
+		c.offset = c.at.Sub(c.wallNow())
+		c.frozen = false
+	}
+}
+
+// Advance moves the clock forward by d, or back if negative.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen {
+		c.at = c.at.Add(d)
+	} else {
+		c.offset += d
+	}
+}
+
+// Set moves the clock to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen {
+		c.at = t
+	} else {
+		c.offset = t.Sub(c.wallNow())
+	}
+}
+
+// SetOffset moves the clock to the wall clock plus d.
+func (c *Clock) SetOffset(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset = d
+	if c.frozen {
+		c.at = c.wallNow().Add(d)
+	}
+}
+
+// Reset runs the clock with the wall clock again.
+func (c *Clock) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset, c.frozen, c.at = 0, false, time.Time{}
+}
+
+// State returns the state of the clock.
+func (c *Clock) State() ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := c.wallNow()
+	now := c.now()
+	return ClockState{Now: now, Wall: wall, Offset: now.Sub(wall).String(), Frozen: c.frozen}
+}
+
+// HandleClock serves the clock state, after applying the reset, freeze, at,
+// offset and advance parameters of a POST, in that order:
+//
+//	curl -d freeze=true -d at=2018-10-31T23:59:00Z localhost:9091/admin/clock
+//	curl -d advance=2m localhost:9091/admin/clock
+func (c *Clock) HandleClock(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := c.apply(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.State()) // nolint:errcheck
+}
+
+func (c *Clock) apply(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	var at time.Time
+	var offset, advance time.Duration
+	var reset, freeze bool
+	var err error
+	if v := r.Form.Get("reset"); v != "" {
+		if reset, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("reset must be a boolean, got %q", v)
+		}
+	}
+	if v := r.Form.Get("at"); v != "" {
+		if at, err = time.Parse(time.RFC3339, v); err != nil {
+			return fmt.Errorf("at must be an RFC 3339 time, got %q", v)
+		}
+	}
+	if v := r.Form.Get("offset"); v != "" {
+		if offset, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("offset must be a duration, got %q", v)
+		}
+	}
+	if v := r.Form.Get("advance"); v != "" {
+		if advance, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("advance must be a duration, got %q", v)
+		}
+	}
+	if v := r.Form.Get("freeze"); v != "" {
+		if freeze, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("freeze must be a boolean, got %q", v)
+		}
+	}
+
+	if reset {
+		c.Reset()
+	}
+	if r.Form.Get("freeze") != "" {
+		if freeze {
+			c.Freeze()
+		} else {
+			c.Unfreeze()
+		}
+	}
+	if r.Form.Get("at") != "" {
+		c.Set(at)
+	}
+	if r.Form.Get("offset") != "" {
+		c.SetOffset(offset)
+	}
+	c.Advance(advance)
+	return nil
+}
+
+// ParseWindow returns the window of the send dates described by spec, at
+// now; the default window if spec is empty. Days and months are in UTC.
+func ParseWindow(spec string, now time.Time) (Window, error) {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	switch spec {
+	case "":
+		return Window{From: usagegen.WindowStart, To: usagegen.WindowEnd}, nil
+	case WindowToday:
+		return Window{From: midnight, To: now}, nil
+	case WindowYesterday:
+		return Window{From: midnight.AddDate(0, 0, -1), To: midnight}, nil
+	case WindowThisMonth:
+		return Window{From: month, To: now}, nil
+	case WindowLastMonth:
+		return Window{From: month.AddDate(0, -1, 0), To: month}, nil
+	}
+
+	if m := windowLastPattern.FindStringSubmatch(spec); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n <= 0 {
+			return Window{}, fmt.Errorf("invalid window %q", spec)
+		}
+		if m[2] == "h" {
+			return Window{From: now.Add(-time.Duration(n) * time.Hour), To: now}, nil
+		}
+		return Window{From: now.AddDate(0, 0, -n), To: now}, nil
+	}
+	if t, err := time.Parse("2006-01-02", spec); err == nil {
+		return Window{From: t, To: t.AddDate(0, 0, 1)}, nil
+	}
+	if t, err := time.Parse("2006-01", spec); err == nil {
+		return Window{From: t, To: t.AddDate(0, 1, 0)}, nil
+	}
+	return Window{}, fmt.Errorf("invalid window %q", spec)
+}
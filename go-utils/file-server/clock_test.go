@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// setClock replaces the clock of the mock until the returned func is called.
+func setClock(c *Clock) func() {
+	saved := clock
+	clock = c
+	return func() { clock = saved }
+}
+
+func TestClock(t *testing.T) {
+	wall := time.Date(2018, time.October, 31, 23, 0, 0, 0, time.UTC)
+	c := &Clock{wall: func() time.Time { return wall }}
+
+	steps := []struct {
+		name string
+		do   func()
+		want func() time.Time
+	}{
+		{"wall", func() {}, func() time.Time { return wall }},
+		{"advance", func() { c.Advance(30 * time.Minute) }, func() time.Time { return wall.Add(30 * time.Minute) }},
+		{"freeze", func() { c.Freeze(); wall = wall.Add(time.Hour) }, func() time.Time { return wall.Add(-30 * time.Minute) }},
+		{"advance frozen", func() { c.Advance(time.Minute) }, func() time.Time { return wall.Add(-29 * time.Minute) }},
+		{"unfreeze", func() { c.Unfreeze(); wall = wall.Add(time.Minute) }, func() time.Time { return wall.Add(-29 * time.Minute) }},
+		{"set", func() { c.Set(time.Date(2019, time.March, 31, 0, 59, 0, 0, time.UTC)) }, func() time.Time { return time.Date(2019, time.March, 31, 0, 59, 0, 0, time.UTC) }},
+		{"offset", func() { c.SetOffset(-24 * time.Hour) }, func() time.Time { return wall.Add(-24 * time.Hour) }},
+		{"reset", func() { c.Reset() }, func() time.Time { return wall }},
+	}
+	for _, step := range steps {
+		step.do()
+		if got, want := c.Now(), step.want(); !got.Equal(want) {
+			t.Errorf("%s: Now() = %v, want %v", step.name, got, want)
+		}
+	}
+	if !c.IsWall() {
+		t.Error("reset clock is not the wall clock")
+	}
+}
+
+func TestNewClock(t *testing.T) {
+	c, err := NewClock(ClockOptions{Start: "2018-11-01T00:00:00Z", Offset: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.State(); !s.Frozen || !s.Now.Equal(time.Date(2018, time.November, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("state %+v", s)
+	}
+
+	for _, opts := range []ClockOptions{{Start: "yesterday"}, {ReportWindow: "last-week"}} {
+		if _, err := NewClock(opts); err == nil {
+			t.Errorf("NewClock(%+v) accepted", opts)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	date := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+	now := date(2019, time.March, 1, 12)
+
+	tests := []struct {
+		spec     string
+		now      time.Time
+		from, to time.Time
+	}{
+		{"", now, usagegen.WindowStart, usagegen.WindowEnd},
+		{"today", now, date(2019, time.March, 1, 0), now},
+		{"yesterday", now, date(2019, time.February, 28, 0), date(2019, time.March, 1, 0)},
+		{"yesterday", date(2020, time.March, 1, 0), date(2020, time.February, 29, 0), date(2020, time.March, 1, 0)},
+		{"yesterday", date(2019, time.January, 1, 3), date(2018, time.December, 31, 0), date(2019, time.January, 1, 0)},
+		{"this-month", now, date(2019, time.March, 1, 0), now},
+		{"last-month", now, date(2019, time.February, 1, 0), date(2019, time.March, 1, 0)},
+		{"last-month", date(2019, time.January, 31, 0), date(2018, time.December, 1, 0), date(2019, time.January, 1, 0)},
+		{"last-6h", now, date(2019, time.March, 1, 6), now},
+		{"last-2d", now, date(2019, time.February, 27, 12), now},
+		{"2018-10", now, date(2018, time.October, 1, 0), date(2018, time.November, 1, 0)},
+		{"2018-10-28", now, date(2018, time.October, 28, 0), date(2018, time.October, 29, 0)},
+		// Days are in UTC whatever the zone of now.
+		{"today", time.Date(2019, time.March, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600)), date(2019, time.March, 1, 0), date(2019, time.March, 1, 0)},
+	}
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.spec, tt.now)
+		if err != nil || !w.From.Equal(tt.from) || !w.To.Equal(tt.to) {
+			t.Errorf("ParseWindow(%q, %v) = %v - %v, %v", tt.spec, tt.now, w.From, w.To, err)
+		}
+	}
+
+	for _, spec := range []string{"tomorrow", "last-0d", "last-3w", "2018-13"} {
+		if _, err := ParseWindow(spec, now); err == nil {
+			t.Errorf("ParseWindow(%q) accepted", spec)
+		}
+	}
+}
+
+func TestHandleClock(t *testing.T) {
+	c := &Clock{}
+	post := func(form string) (*httptest.ResponseRecorder, ClockState) {
+		values, _ := url.ParseQuery(form)
+		req := httptest.NewRequest(http.MethodPost, "/admin/clock", strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		c.HandleClock(w, req)
+
+		var s ClockState
+		json.Unmarshal(w.Body.Bytes(), &s) // nolint:errcheck
+		return w, s
+	}
+
+	at := time.Date(2018, time.October, 31, 23, 59, 0, 0, time.UTC)
+	if _, s := post("freeze=true&at=2018-10-31T23:59:00Z"); !s.Frozen || !s.Now.Equal(at) {
+		t.Errorf("frozen at %v: %+v", at, s)
+	}
+	if _, s := post("advance=2m"); !s.Now.Equal(at.Add(2 * time.Minute)) {
+		t.Errorf("advanced 2m: %+v", s)
+	}
+	if _, s := post("reset=true"); s.Frozen || !c.IsWall() {
+		t.Errorf("reset: %+v", s)
+	}
+	if w, _ := post("advance=soon"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid advance: status %d", w.Code)
+	}
+}
+
+func TestHasSession_Expiry(t *testing.T) {
+	c := &Clock{}
+	c.Freeze()
+	defer setClock(c)()
+
+	w := httptest.NewRecorder()
+	SetSessionCookie(w)
+	req := httptest.NewRequest(http.MethodGet, "/report", nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	if !HasSession(req) {
+		t.Fatal("new session rejected")
+	}
+	c.Advance(24*time.Hour - time.Second)
+	if !HasSession(req) {
+		t.Error("session rejected before its expiry")
+	}
+	c.Advance(time.Second)
+	if HasSession(req) {
+		t.Error("expired session accepted")
+	}
+}
+
+func TestHasSession_Clients(t *testing.T) {
+	// Clients logging in at once each keep their own session.
+	var wg sync.WaitGroup
+	reqs := make([]*http.Request, 20)
+	for i := range reqs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			SetSessionCookie(w)
+			reqs[i] = httptest.NewRequest(http.MethodGet, "/report", nil)
+			reqs[i].AddCookie(w.Result().Cookies()[0])
+			HasSession(reqs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, req := range reqs {
+		if !HasSession(req) {
+			t.Errorf("session %d rejected after the other logins", i)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/report", nil)
+	req.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: "forged"})
+	if HasSession(req) {
+		t.Error("unknown session accepted")
+	}
+}
+
+func TestGenerateReport_Window(t *testing.T) {
+	c := &Clock{}
+	c.Freeze()
+	c.Set(time.Date(2018, time.November, 1, 0, 30, 0, 0, time.UTC))
+	defer setClock(c)()
+
+	dir, err := ioutil.TempDir("", "window")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name, err := generateReport(dir, ReportParams{Rows: 200, Seed: 1, Window: WindowYesterday})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "zix-usage-data-20181101003000.csv" {
+		t.Errorf("report named %s", name)
+	}
+
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records[1:] {
+		date, err := usagegen.ParseDate(record[2])
+		if err != nil || date.Day() != 31 || date.Month() != time.October {
+			t.Fatalf("send date %s outside yesterday: %v", record[2], err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, name+SuffixManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil || !m.Generated.Equal(c.Now()) || !m.Window.To.Equal(time.Date(2018, time.November, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("manifest = %+v, %v", m, err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/fbatroni/fusemail/go-utils/mailcorpus"
+)
+
+// CorpusNone disables the message corpus; the other formats are those of mailcorpus.
+const CorpusNone = "none"
+
+// CorpusOptions configures the .eml corpus generated along with each report.
+type CorpusOptions struct {
+	Format string `long:"corpus-format" env:"CORPUS_FORMAT" default:"none" choice:"none" choice:"zip" choice:"mbox" description:"also generate an RFC 5322 message per usage row, packed as zip or mbox"`
+	Domain string `long:"corpus-domain" env:"CORPUS_DOMAIN" default:"zix.example" description:"domain of the receiving host in Message-ID and Received headers"`
+}
+
+// Response headers naming the corpus files of a report, as paths under /files/.
+const (
+	HeaderCorpus      = "X-Message-Corpus"
+	HeaderCorpusIndex = "X-Message-Corpus-Index"
+)
+
+// SetCorpusHeaders names the corpus archive and index generated with the report, if any.
+func SetCorpusHeaders(w http.ResponseWriter, report Report) {
+	format := options.Corpus.Format
+	if format == "" || format == CorpusNone {
+		return
+	}
+	w.Header().Set(HeaderCorpus, report.ID+"/"+mailcorpus.ArchiveName(report.Name, format))
+	w.Header().Set(HeaderCorpusIndex, report.ID+"/"+mailcorpus.IndexName(report.Name))
+}
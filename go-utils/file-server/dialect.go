@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// DialectOptions configures the CSV dialect and character encoding of the
+// reports; per request with the query parameters of the same names.
+type DialectOptions struct {
+	Delimiter   string `long:"csv-delimiter" env:"CSV_DELIMITER" default:"comma" description:"field delimiter: comma, semicolon, tab or pipe; per request with ?delimiter="`
+	Encoding    string `long:"csv-encoding" env:"CSV_ENCODING" default:"utf-8" description:"character encoding: utf-8, windows-1252, iso-8859-1 or utf-16le, characters out of it written as ?; per request with ?encoding="`
+	AlwaysQuote bool   `long:"csv-always-quote" env:"CSV_ALWAYS_QUOTE" description:"quote every field, not only those that need it; per request with ?always_quote="`
+	CRLF        bool   `long:"csv-crlf" env:"CSV_CRLF" description:"end lines with CRLF rather than LF; per request with ?crlf="`
+	BOM         bool   `long:"csv-bom" env:"CSV_BOM" description:"start the reports with a byte order mark, in utf-8 or utf-16le; per request with ?bom="`
+}
+
+// csvDialect is the dialect of the reports without dialect query parameters.
+var csvDialect usagegen.Dialect
+
+// NewDialect returns the dialect of the options.
+func NewDialect(opts DialectOptions) (usagegen.Dialect, error) {
+	return usagegen.ParseDialect(opts.Delimiter, opts.Encoding, opts.AlwaysQuote, opts.CRLF, opts.BOM)
+}
+
+// ParseDialectParams returns the dialect of the delimiter, encoding,
+// always_quote, crlf and bom query parameters over the options; nil if none
+// is set.
+func ParseDialectParams(query url.Values, opts DialectOptions) (*usagegen.Dialect, error) {
+	set := false
+	if v, ok := query["delimiter"]; ok {
+		opts.Delimiter, set = v[0], true
+	}
+	if v, ok := query["encoding"]; ok {
+		opts.Encoding, set = v[0], true
+	}
+	flags := []struct {
+		name  string
+		value *bool
+	}{
+		{"always_quote", &opts.AlwaysQuote},
+		{"crlf", &opts.CRLF},
+		{"bom", &opts.BOM},
+	}
+	for _, flag := range flags {
+		v := query.Get(flag.name)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a boolean, got %q", flag.name, v)
+		}
+		*flag.value, set = b, true
+	}
+	if !set {
+		return nil, nil
+	}
+
+	d, err := NewDialect(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
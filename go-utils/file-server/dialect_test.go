@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateReport_Dialect(t *testing.T) {
+	os.MkdirAll(folder, os.ModePerm) // nolint:errcheck
+	params, err := ParseReportParams(url.Values{"rows": {"50"}, "seed": {"3"}, "delimiter": {"semicolon"}, "encoding": {"windows-1252"}, "crlf": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := generateReport(folder, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(folder, name)
+	defer func() {
+		for _, suffix := range []string{"", SuffixSHA256, SuffixManifest, SuffixSignature} {
+			os.Remove(path + suffix) // nolint:errcheck
+		}
+	}()
+
+	m, err := LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Dialect == nil || *m.Dialect != *params.Dialect {
+		t.Fatalf("manifest dialect %+v, want %+v", m.Dialect, params.Dialect)
+	}
+	w := httptest.NewRecorder()
+	SetIntegrityHeaders(w, httptest.NewRequest("GET", "/"+name, nil), path)
+	if got := w.Header().Get("Content-Type"); got != "text/csv; charset=windows-1252" {
+		t.Errorf("Content-Type %q", got)
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte("senderAddress;recipientAddress;")) || !bytes.Contains(raw, []byte("\r\n")) {
+		t.Errorf("report not in the dialect:\n%.200s", raw)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := m.Dialect.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != m.Rows+1 || len(records[1]) != len(header) {
+		t.Errorf("%d records of %d fields, want %d of %d", len(records), len(records[1]), m.Rows+1, len(header))
+	}
+
+	for _, query := range []url.Values{
+		{"delimiter": {"colon"}},
+		{"encoding": {"ebcdic"}},
+		{"crlf": {"maybe"}},
+		{"encoding": {"iso-8859-1"}, "bom": {"true"}},
+	} {
+		if _, err := ParseReportParams(query); err == nil {
+			t.Errorf("%s accepted", query.Encode())
+		}
+	}
+	if params, err := ParseReportParams(url.Values{}); err != nil || params.Dialect != nil {
+		t.Errorf("no dialect parameters: %+v, %v", params.Dialect, err)
+	}
+}
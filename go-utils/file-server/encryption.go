@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/sys"
+)
+
+// Encryption modes.
+const (
+	EncryptNone   = "none"
+	EncryptAESGCM = "aes-gcm"
+)
+
+// Encryption headers set on encrypted reports.
+const (
+	HeaderEncryption = "X-Encryption"
+	HeaderKeyID      = "X-Encryption-Key-Id"
+)
+
+// EncryptionOptions configures encrypted report delivery.
+//
+// Encrypted reports are served, pushed and mailed as the 12 byte GCM nonce
+// followed by the sealed CSV (ciphertext plus 16 byte tag), with no
+// additional data.
+type EncryptionOptions struct {
+	Mode     string           `long:"encrypt-mode" env:"ENCRYPT_MODE" default:"none" choice:"none" choice:"aes-gcm" description:"encrypt report bodies for the recipient"`
+	Key      sys.MaskedString `long:"encrypt-key" env:"ENCRYPT_KEY" description:"hex encoded AES key shared with the recipient (16, 24 or 32 bytes)"`
+	KeyID    string           `long:"encrypt-key-id" env:"ENCRYPT_KEY_ID" default:"default" description:"key id advertised in the encryption headers"`
+	WrongKey bool             `long:"encrypt-wrong-key" env:"ENCRYPT_WRONG_KEY" description:"always encrypt with a key the recipient does not have; per request with ?wrong_key=true"`
+}
+
+// sealOverhead is the size added to a report by Seal: GCM nonce and tag.
+const sealOverhead = 12 + 16
+
+// Encryptor seals report bodies for the configured recipient key.
+type Encryptor struct {
+	Options EncryptionOptions
+	key     []byte
+}
+
+// NewEncryptor constructs an Encryptor, validating the configured key.
+func NewEncryptor(opts EncryptionOptions) (*Encryptor, error) {
+	e := &Encryptor{Options: opts}
+	if opts.Mode != EncryptAESGCM {
+		return e, nil
+	}
+
+	key, err := hex.DecodeString(string(opts.Key))
+	if err != nil {
+		return nil, errors.New("encryption key is not hex encoded: " + err.Error())
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, errors.New("encryption key must be 16, 24 or 32 bytes, got " + strconv.Itoa(len(key)))
+	}
+
+	e.key = key
+	return e, nil
+}
+
+// Enabled reports whether reports are encrypted.
+func (e *Encryptor) Enabled() bool {
+	return e != nil && e.key != nil
+}
+
+// Algorithm names the cipher of the sealed reports, as in HeaderEncryption.
+func (e *Encryptor) Algorithm() string {
+	return "AES-" + strconv.Itoa(len(e.key)*8) + "-GCM"
+}
+
+// Seal encrypts plaintext with the recipient key, or with a derived key of
+// the same size the recipient cannot know if wrongKey is set.
+func (e *Encryptor) Seal(plaintext []byte, wrongKey bool) ([]byte, error) {
+	key := e.key
+	if wrongKey {
+		sum := sha256.Sum256(e.key)
+		key = sum[:len(e.key)]
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// ServeEncrypted writes the encrypted report at path, with digests of the
+// encrypted body so transport integrity can still be checked.
+func (e *Encryptor) ServeEncrypted(w http.ResponseWriter, r *http.Request, path string) {
+	plaintext, err := ioutil.ReadFile(path)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+	e.ServeSealed(w, r, path, plaintext)
+}
+
+// ServeSealed writes plaintext encrypted as the report at path, see
+// ServeEncrypted.
+func (e *Encryptor) ServeSealed(w http.ResponseWriter, r *http.Request, path string, plaintext []byte) {
+	wrongKey := e.Options.WrongKey || r.URL.Query().Get("wrong_key") == "true"
+	body, err := e.Seal(plaintext, wrongKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	sha := sha256.Sum256(body)
+	sum := md5.Sum(body)
+
+	if m, err := LoadManifest(path); err == nil {
+		w.Header().Set(HeaderRowCount, strconv.Itoa(m.Rows))
+	}
+	w.Header().Set(HeaderDigest, "SHA-256="+base64.StdEncoding.EncodeToString(sha[:]))
+	w.Header().Set(HeaderContentMD5, base64.StdEncoding.EncodeToString(sum[:]))
+	w.Header().Set(HeaderEncryption, e.Algorithm())
+	w.Header().Set(HeaderKeyID, e.Options.KeyID)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(path)+`.enc"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(body) // nolint:errcheck
+}
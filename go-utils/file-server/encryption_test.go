@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/sys"
+	"github.com/gorilla/mux"
+)
+
+func TestEncryptor_Seal(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	plaintext := []byte("senderAddress,recipientAddress\na@b.com,c@d.com\n")
+
+	tests := []struct {
+		name     string
+		wrongKey bool
+		wantOpen bool
+	}{
+		{"recipient key opens the report", false, true},
+		{"wrong key does not open the report", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewEncryptor(EncryptionOptions{Mode: EncryptAESGCM, Key: sys.MaskedString(hex.EncodeToString(key))})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sealed, err := e.Seal(plaintext, tt.wrongKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block, _ := aes.NewCipher(key)
+			gcm, _ := cipher.NewGCM(block)
+			opened, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+
+			if tt.wantOpen && (err != nil || !bytes.Equal(opened, plaintext)) {
+				t.Errorf("cannot open sealed report: %v", err)
+			}
+			if !tt.wantOpen && err == nil {
+				t.Error("report sealed with the wrong key was opened")
+			}
+		})
+	}
+}
+
+func TestNewEncryptor_InvalidKey(t *testing.T) {
+	for _, key := range []string{"not-hex", "0011"} {
+		if _, err := NewEncryptor(EncryptionOptions{Mode: EncryptAESGCM, Key: sys.MaskedString(key)}); err == nil {
+			t.Errorf("key %q accepted", key)
+		}
+	}
+}
+
+func TestEncryptor_DeliveryPaths(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	plaintext := []byte("a,b\n1,2\n")
+	e, err := NewEncryptor(EncryptionOptions{Mode: EncryptAESGCM, Key: sys.MaskedString(hex.EncodeToString(key)), KeyID: "k1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptor = e
+	defer func() { encryptor = nil }()
+
+	report := Report{ID: "0a2d1e3c-4b5f-4a6e-8d7c-9b0a1f2e3d4c", Name: "encrypted.csv"}
+	os.MkdirAll(report.Dir(), os.ModePerm)           // nolint:errcheck
+	ioutil.WriteFile(report.Path(), plaintext, 0644) // nolint:errcheck
+	defer os.RemoveAll(report.Dir())                 // nolint:errcheck
+
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	open := func(sealed []byte) []byte {
+		if len(sealed) != len(plaintext)+sealOverhead {
+			return nil
+		}
+		opened, _ := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+		return opened
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/files/{id}/{name}", HandleFile)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/files/"+report.ID+"/"+report.Name, nil))
+	if w.Header().Get(HeaderEncryption) != "AES-128-GCM" || !bytes.Equal(open(w.Body.Bytes()), plaintext) {
+		t.Errorf("/files served %q with headers %v", w.Body.Bytes(), w.Header())
+	}
+
+	wh := NewWebhook(WebhookOptions{Mode: WebhookModeFile})
+	body, headers, err := wh.payload(&Delivery{Report: report.ID, File: report.Name, Mode: WebhookModeFile})
+	if err != nil || headers[HeaderKeyID] != "k1" || !bytes.Equal(open(body), plaintext) {
+		t.Errorf("webhook pushed %q with headers %v, %v", body, headers, err)
+	}
+}
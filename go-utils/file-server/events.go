@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/metrics"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventOptions configures the live usage event stream served at /events.
+type EventOptions struct {
+	Rate            float64       `long:"events-rate" env:"EVENTS_RATE" default:"10" description:"usage events per second of each stream, bursts only if 0; per request with ?rate="`
+	Burst           int           `long:"events-burst" env:"EVENTS_BURST" default:"0" description:"events sent at once every burst interval, on top of the rate; per request with ?burst="`
+	BurstEvery      time.Duration `long:"events-burst-every" env:"EVENTS_BURST_EVERY" default:"10s" description:"interval between bursts"`
+	Heartbeat       time.Duration `long:"events-heartbeat" env:"EVENTS_HEARTBEAT" default:"15s" description:"interval of the heartbeat comments, or pings over WebSocket; none if 0"`
+	DisconnectAfter int           `long:"events-disconnect-after" env:"EVENTS_DISCONNECT_AFTER" default:"0" description:"reset each stream after this many events, to exercise resumption; per request with ?disconnect_after="`
+	Retry           time.Duration `long:"events-retry" env:"EVENTS_RETRY" default:"3s" description:"reconnection delay advised to SSE clients"`
+	Seed            int64         `long:"events-seed" env:"EVENTS_SEED" default:"1" description:"seed of the event sequence, the same for every stream"`
+	Senders         int           `long:"events-senders" env:"EVENTS_SENDERS" default:"200" description:"distinct senders per domain of the events"`
+	Domains         int           `long:"events-domains" env:"EVENTS_DOMAINS" default:"50" description:"distinct domains of the events"`
+	WebSocket       bool          `long:"events-websocket" env:"EVENTS_WEBSOCKET" description:"also stream the events over WebSocket when /events is upgraded"`
+}
+
+// Event stream transports, as labelled in the events metrics.
+const (
+	TransportSSE       = "sse"
+	TransportWebSocket = "websocket"
+)
+
+// EventType names the usage events in the SSE event field.
+const EventType = "usage"
+
+// Events of different ids draw their row from seeds this far apart.
+const eventSeedStride = 1000003
+
+// metrics vectors
+var (
+	eventStreams = metrics.NewMetric(&metrics.Vector{
+		Type:   metrics.TypeGauge,
+		Name:   "events_streams",
+		Desc:   "Open /events streams by transport",
+		Labels: []string{"transport"},
+	})
+	eventsSentTotal = metrics.NewMetric(&metrics.Vector{
+		Type:   metrics.TypeCounter,
+		Name:   "events_sent_total",
+		Desc:   "Usage events sent by transport",
+		Labels: []string{"transport"},
+	})
+	eventDisconnectsTotal = metrics.NewMetric(&metrics.Vector{
+		Type:   metrics.TypeCounter,
+		Name:   "events_forced_disconnects_total",
+		Desc:   "Streams reset after the configured number of events, by transport",
+		Labels: []string{"transport"},
+	})
+)
+
+// EventVectors returns the event stream metric vectors, to pass to metrics.Register.
+func EventVectors() []*metrics.Vector {
+	return metrics.NewMetricVectors([]*metrics.Metric{
+		eventStreams,
+		eventsSentTotal,
+		eventDisconnectsTotal,
+	})
+}
+
+// events serves /events, see NewEventStream.
+var events *EventStream
+
+// UsageEvent is a usage row, as sent in the event data and NSQ messages.
+type UsageEvent struct {
+	ID               int64  `json:"id"`
+	SenderAddress    string `json:"senderAddress"`
+	RecipientAddress string `json:"recipientAddress"`
+	SentTimestamp    string `json:"sentTimestamp"`
+	Subject          string `json:"subject"`
+	PolicyTypes      string `json:"policyTypes"`
+	PolicyNames      string `json:"policyNames"`
+	DeliveryMethod   string `json:"deliveryMethod"`
+}
+
+// EventStream streams usage events, numbered from 1, to each client. Event
+// ids are deterministic: every stream sends the same event for an id, so a
+// client resuming after its Last-Event-ID misses and repeats nothing.
+type EventStream struct {
+	Options EventOptions
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewEventStream constructs an EventStream, validating the options.
+func NewEventStream(opts EventOptions) (*EventStream, error) {
+	if !validRate(opts.Rate) {
+		return nil, fmt.Errorf("events rate must be from 0 to %g events per second, got %v", maxEventRate, opts.Rate)
+	}
+	return &EventStream{Options: opts, stop: make(chan struct{})}, nil
+}
+
+// Stop ends the open streams and waits for them.
+func (s *EventStream) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.wg.Wait()
+}
+
+// Event returns the event of id.
+func (s *EventStream) Event(id int64) UsageEvent {
+	g := usagegen.New(timestamps.Apply(usagegen.Options{
+		Rows:      1,
+		Seed:      s.Options.Seed*eventSeedStride + id,
+		Senders:   s.Options.Senders,
+		Domains:   s.Options.Domains,
+		Addresses: addressMix,
+	}))
+	g.Next()
+	return NewUsageEvent(id, g.Row().Record)
+}
+
+// NewUsageEvent returns the event of id for record.
+func NewUsageEvent(id int64, record usagegen.Record) UsageEvent {
+	return UsageEvent{
+		ID:               id,
+		SenderAddress:    record[0],
+		RecipientAddress: record[1],
+		SentTimestamp:    record[2],
+		Subject:          record[3],
+		PolicyTypes:      record[4],
+		PolicyNames:      record[5],
+		DeliveryMethod:   record[6],
+	}
+}
+
+// maxEventRate is the highest rate, of an event every nanosecond.
+const maxEventRate = float64(time.Second)
+
+// validRate reports whether rate is a number of events per second that can
+// be ticked: 0, or a positive one whose interval is at least a nanosecond,
+// which leaves out NaN and infinities.
+func validRate(rate float64) bool {
+	return rate == 0 || rate > 0 && rate <= maxEventRate
+}
+
+// ParseEventParams returns opts overridden by the rate, burst and
+// disconnect_after query parameters.
+func ParseEventParams(query url.Values, opts EventOptions) (EventOptions, error) {
+	if v := query.Get("rate"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || !validRate(rate) {
+			return opts, fmt.Errorf("rate must be a number from 0 to %g, got %q", maxEventRate, v)
+		}
+		opts.Rate = rate
+	}
+	ints := map[string]*int{"burst": &opts.Burst, "disconnect_after": &opts.DisconnectAfter}
+	for name, value := range ints {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("%s must be a non-negative integer, got %q", name, v)
+			}
+			*value = n
+		}
+	}
+	return opts, nil
+}
+
+// LastEventID returns the id of the last event r has seen, from the
+// Last-Event-ID header or, for clients that cannot set it, the
+// last_event_id query parameter; 0 for a new stream.
+func LastEventID(r *http.Request) (int64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("last event id must be a non-negative integer, got %q", v)
+	}
+	return id, nil
+}
+
+// eventSink writes the events of a stream to its transport.
+type eventSink interface {
+	Event(e UsageEvent) error
+	Heartbeat() error
+	Flush() error
+	// Reset closes the connection abruptly, Close cleanly.
+	Reset()
+	Close()
+	// Done is closed when the client goes away.
+	Done() <-chan struct{}
+}
+
+// HandleEvents streams the events following the last event id of r, over
+// WebSocket if r is an upgrade and it is enabled, over SSE otherwise.
+func (s *EventStream) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	opts, err := ParseEventParams(r.URL.Query(), s.Options)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	last, err := LastEventID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	var sink eventSink
+	transport := TransportSSE
+	if IsWebSocket(r) {
+		if !s.Options.WebSocket {
+			w.WriteHeader(http.StatusNotImplemented)
+			io.WriteString(w, "WebSocket streaming is disabled")
+			return
+		}
+		transport = TransportWebSocket
+		conn, rw, err := wsUpgrade(w, r)
+		if err != nil {
+			log.WithField("err", err).Info("events websocket upgrade failed")
+			return
+		}
+		sink = newWSSink(conn, rw)
+	} else {
+		conn, rw, err := hijack(w)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+		sink, err = newSSESink(conn, rw, opts.Retry)
+		if err != nil {
+			log.WithField("err", err).Info("events stream failed")
+			return
+		}
+	}
+
+	s.wg.Add(1)
+	defer s.wg.Done()
+	eventStreams.Add(1, transport)
+	defer eventStreams.Add(-1, transport)
+
+	logger := log.WithFields(log.Fields{"transport": transport, "lastEventId": last})
+	logger.Info("events stream opened")
+	if err := s.stream(sink, transport, last, opts); err != nil {
+		logger.WithField("err", err).Info("events stream ended")
+	}
+}
+
+// stream sends the events after last to sink at the pace of opts, until the
+// client goes away, the stream is reset or the server stops.
+func (s *EventStream) stream(sink eventSink, transport string, last int64, opts EventOptions) error {
+	var rate, burst, heartbeat <-chan time.Time
+	if opts.Rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer t.Stop()
+		rate = t.C
+	}
+	if opts.Burst > 0 && opts.BurstEvery > 0 {
+		t := time.NewTicker(opts.BurstEvery)
+		defer t.Stop()
+		burst = t.C
+	}
+	if opts.Heartbeat > 0 {
+		t := time.NewTicker(opts.Heartbeat)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+
+	id, sent := last, 0
+	send := func(n int) (bool, error) {
+		for i := 0; i < n; i++ {
+			id++
+			if err := sink.Event(s.Event(id)); err != nil {
+				return false, err
+			}
+			eventsSentTotal.AddOne(transport)
+			sent++
+			if opts.DisconnectAfter > 0 && sent >= opts.DisconnectAfter {
+				sink.Flush() // nolint:errcheck
+				return true, nil
+			}
+		}
+		return false, sink.Flush()
+	}
+
+	for {
+		var reset bool
+		var err error
+		select {
+		case <-rate:
+			reset, err = send(1)
+		case <-burst:
+			reset, err = send(opts.Burst)
+		case <-heartbeat:
+			if err = sink.Heartbeat(); err == nil {
+				err = sink.Flush()
+			}
+		case <-sink.Done():
+			sink.Close()
+			return nil
+		case <-s.stop:
+			sink.Close()
+			return nil
+		}
+
+		if err != nil {
+			sink.Close()
+			return err
+		}
+		if reset {
+			eventDisconnectsTotal.AddOne(transport)
+			sink.Reset()
+			return nil
+		}
+	}
+}
+
+// resetConn closes conn, with a TCP reset rather than a FIN where possible.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0) // nolint:errcheck
+	}
+	conn.Close() // nolint:errcheck
+}
+
+// sseSink writes events in the text/event-stream format.
+type sseSink struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	done chan struct{}
+}
+
+func newSSESink(conn net.Conn, rw *bufio.ReadWriter, retry time.Duration) (*sseSink, error) {
+	s := &sseSink{conn: conn, rw: rw, done: make(chan struct{})}
+
+	// The response is delimited by the end of the connection.
+	rw.WriteString("HTTP/1.1 200 OK\r\n" + // nolint:errcheck
+		"Content-Type: text/event-stream\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n" +
+		"X-Accel-Buffering: no\r\n\r\n")
+	if retry > 0 {
+		fmt.Fprintf(rw, "retry: %d\n\n", retry/time.Millisecond)
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close() // nolint:errcheck
+		return nil, err
+	}
+
+	// The client sends nothing more, so reading ends when it goes away.
+	go func() {
+		io.Copy(ioutil.Discard, rw) // nolint:errcheck
+		close(s.done)
+	}()
+	return s, nil
+}
+
+func (s *sseSink) Event(e UsageEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.rw, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, EventType, data)
+	return err
+}
+
+func (s *sseSink) Heartbeat() error {
+	_, err := s.rw.WriteString(": heartbeat\n\n")
+	return err
+}
+
+func (s *sseSink) Flush() error          { return s.rw.Flush() }
+func (s *sseSink) Reset()                { resetConn(s.conn) }
+func (s *sseSink) Close()                { s.conn.Close() } // nolint:errcheck
+func (s *sseSink) Done() <-chan struct{} { return s.done }
+
+// wsSink writes events as WebSocket text messages, answering the client
+// control frames.
+type wsSink struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	done chan struct{}
+
+	// mu serializes the frames of the stream and of the reader.
+	mu sync.Mutex
+}
+
+func newWSSink(conn net.Conn, rw *bufio.ReadWriter) *wsSink {
+	s := &wsSink{conn: conn, rw: rw, done: make(chan struct{})}
+	go s.read()
+	return s
+}
+
+func (s *wsSink) read() {
+	defer close(s.done)
+	for {
+		opcode, payload, err := wsReadFrame(s.rw)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			if s.write(wsPong, payload) != nil {
+				return
+			}
+		case wsClose:
+			s.write(wsClose, payload) // nolint:errcheck
+			return
+		}
+	}
+}
+
+func (s *wsSink) write(opcode byte, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := wsWriteFrame(s.rw, opcode, payload); err != nil {
+		return err
+	}
+	return s.rw.Flush()
+}
+
+func (s *wsSink) Event(e UsageEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.write(wsText, data)
+}
+
+func (s *wsSink) Heartbeat() error { return s.write(wsPing, nil) }
+
+// Flush does nothing, as every frame is flushed when written.
+func (s *wsSink) Flush() error { return nil }
+
+func (s *wsSink) Reset() { resetConn(s.conn) }
+
+// Close sends a going away close frame, unless the client closed first.
+func (s *wsSink) Close() {
+	select {
+	case <-s.done:
+	default:
+		s.write(wsClose, []byte{0x03, 0xE9}) // nolint:errcheck
+	}
+	s.conn.Close() // nolint:errcheck
+}
+
+func (s *wsSink) Done() <-chan struct{} { return s.done }
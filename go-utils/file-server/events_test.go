@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEventOptions() EventOptions {
+	return EventOptions{Rate: 200, Seed: 7, Senders: 20, Domains: 5, Retry: time.Second, WebSocket: true}
+}
+
+func newTestEventStream(t *testing.T, opts EventOptions) *EventStream {
+	s, err := NewEventStream(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// sseEvent is an event or comment read from an SSE stream.
+type sseEvent struct {
+	id      string
+	event   string
+	data    string
+	comment string
+}
+
+// readSSE reads the next event or comment of r.
+func readSSE(r *bufio.Reader) (sseEvent, error) {
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return e, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e != (sseEvent{}) {
+				return e, nil
+			}
+		case strings.HasPrefix(line, ":"):
+			e.comment = strings.TrimSpace(line[1:])
+		case strings.HasPrefix(line, "id: "):
+			e.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			e.event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[6:]
+		}
+	}
+}
+
+func TestParseEventParams(t *testing.T) {
+	defaults := testEventOptions()
+	tests := []struct {
+		query   string
+		want    func(*EventOptions)
+		wantErr bool
+	}{
+		{"", func(*EventOptions) {}, false},
+		{"rate=0.5&burst=20&disconnect_after=3", func(o *EventOptions) { o.Rate, o.Burst, o.DisconnectAfter = 0.5, 20, 3 }, false},
+		{"rate=0", func(o *EventOptions) { o.Rate = 0 }, false},
+		{"rate=-1", nil, true},
+		{"rate=1e9", func(o *EventOptions) { o.Rate = 1e9 }, false},
+		{"rate=2e9", nil, true},
+		{"rate=NaN", nil, true},
+		{"rate=Inf", nil, true},
+		{"burst=x", nil, true},
+		{"disconnect_after=-2", nil, true},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := ParseEventParams(query, defaults)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseEventParams(%q) error %v", tt.query, err)
+			continue
+		}
+		if err == nil {
+			want := defaults
+			tt.want(&want)
+			if got != want {
+				t.Errorf("ParseEventParams(%q) = %+v, want %+v", tt.query, got, want)
+			}
+		}
+	}
+}
+
+func TestNewEventStream(t *testing.T) {
+	for _, rate := range []float64{-1, math.NaN(), math.Inf(1), 1e10} {
+		opts := testEventOptions()
+		opts.Rate = rate
+		if _, err := NewEventStream(opts); err == nil {
+			t.Errorf("rate %v accepted", rate)
+		}
+	}
+}
+
+func TestEventStream_Event(t *testing.T) {
+	s := newTestEventStream(t, testEventOptions())
+	if a, b := s.Event(5), s.Event(5); a != b {
+		t.Errorf("event 5 differs: %+v, %+v", a, b)
+	}
+	if a, b := s.Event(5), s.Event(6); a == b {
+		t.Errorf("events 5 and 6 are the same: %+v", a)
+	}
+	if e := s.Event(5); e.ID != 5 || !strings.HasPrefix(e.SenderAddress, "sender") || e.DeliveryMethod == "" {
+		t.Errorf("event 5 = %+v", e)
+	}
+}
+
+func TestHandleEvents_SSE(t *testing.T) {
+	opts := testEventOptions()
+	opts.DisconnectAfter = 3
+	s := newTestEventStream(t, opts)
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleEvents))
+	defer ts.Close()
+	defer s.Stop()
+
+	// read returns the events of a stream until it is reset.
+	read := func(lastEventID string) []sseEvent {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type %q", ct)
+		}
+
+		var got []sseEvent
+		r := bufio.NewReader(res.Body)
+		for {
+			e, err := readSSE(r)
+			if err != nil {
+				return got
+			}
+			got = append(got, e)
+		}
+	}
+
+	first := read("")
+	if len(first) != 3 {
+		t.Fatalf("%d events before the disconnect, want 3: %+v", len(first), first)
+	}
+	for i, e := range first {
+		var ev UsageEvent
+		if err := json.Unmarshal([]byte(e.data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(i + 1); e.id != strconv.FormatInt(want, 10) || e.event != EventType || ev != s.Event(want) {
+			t.Errorf("event %d = %+v", i+1, e)
+		}
+	}
+
+	// Resuming continues the same sequence.
+	resumed := read("2")
+	if len(resumed) != 3 || resumed[0].id != "3" || resumed[0].data != first[2].data {
+		t.Errorf("resumed after 2: %+v", resumed)
+	}
+
+	res, err := http.Get(ts.URL + "?last_event_id=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid last event id: status %d", res.StatusCode)
+	}
+}
+
+func TestHandleEvents_Heartbeat(t *testing.T) {
+	opts := testEventOptions()
+	opts.Rate = 0
+	opts.Heartbeat = 10 * time.Millisecond
+	opts.Burst = 4
+	opts.BurstEvery = 50 * time.Millisecond
+	s := newTestEventStream(t, opts)
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleEvents))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	heartbeats, ids := 0, []string{}
+	r := bufio.NewReader(res.Body)
+	for len(ids) < 4 {
+		e, err := readSSE(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case e.comment == "heartbeat":
+			heartbeats++
+		case e.id != "":
+			ids = append(ids, e.id)
+		}
+	}
+	if heartbeats == 0 || strings.Join(ids, ",") != "1,2,3,4" {
+		t.Errorf("%d heartbeats, events %v", heartbeats, ids)
+	}
+
+	// Stop ends the open streams.
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not end the stream")
+	}
+}
+
+// dialWebSocket opens a WebSocket to the events of ts.
+func dialWebSocket(t *testing.T, ts *httptest.Server, query string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /events?"+query+" HTTP/1.1\r\n"+ // nolint:errcheck
+		"Host: "+ts.Listener.Addr().String()+"\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake response %d %v", res.StatusCode, res.Header)
+	}
+	return conn, r
+}
+
+// writeMasked writes a frame masked as clients must.
+func writeMasked(w io.Writer, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	w.Write(frame) // nolint:errcheck
+}
+
+func TestHandleEvents_WebSocket(t *testing.T) {
+	s := newTestEventStream(t, testEventOptions())
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleEvents))
+	defer ts.Close()
+	defer s.Stop()
+
+	conn, r := dialWebSocket(t, ts, "last_event_id=10")
+	defer conn.Close()
+
+	for want := int64(11); want <= 13; want++ {
+		opcode, payload, err := wsReadFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e UsageEvent
+		if err := json.Unmarshal(payload, &e); err != nil || opcode != wsText || e != s.Event(want) {
+			t.Fatalf("frame %d: opcode %d, %s, %v", want, opcode, payload, err)
+		}
+	}
+
+	writeMasked(conn, wsPing, []byte("hi"))
+	writeMasked(conn, wsClose, []byte{0x03, 0xE8})
+	closed := false
+	for !closed {
+		opcode, payload, err := wsReadFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch opcode {
+		case wsPong:
+			if string(payload) != "hi" {
+				t.Errorf("pong %q", payload)
+			}
+		case wsClose:
+			closed = true
+		}
+	}
+}
+
+func TestHandleEvents_WebSocketDisabled(t *testing.T) {
+	opts := testEventOptions()
+	opts.WebSocket = false
+	s := newTestEventStream(t, opts)
+
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	w := httptest.NewRecorder()
+	s.HandleEvents(w, req)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status %d", w.Code)
+	}
+}
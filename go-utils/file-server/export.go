@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// SuffixExport is appended to the report name for its export manifest.
+const SuffixExport = ".export.json"
+
+// maxExportParts bounds the parts of an export.
+const maxExportParts = 1000
+
+// ExportOptions configures partitioned exports: /report answers with an
+// export manifest listing the parts of the report, each served under /files/
+// and failing as configured until it has been requested enough times.
+type ExportOptions struct {
+	Parts       int           `long:"export-parts" env:"EXPORT_PARTS" default:"0" description:"split every report into this many parts, /report answering with their export manifest; whole reports if 0; per request with ?parts="`
+	BaseURL     string        `long:"export-base-url" env:"EXPORT_BASE_URL" default:"http://localhost:9091" description:"base URL of the part links of the export manifests"`
+	NotFound    []int         `long:"export-not-found" env:"EXPORT_NOT_FOUND" env-delim:"," description:"parts answered 404 Not Found, as if not arrived yet; per request with ?not_found="`
+	Unavailable []int         `long:"export-unavailable" env:"EXPORT_UNAVAILABLE" env-delim:"," description:"parts answered 503 Service Unavailable with a Retry-After header; per request with ?unavailable="`
+	Corrupt     []int         `long:"export-corrupt" env:"EXPORT_CORRUPT" env-delim:"," description:"parts served with a byte changed, so their checksum does not match the manifest; per request with ?corrupt="`
+	Failures    int           `long:"export-failures" env:"EXPORT_FAILURES" default:"2" description:"requests of a faulty part that fail before it is served intact; every request if 0; per request with ?failures="`
+	RetryAfter  time.Duration `long:"export-retry-after" env:"EXPORT_RETRY_AFTER" default:"1s" description:"delay advised by the Retry-After header of unavailable parts"`
+}
+
+// ExportManifest lists the parts of a report, so downloaders can fetch and
+// check each of them.
+type ExportManifest struct {
+	// Report is the manifest of the whole report.
+	Report *Manifest    `json:"report"`
+	Parts  []ExportPart `json:"parts"`
+}
+
+// ExportPart is a part of an export: a CSV file with the header and a range
+// of the report rows.
+type ExportPart struct {
+	Number int    `json:"number"`
+	File   string `json:"file"`
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
+}
+
+// partFault is a fault injected into the responses of a part.
+type partFault struct {
+	status int
+	// remaining failed requests, forever if negative.
+	remaining  int
+	retryAfter time.Duration
+}
+
+// Exporter splits reports into parts and injects the faults of each export
+// into the responses of its parts.
+type Exporter struct {
+	mu sync.Mutex
+	// faults by part path, so exports of other reports keep theirs.
+	faults map[string]*partFault
+}
+
+// exporter splits the reports when parts are requested.
+var exporter = &Exporter{}
+
+// NewExporter constructs an Exporter, validating the options. Fault parts
+// are checked against the default number of parts, if any.
+func NewExporter(opts ExportOptions) (*Exporter, error) {
+	if opts.Parts < 0 || opts.Parts > maxExportParts {
+		return nil, fmt.Errorf("export parts must be from 0 to %d, got %d", maxExportParts, opts.Parts)
+	}
+	if opts.Failures < 0 {
+		return nil, fmt.Errorf("export failures must be non-negative, got %d", opts.Failures)
+	}
+	if opts.Parts > 0 {
+		if err := checkFaultParts(opts); err != nil {
+			return nil, err
+		}
+	}
+	return &Exporter{}, nil
+}
+
+// ParseExportParams reads the parts, not_found, unavailable, corrupt and
+// failures query parameters over opts. Fault parts are comma separated part
+// numbers, from 1.
+func ParseExportParams(query url.Values, opts ExportOptions) (ExportOptions, error) {
+	ints := map[string]*int{"parts": &opts.Parts, "failures": &opts.Failures}
+	for name, value := range ints {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("%s must be a non-negative integer, got %q", name, v)
+			}
+			*value = n
+		}
+	}
+	if opts.Parts > maxExportParts {
+		return opts, fmt.Errorf("parts must be at most %d, got %d", maxExportParts, opts.Parts)
+	}
+
+	lists := map[string]*[]int{"not_found": &opts.NotFound, "unavailable": &opts.Unavailable, "corrupt": &opts.Corrupt}
+	for name, value := range lists {
+		v, ok := query[name]
+		if !ok {
+			continue
+		}
+		var parts []int
+		for _, s := range strings.Split(v[0], ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be comma separated part numbers, got %q", name, v[0])
+			}
+			parts = append(parts, n)
+		}
+		*value = parts
+	}
+	if opts.Parts == 0 {
+		return opts, nil
+	}
+	return opts, checkFaultParts(opts)
+}
+
+// checkFaultParts returns an error if a fault part is not a part of opts,
+// or has more than one fault.
+func checkFaultParts(opts ExportOptions) error {
+	seen := map[int]bool{}
+	for _, parts := range [][]int{opts.NotFound, opts.Unavailable, opts.Corrupt} {
+		for _, n := range parts {
+			if n < 1 || n > opts.Parts {
+				return fmt.Errorf("fault part %d is not one of the %d parts", n, opts.Parts)
+			}
+			if seen[n] {
+				return fmt.Errorf("part %d has more than one fault", n)
+			}
+			seen[n] = true
+		}
+	}
+	return nil
+}
+
+// partName returns the file name of part n of the report.
+func partName(fileName string, n, parts int) string {
+	return fmt.Sprintf("%s.part%03dof%03d.csv", strings.TrimSuffix(fileName, ".csv"), n, parts)
+}
+
+// Export splits the report into the parts of opts, each with its manifest
+// in the report directory, writes the export manifest and arms the faults of
+// opts for the parts.
+func (e *Exporter) Export(report Report, opts ExportOptions) (*ExportManifest, error) {
+	path := report.Path()
+	m, err := LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	var dialect usagegen.Dialect
+	if m.Dialect != nil {
+		dialect = *m.Dialect
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := dialect.NewReader(f)
+	if _, err := r.Read(); err != nil {
+		return nil, err
+	}
+
+	export := &ExportManifest{Report: m}
+	for n := 1; n <= opts.Parts; n++ {
+		// Parts share the rows out evenly, in order.
+		rows := m.Rows*n/opts.Parts - m.Rows*(n-1)/opts.Parts
+		part, err := writePart(report.Dir(), partName(report.Name, n, opts.Parts), m, dialect, r, rows)
+		if err != nil {
+			return nil, err
+		}
+		export.Parts = append(export.Parts, ExportPart{
+			Number: n,
+			File:   part.File,
+			URL:    report.URL(opts.BaseURL, part.File),
+			Size:   part.Size,
+			Rows:   part.Rows,
+			SHA256: part.SHA256,
+			MD5:    part.MD5,
+		})
+	}
+
+	b, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path+SuffixExport, b, 0644); err != nil {
+		return nil, err
+	}
+
+	remaining := opts.Failures
+	if remaining == 0 {
+		remaining = -1
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.faults == nil {
+		e.faults = map[string]*partFault{}
+	}
+	for status, parts := range map[int][]int{
+		http.StatusNotFound:           opts.NotFound,
+		http.StatusServiceUnavailable: opts.Unavailable,
+		http.StatusOK:                 opts.Corrupt,
+	} {
+		for _, n := range parts {
+			path := filepath.Join(report.Dir(), partName(report.Name, n, opts.Parts))
+			e.faults[path] = &partFault{status: status, remaining: remaining, retryAfter: opts.RetryAfter}
+		}
+	}
+	return export, nil
+}
+
+// Forget drops the faults of the parts in dir, once removed.
+func (e *Exporter) Forget(dir string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for path := range e.faults {
+		if filepath.Dir(path) == dir {
+			delete(e.faults, path)
+		}
+	}
+}
+
+// writePart writes the next rows of r, after the header, as a part of the
+// report with its manifest.
+func writePart(dir, name string, report *Manifest, dialect usagegen.Dialect, r *csv.Reader, rows int) (*Manifest, error) {
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums := newChecksums()
+	w := dialect.NewWriter(io.MultiWriter(file, sums))
+	w.Write(report.Columns) // nolint:errcheck
+	for i := 0; i < rows; i++ {
+		record, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		w.Write(record) // nolint:errcheck
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	m := NewManifest(name, report.Seed, rows, report.Window, sums)
+	m.Dialect = report.Dialect
+	return m, WriteManifest(dir, m)
+}
+
+// ServeFault answers the request of the part in dir with its fault, if it
+// has one left, and reports whether it did.
+func (e *Exporter) ServeFault(w http.ResponseWriter, r *http.Request, dir, name string) bool {
+	e.mu.Lock()
+	fault := e.faults[filepath.Join(dir, name)]
+	if fault == nil || fault.remaining == 0 {
+		e.mu.Unlock()
+		return false
+	}
+	if fault.remaining > 0 {
+		fault.remaining--
+	}
+	status, retryAfter := fault.status, fault.retryAfter
+	e.mu.Unlock()
+
+	switch status {
+	case http.StatusNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "Report not found")
+	case http.StatusServiceUnavailable:
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "Part not available yet")
+	default:
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return true
+		}
+		// A digit of the last row changes, or a letter of the header of an
+		// empty part, keeping the size and the CSV valid.
+		if i := bytes.LastIndexAny(b, "0123456789"); i >= 0 {
+			b[i] = '0' + (b[i]-'0'+1)%10
+		} else if i := bytes.IndexAny(b, "abcdefghijklmnopqrstuvwxyz"); i >= 0 {
+			b[i] -= 'a' - 'A'
+		}
+		if encryptor.Enabled() {
+			encryptor.ServeSealed(w, r, filepath.Join(dir, name), b)
+			return true
+		}
+		SetIntegrityHeaders(w, r, filepath.Join(dir, name))
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+	}
+	return true
+}
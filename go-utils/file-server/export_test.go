@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseExportParams(t *testing.T) {
+	opts := ExportOptions{Failures: 2, NotFound: []int{2}}
+	got, err := ParseExportParams(url.Values{"parts": {"3"}, "unavailable": {"1, 3"}, "failures": {"0"}}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Parts != 3 || got.Failures != 0 || len(got.NotFound) != 1 || len(got.Unavailable) != 2 {
+		t.Errorf("unexpected options %+v", got)
+	}
+
+	for _, query := range []url.Values{
+		{"parts": {"-1"}},
+		{"parts": {"2000"}},
+		{"parts": {"3"}, "corrupt": {"4"}},
+		{"parts": {"3"}, "corrupt": {"2"}},
+		{"parts": {"3"}, "unavailable": {"first"}},
+	} {
+		if _, err := ParseExportParams(query, opts); err == nil {
+			t.Errorf("%s accepted", query.Encode())
+		}
+	}
+	if _, err := NewExporter(ExportOptions{Parts: 2, Corrupt: []int{3}}); err == nil {
+		t.Error("fault on a missing part accepted")
+	}
+}
+
+func TestExporter_Export(t *testing.T) {
+	defer func(keep int) { options.Reports.Keep = keep }(options.Reports.Keep)
+	options.Reports.Keep = 2
+
+	params, err := ParseReportParams(url.Values{"rows": {"100"}, "seed": {"9"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := CreateReport(params)
+	defer os.RemoveAll(report.Dir()) // nolint:errcheck
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := ParseExportParams(url.Values{"parts": {"3"}, "not_found": {"1"}, "unavailable": {"2"}, "corrupt": {"3"}, "failures": {"1"}}, ExportOptions{BaseURL: "http://files", RetryAfter: 1500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Exporter{}
+	m, err := e.Export(report, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Parts) != 3 || m.Report.Rows != 100 || m.Parts[0].URL != "http://files/files/"+report.ID+"/"+m.Parts[0].File {
+		t.Fatalf("unexpected export manifest %+v", m)
+	}
+
+	// Exporting another report keeps the faults of the first.
+	other, err := CreateReport(params)
+	defer os.RemoveAll(other.Dir()) // nolint:errcheck
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Export(other, ExportOptions{Parts: 3, Failures: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter = e
+	defer func() { exporter = &Exporter{} }()
+	router := mux.NewRouter()
+	router.HandleFunc("/files/{id}/{name}", HandleFile)
+	get := func(part ExportPart) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/files/"+report.ID+"/"+part.File, nil))
+		return w
+	}
+
+	// Every part fails once, then is served intact.
+	if w := get(m.Parts[0]); w.Code != http.StatusNotFound {
+		t.Errorf("part 1: status %d", w.Code)
+	}
+	if w := get(m.Parts[1]); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("part 2: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := get(m.Parts[2]); w.Code != http.StatusOK || sha256Hex(w.Body.Bytes()) == m.Parts[2].SHA256 || int64(w.Body.Len()) != m.Parts[2].Size {
+		t.Errorf("part 3: status %d, %d bytes of sha256 %s", w.Code, w.Body.Len(), sha256Hex(w.Body.Bytes()))
+	}
+
+	rows := 0
+	for _, part := range m.Parts {
+		w := get(part)
+		if w.Code != http.StatusOK || sha256Hex(w.Body.Bytes()) != part.SHA256 {
+			t.Fatalf("part %d: status %d, sha256 %s, want %s", part.Number, w.Code, sha256Hex(w.Body.Bytes()), part.SHA256)
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != part.Rows+1 || strings.Join(records[0], ",") != strings.Join(header, ",") {
+			t.Errorf("part %d: %d records, header %v", part.Number, len(records), records[0])
+		}
+		rows += part.Rows
+	}
+	if rows != m.Report.Rows {
+		t.Errorf("parts have %d rows, want %d", rows, m.Report.Rows)
+	}
+
+	e.Export(report, opts) // nolint:errcheck
+	e.Forget(report.Dir())
+	if w := get(m.Parts[0]); w.Code != http.StatusOK {
+		t.Errorf("part 1 of a forgotten export: status %d", w.Code)
+	}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
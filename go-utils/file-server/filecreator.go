@@ -1,138 +1,299 @@
 package main
 
 import (
-	"bytes"
-	"encoding/csv"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/fbatroni/fusemail/go-utils/mailcorpus"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
 )
 
 const (
-	SenderAddress       = "sender%d@sender%d.com"
-	ReceiverAddress     = "receiver%d@receiver%d.com"
-	DateFormat          = "%d/%d/%d %d:%d"
-	Subject             = "Hello %d"
-	PolicyTypes         = "PolicyType1, PolicyType2"
-	PolicyNames         = "PolicyName1, PolicyName2"
-	DeliveryMethod      = "ZixPort"
 	dateFormatWithHours = "20060102150405"
 	folder              = "output"
 )
 
-var (
-	fileName      string
-	numberOfRows  int
-	numberDomains int
-	numberSenders int
-	spamStartLine int
-	append        bool
-	header        = []string{"senderAddress", "recipientAddress", "sentTimestamp", "subject", "policyTypes", "policyNames", "deliveryMethod"}
-)
+var header = usagegen.Header
+
+// ReportOptions configures the reports kept in the output folder.
+type ReportOptions struct {
+	Keep int `long:"report-keep" env:"REPORT_KEEP" default:"20" description:"generated reports kept in the output folder, each in its own directory, so their links outlive newer reports"`
+}
+
+// Report is a generated report, alone in its directory under the output
+// folder with its sidecar files.
+type Report struct {
+	// ID names the directory of the report, and is part of its links.
+	ID   string
+	Name string
+}
+
+// Dir returns the directory of the report.
+func (r Report) Dir() string {
+	return filepath.Join(folder, r.ID)
+}
 
-type Record []string
+// Path returns the path of the report file.
+func (r Report) Path() string {
+	return filepath.Join(r.Dir(), r.Name)
+}
 
-func CreateFile() (string, error) {
+// URL returns the link to the file name of the report directory under base.
+func (r Report) URL(base, name string) string {
+	return base + "/files/" + r.ID + "/" + name
+}
 
-	var file *os.File
-	var err error
-	numberOfRows = randonNumberOfLine()
-	numberDomains := randonDiffDomains()
-	numberSenders := randonDiffDomains()
+// reports are the IDs of the reports kept in the output folder, oldest first.
+var reports = struct {
+	sync.Mutex
+	ids []string
+}{}
 
-	if _, err := os.Stat(folder); os.IsNotExist(err) {
-		os.Mkdir(folder, os.ModePerm)
+// ReportParams are the per-request generation parameters of a report;
+// zero values are picked at random.
+type ReportParams struct {
+	Rows    int
+	Seed    int64
+	Senders int
+	Domains int
+	// Window is a ParseWindow spec of the send dates.
+	Window string
+	// Addresses is a usagegen.ParseAddressMix spec.
+	Addresses string
+	// Dialect of the CSV, csvDialect if nil.
+	Dialect *usagegen.Dialect
+}
+
+// IsZero reports whether no parameter is set, so any report will do.
+func (p ReportParams) IsZero() bool {
+	return p == ReportParams{}
+}
+
+// ParseReportParams reads the rows, seed, senders, domains, window,
+// addresses and dialect query parameters.
+func ParseReportParams(query url.Values) (ReportParams, error) {
+	var p ReportParams
+	ints := map[string]*int{"rows": &p.Rows, "senders": &p.Senders, "domains": &p.Domains}
+	for name, value := range ints {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return p, fmt.Errorf("%s must be a positive integer, got %q", name, v)
+			}
+			*value = n
+		}
+	}
+	if v := query.Get("seed"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("seed must be an integer, got %q", v)
+		}
+		p.Seed = seed
+	}
+	if v := query.Get("window"); v != "" {
+		if _, err := ParseWindow(v, clock.Now()); err != nil {
+			return p, err
+		}
+		p.Window = v
+	}
+	if v := query.Get("addresses"); v != "" {
+		if _, err := usagegen.ParseAddressMix(v); err != nil {
+			return p, err
+		}
+		p.Addresses = v
 	}
-	err = RemoveContents(folder)
+	d, err := ParseDialectParams(query, options.CSV)
 	if err != nil {
-		return fileName, err
+		return p, err
 	}
+	p.Dialect = d
+	return p, nil
+}
 
-	fileName = "zix-usage-data-" + time.Now().Format(dateFormatWithHours) + ".csv"
+// CreateFile generates a new random report, see CreateReport.
+func CreateFile() (Report, error) {
+	return CreateReport(ReportParams{})
+}
 
-	// Creating the new file
-	file, err = os.Create(filepath.Join(folder, fileName))
-	if err != nil {
-		return fileName, err
+// CreateReport generates a report matching params in a new directory of the
+// output folder, or takes it from the pool when any report will do. Reports
+// older than the options.Reports.Keep last ones are removed.
+func CreateReport(params ReportParams) (Report, error) {
+	token, _ := uuid.NewV4()
+	report := Report{ID: token.String()}
+	if err := os.MkdirAll(report.Dir(), os.ModePerm); err != nil {
+		return report, err
 	}
+	keepReport(report.ID)
 
-	defer file.Close()
+	name, ok := pool.Take(report.Dir(), params)
+	if !ok {
+		var err error
+		if name, err = generateReport(report.Dir(), params); err != nil {
+			return report, err
+		}
+	}
+	report.Name = name
+	return report, nil
+}
 
-	csvWriter := csv.NewWriter(file)
+// keepReport records a new report, and removes those past the ones kept.
+func keepReport(id string) {
+	keep := options.Reports.Keep
+	if keep < 1 {
+		keep = 1
+	}
 
-	//Writes the header
-	err = csvWriter.Write(header)
-	if err != nil {
-		return fileName, err
+	reports.Lock()
+	reports.ids = append(reports.ids, id)
+	var old []string
+	if n := len(reports.ids) - keep; n > 0 {
+		old = append(old, reports.ids[:n]...)
+		reports.ids = reports.ids[n:]
 	}
+	reports.Unlock()
 
-	for i := 1; i < numberOfRows; i++ {
+	for _, id := range old {
+		dir := filepath.Join(folder, id)
+		if err := os.RemoveAll(dir); err != nil {
+			log.WithFields(log.Fields{"report": id, "err": err}).Error("cannot remove old report")
+		}
+		exporter.Forget(dir)
+	}
+}
 
-		sendDate := createRandomDateAsString()
-		domainNum := randonDomains(numberDomains)
-		senderNum := randonDomains(numberSenders)
+// generateReport writes a report, its corpus and its manifest into dir.
+func generateReport(dir string, params ReportParams) (string, error) {
 
-		err = writeCSVLine(senderNum, domainNum, sendDate, csvWriter)
-		if err != nil {
-			return fileName, err
+	seed := params.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	numberOfRows := randonNumberOfLine(rnd)
+	numberDomains := randonDiffDomains(rnd)
+	numberSenders := randonDiffDomains(rnd)
+	if params.Rows > 0 {
+		numberOfRows = params.Rows
+	}
+	if params.Domains > 0 {
+		numberDomains = params.Domains
+	}
+	if params.Senders > 0 {
+		numberSenders = params.Senders
+	}
+
+	spec := params.Window
+	if spec == "" {
+		spec = options.Clock.ReportWindow
+	}
+	now := clock.Now()
+	window, err := ParseWindow(spec, now)
+	if err != nil {
+		return "", err
+	}
+
+	addresses := addressMix
+	if params.Addresses != "" {
+		if addresses, err = usagegen.ParseAddressMix(params.Addresses); err != nil {
+			return "", err
 		}
+	}
 
+	dialect := csvDialect
+	if params.Dialect != nil {
+		dialect = *params.Dialect
 	}
 
-	// Write any buffered data to the underlying writer (standard output).
-	csvWriter.Flush()
+	name := reportName(now)
 
-	err = csvWriter.Error()
-	return fileName, err
-}
+	// Creating the new file
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return name, err
+	}
 
-func createRandomDateAsString() string {
+	defer file.Close()
 
-	year := 2018
-	month := 10
-	day := rand.Intn(30) + 1
+	var corpus *mailcorpus.Writer
+	var ids *mailcorpus.MessageIDs
+	if options.Corpus.Format != "" && options.Corpus.Format != CorpusNone {
+		corpus, err = mailcorpus.NewWriter(filepath.Join(dir, name), options.Corpus.Format, options.Corpus.Domain)
+		if err != nil {
+			return name, err
+		}
+		defer corpus.Close()
+		ids = mailcorpus.NewMessageIDs(seed)
+	}
 
-	hour := rand.Intn(12) + 1
-	minute := rand.Intn(59)
+	// Messages are written in row order while the rows are generated in parallel.
+	var onRow func(usagegen.Row) error
+	if corpus != nil {
+		onRow = func(row usagegen.Row) error {
+			sent, msgID := ids.Next(row.Date)
+			return corpus.Write(row.Number, sent, msgID, row.Record)
+		}
+	}
 
-	return fmt.Sprintf(DateFormat, day, month, year, hour, minute)
-}
+	opts := usagegen.Options{
+		Rows:      numberOfRows,
+		Seed:      seed,
+		Senders:   numberSenders,
+		Domains:   numberDomains,
+		Addresses: addresses,
+		Dialect:   dialect,
+	}
+	// Without a window, the send dates are the legacy ones of file-creator.
+	if spec != "" {
+		opts.Start, opts.End = window.From, window.To
+	}
 
-func randonNumberOfLine() int {
-	return rand.Intn(45000) + 15000
-}
+	// Checksums and row count are collected while writing, for the manifest.
+	sums := newChecksums()
+	rows, err := usagegen.WriteCSVParallel(io.MultiWriter(file, sums), timestamps.Apply(opts), 0, onRow)
+	if err != nil {
+		return name, err
+	}
 
-func randonDiffDomains() int {
-	return rand.Intn(150) + 50
-}
+	if corpus != nil {
+		if err = corpus.Close(); err != nil {
+			return name, err
+		}
+	}
 
-func randonDomains(numberOfDomains int) int {
-	return rand.Intn(numberOfDomains) + 1
-}
+	if err = file.Close(); err != nil {
+		return name, err
+	}
 
-func writeCSVLine(senderNum int, domainNum int, sendDate string, w *csv.Writer) error {
-	record := Record{
-		fmt.Sprintf(SenderAddress, senderNum, domainNum),
-		fmt.Sprintf(ReceiverAddress, domainNum, senderNum),
-		sendDate,
-		fmt.Sprintf(Subject, domainNum),
-		PolicyTypes,
-		PolicyNames,
-		DeliveryMethod,
+	m := NewManifest(name, seed, rows, window, sums)
+	if !dialect.IsDefault() {
+		m.Dialect = &dialect
 	}
+	err = WriteManifest(dir, m)
+	return name, err
+}
 
-	return w.Write(record)
+// reportName returns the name of a report generated at t.
+func reportName(t time.Time) string {
+	return "zix-usage-data-" + t.Format(dateFormatWithHours) + ".csv"
 }
 
-func (r Record) toString() string {
-	var buffer bytes.Buffer
-	for _, column := range r {
-		buffer.WriteString(column)
-	}
+func randonNumberOfLine(rnd *rand.Rand) int {
+	return rnd.Intn(45000) + 15000
+}
 
-	return buffer.String()
+func randonDiffDomains(rnd *rand.Rand) int {
+	return rnd.Intn(150) + 50
 }
 
 func RemoveContents(dir string) error {
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCreateReport_Keep(t *testing.T) {
+	defer func(keep int) { options.Reports.Keep = keep }(options.Reports.Keep)
+	options.Reports.Keep = 2
+
+	var created []Report
+	defer func() {
+		for _, report := range created {
+			os.RemoveAll(report.Dir()) // nolint:errcheck
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		report, err := CreateReport(ReportParams{Rows: 10})
+		created = append(created, report)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each report has its own directory, and only the oldest is removed.
+	for i, report := range created {
+		_, err := ioutil.ReadFile(report.Path())
+		if removed := i == 0; removed != os.IsNotExist(err) {
+			t.Errorf("report %d: %v", i, err)
+		}
+	}
+	if created[1].ID == created[2].ID {
+		t.Errorf("reports share directory %s", created[1].ID)
+	}
+}
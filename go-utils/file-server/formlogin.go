@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Form login routes.
+const (
+	RouteLoginForm     = "/login/form"
+	RouteLoginRedirect = "/login/redirect"
+)
+
+// FormLoginOptions configures the browser-style login flow, used by the
+// "form" auth mode.
+type FormLoginOptions struct {
+	RedirectHops int           `long:"form-redirect-hops" env:"FORM_REDIRECT_HOPS" default:"1" description:"number of 302 hops before the login form and after a successful login"`
+	RedirectLoop bool          `long:"form-redirect-loop" env:"FORM_REDIRECT_LOOP" description:"redirect hops point back to themselves forever"`
+	CSRFTTL      time.Duration `long:"form-csrf-ttl" env:"FORM_CSRF_TTL" default:"10m" description:"lifetime of the CSRF token embedded in the login form"`
+	CSRFExpired  bool          `long:"form-csrf-expired" env:"FORM_CSRF_EXPIRED" description:"reject every CSRF token as expired"`
+}
+
+var loginFormTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Zix Portal - Sign in</title></head>
+<body>
+{{if .Error}}<p class="error">{{.Error}}</p>
+{{end}}<form id="login" method="POST" action="{{.Action}}">
+<input type="hidden" name="csrf_token" value="{{.CSRF}}">
+<input type="hidden" name="next" value="{{.Next}}">
+<label>Username <input type="text" name="username"></label>
+<label>Password <input type="password" name="password"></label>
+<input type="submit" value="Sign in">
+</form>
+</body>
+</html>
+`))
+
+type loginForm struct {
+	Action string
+	CSRF   string
+	Next   string
+	Error  string
+}
+
+// redirectToLogin sends a client without a session towards the login form.
+func (a *Authenticator) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	next := url.QueryEscape(r.URL.RequestURI())
+	http.Redirect(w, r, a.hop(1, RouteLoginForm+"?next="+next), http.StatusFound)
+}
+
+// hop returns the URL of redirect hop n on the way to target, or target
+// itself once all hops are done.
+func (a *Authenticator) hop(n int, target string) string {
+	if !a.Options.Form.RedirectLoop && n > a.Options.Form.RedirectHops {
+		return target
+	}
+	return RouteLoginRedirect + "?hop=" + strconv.Itoa(n) + "&to=" + url.QueryEscape(target)
+}
+
+// HandleLoginRedirect follows one redirect hop, or loops forever with
+// RedirectLoop.
+func (a *Authenticator) HandleLoginRedirect(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("hop"))
+	target := r.URL.Query().Get("to")
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/report"
+	}
+
+	if a.Options.Form.RedirectLoop {
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, a.hop(n+1, target), http.StatusFound)
+}
+
+// HandleLoginForm renders the login form on GET, and validates the posted
+// CSRF token and credentials on POST, starting a session like HandleLogin.
+func (a *Authenticator) HandleLoginForm(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/report"
+	}
+
+	if r.Method != http.MethodPost {
+		a.renderLoginForm(w, http.StatusOK, next, "")
+		return
+	}
+
+	if ok, expired := a.checkCSRF(r.PostFormValue("csrf_token")); !ok {
+		msg := "Invalid request token"
+		if expired {
+			msg = "Your session has expired, please sign in again"
+		}
+		log.WithField("expired", expired).Info("rejected login form CSRF token")
+		a.renderLoginForm(w, http.StatusForbidden, next, msg)
+		return
+	}
+
+	want, found := a.users[r.PostFormValue("username")]
+	if !found || subtle.ConstantTimeCompare([]byte(r.PostFormValue("password")), []byte(want)) != 1 {
+		a.renderLoginForm(w, http.StatusUnauthorized, next, "Invalid username or password")
+		return
+	}
+
+	SetSessionCookie(w)
+	http.Redirect(w, r, a.hop(1, next), http.StatusFound)
+}
+
+func (a *Authenticator) renderLoginForm(w http.ResponseWriter, status int, next, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	err := loginFormTemplate.Execute(w, &loginForm{
+		Action: RouteLoginForm,
+		CSRF:   a.newCSRF(clock.Now()),
+		Next:   next,
+		Error:  msg,
+	})
+	if err != nil {
+		log.WithField("err", err).Error("cannot render login form")
+	}
+}
+
+// newCSRF returns a signed "<unix nanos>:<random>" token.
+func (a *Authenticator) newCSRF(now time.Time) string {
+	salt := make([]byte, 8)
+	io.ReadFull(rand.Reader, salt) // nolint:errcheck
+	payload := strconv.FormatInt(now.UnixNano(), 10) + ":" + hex.EncodeToString(salt)
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte("csrf:" + payload)) // nolint:errcheck
+	return base64.RawURLEncoding.EncodeToString([]byte(payload + ":" + hex.EncodeToString(mac.Sum(nil))))
+}
+
+// checkCSRF validates a token from newCSRF.
+// expired is true for a genuine token older than CSRFTTL.
+func (a *Authenticator) checkCSRF(token string) (ok bool, expired bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return false, false
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 {
+		return false, false
+	}
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte("csrf:" + parts[0] + ":" + parts[1])) // nolint:errcheck
+	if !hmac.Equal([]byte(parts[2]), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return false, false
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false, false
+	}
+	if a.Options.Form.CSRFExpired || clock.Since(time.Unix(0, nanos)) > a.Options.Form.CSRFTTL {
+		return false, true
+	}
+	return true, false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var csrfInput = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+func TestAuthenticator_FormLogin(t *testing.T) {
+	tests := []struct {
+		name        string
+		hops        int
+		csrfExpired bool
+		password    string
+		wantStatus  int
+	}{
+		{"login without redirect hops", 0, false, "secret", http.StatusFound},
+		{"login through redirect hops", 2, false, "secret", http.StatusFound},
+		{"wrong password", 1, false, "nope", http.StatusUnauthorized},
+		{"expired CSRF token", 1, true, "secret", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAuthenticator(AuthOptions{
+				Mode:  AuthForm,
+				Users: []string{"zix:secret"},
+				Form:  FormLoginOptions{RedirectHops: tt.hops, CSRFTTL: time.Minute, CSRFExpired: tt.csrfExpired},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			router := mux.NewRouter()
+			router.HandleFunc("/report", a.Wrap(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}))
+			router.HandleFunc(RouteLoginForm, a.HandleLoginForm)
+			router.HandleFunc(RouteLoginRedirect, a.HandleLoginRedirect)
+
+			do := func(r *http.Request) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				return w
+			}
+			// follow follows redirects, returning the final response.
+			follow := func(w *httptest.ResponseRecorder, cookie *http.Cookie) (*httptest.ResponseRecorder, int) {
+				redirects := 0
+				for w.Code == http.StatusFound {
+					r := httptest.NewRequest("GET", w.Header().Get("Location"), nil)
+					if cookie != nil {
+						r.AddCookie(cookie)
+					}
+					w = do(r)
+					redirects++
+				}
+				return w, redirects
+			}
+
+			form, redirects := follow(do(httptest.NewRequest("GET", "/report", nil)), nil)
+			if form.Code != http.StatusOK || redirects != tt.hops+1 {
+				t.Fatalf("login form: status = %d after %d redirects", form.Code, redirects)
+			}
+			match := csrfInput.FindStringSubmatch(form.Body.String())
+			if match == nil {
+				t.Fatalf("no CSRF token in form:\n%s", form.Body.String())
+			}
+
+			post := url.Values{"csrf_token": {match[1]}, "next": {"/report"}, "username": {"zix"}, "password": {tt.password}}
+			r := httptest.NewRequest("POST", RouteLoginForm, strings.NewReader(post.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := do(r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("login post: status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusFound {
+				return
+			}
+
+			var session *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				if c.Name == "JSESSIONID" {
+					session = c
+				}
+			}
+			if session == nil {
+				t.Fatal("no session cookie set")
+			}
+
+			report, _ := follow(w, session)
+			if report.Code != http.StatusTeapot {
+				t.Errorf("report after login: status = %d", report.Code)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_FormRedirectLoop(t *testing.T) {
+	a, err := NewAuthenticator(AuthOptions{
+		Mode:  AuthForm,
+		Users: []string{"zix:secret"},
+		Form:  FormLoginOptions{RedirectLoop: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	a.HandleLoginRedirect(w, httptest.NewRequest("GET", RouteLoginRedirect+"?hop=1&to=%2Freport", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != RouteLoginRedirect+"?hop=1&to=%2Freport" {
+		t.Errorf("status = %d, location = %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Integrity headers set on served reports.
+const (
+	HeaderDigest     = "Digest"
+	HeaderContentMD5 = "Content-MD5"
+	HeaderRowCount   = "X-Row-Count"
+)
+
+// Sidecar file suffixes, appended to the report name.
+const (
+	SuffixSHA256    = ".sha256"
+	SuffixManifest  = ".manifest.json"
+	SuffixSignature = ".manifest.json.sig"
+)
+
+// IntegrityOptions configures report manifests.
+type IntegrityOptions struct {
+	SigningKey string `long:"manifest-signing-key" env:"MANIFEST_SIGNING_KEY" description:"path to a PEM (PKCS #8) Ed25519 private key used to sign report manifests; unsigned if empty"`
+}
+
+// signingKey signs manifests when loaded with LoadSigningKey.
+var signingKey ed25519.PrivateKey
+
+// oidEd25519 identifies Ed25519 keys, as per RFC 8410.
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// privateKeyInfo is a PKCS #8 private key, and subjectPublicKeyInfo a PKIX
+// public key; they are encoded here as the crypto/x509 of Go 1.10 does not
+// know Ed25519.
+type privateKeyInfo struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// Window is the time span covered by the report timestamps, end exclusive.
+type Window struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Manifest describes a generated report, so consumers can validate it.
+type Manifest struct {
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	MD5       string    `json:"md5"`
+	Rows      int       `json:"rows"`
+	Columns   []string  `json:"columns"`
+	Seed      int64     `json:"seed"`
+	Window    Window    `json:"window"`
+	Generated time.Time `json:"generated"`
+	// Dialect of the report, if not the encoding/csv default.
+	Dialect *usagegen.Dialect `json:"dialect,omitempty"`
+}
+
+func (m *Manifest) String() string {
+	return fmt.Sprintf("{%T: %v %v rows, sha256 %v}", m, m.File, m.Rows, m.SHA256)
+}
+
+// checksums hashes everything written to it.
+type checksums struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+	size   int64
+}
+
+func newChecksums() *checksums {
+	return &checksums{sha256: sha256.New(), md5: md5.New()}
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	c.sha256.Write(p) // nolint:errcheck
+	c.md5.Write(p)    // nolint:errcheck
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// NewManifest constructs the manifest of a report written through sums.
+func NewManifest(fileName string, seed int64, rows int, window Window, sums *checksums) *Manifest {
+	return &Manifest{
+		File:      fileName,
+		Size:      sums.size,
+		SHA256:    hex.EncodeToString(sums.sha256.Sum(nil)),
+		MD5:       hex.EncodeToString(sums.md5.Sum(nil)),
+		Rows:      rows,
+		Columns:   header,
+		Seed:      seed,
+		Window:    window,
+		Generated: clock.Now(),
+	}
+}
+
+// WriteManifest writes the sidecar files of the report next to it in dir:
+// a sha256sum compatible checksum, the JSON manifest and, when a signing key
+// is loaded, the base64 Ed25519 signature of the manifest bytes.
+func WriteManifest(dir string, m *Manifest) error {
+	path := filepath.Join(dir, m.File)
+
+	sum := fmt.Sprintf("%s  %s\n", m.SHA256, m.File)
+	if err := ioutil.WriteFile(path+SuffixSHA256, []byte(sum), 0644); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+SuffixManifest, b, 0644); err != nil {
+		return err
+	}
+
+	if signingKey == nil {
+		return nil
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, b))
+	return ioutil.WriteFile(path+SuffixSignature, []byte(sig), 0644)
+}
+
+// LoadManifest reads the manifest of the report at path.
+func LoadManifest(path string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(path + SuffixManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	err = json.Unmarshal(b, m)
+	return m, err
+}
+
+// SetIntegrityHeaders sets digest and row count headers for the report at
+// path, if it has a manifest. Checksums describe the whole file, so they are
+// skipped on range requests.
+func SetIntegrityHeaders(w http.ResponseWriter, r *http.Request, path string) {
+	m, err := LoadManifest(path)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set(HeaderRowCount, strconv.Itoa(m.Rows))
+	if m.Dialect != nil {
+		w.Header().Set("Content-Type", m.Dialect.ContentType())
+	}
+
+	if r.Header.Get("Range") != "" {
+		return
+	}
+	w.Header().Set(HeaderDigest, "SHA-256="+hexToBase64(m.SHA256))
+	w.Header().Set(HeaderContentMD5, hexToBase64(m.MD5))
+}
+
+func hexToBase64(s string) string {
+	b, _ := hex.DecodeString(s)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// LoadSigningKey loads the Ed25519 manifest signing key from a PEM file.
+func LoadSigningKey(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return errors.New("no PEM data found in " + path)
+	}
+
+	var info privateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidEd25519) {
+		return fmt.Errorf("%s is a %v key, not an Ed25519 one", path, info.Algorithm.Algorithm)
+	}
+
+	// The private key is the 32-byte seed, itself DER encoded.
+	var seed []byte
+	if _, err := asn1.Unmarshal(info.PrivateKey, &seed); err != nil {
+		return err
+	}
+	if len(seed) != 32 {
+		return fmt.Errorf("%s has a %d-byte Ed25519 seed, want 32", path, len(seed))
+	}
+
+	_, key, err := ed25519.GenerateKey(bytes.NewReader(seed))
+	if err != nil {
+		return err
+	}
+
+	signingKey = key
+	return nil
+}
+
+// HandlePublicKey serves the PEM public key that verifies manifest signatures.
+func HandlePublicKey(w http.ResponseWriter, r *http.Request) { //nolint
+
+	if signingKey == nil {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "Manifest signing is disabled")
+		return
+	}
+
+	pub := signingKey.Public().(ed25519.PublicKey)
+	der, err := asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+		PublicKey: asn1.BitString{Bytes: pub, BitLength: 8 * len(pub)},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der}) // nolint:errcheck
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/server"
+	"bitbucket.org/fusemail/fm-lib-commons-golang/sys"
+	log "github.com/sirupsen/logrus"
+)
+
+// MailOptions configures email delivery of generated reports.
+type MailOptions struct {
+	Host               string           `long:"smtp-host" env:"SMTP_HOST" description:"SMTP server host:port reports are sent to; email delivery is disabled if empty"`
+	From               string           `long:"smtp-from" env:"SMTP_FROM" default:"reports@zix.example" description:"envelope and header sender"`
+	To                 []string         `long:"smtp-to" env:"SMTP_TO" env-delim:"," description:"report recipients"`
+	Subject            string           `long:"smtp-subject" env:"SMTP_SUBJECT" default:"Zix usage report" description:"subject prefix, followed by the report name"`
+	Username           string           `long:"smtp-username" env:"SMTP_USERNAME" description:"AUTH PLAIN username; no AUTH if empty"`
+	Password           sys.MaskedString `long:"smtp-password" env:"SMTP_PASSWORD" description:"AUTH PLAIN password"`
+	StartTLS           bool             `long:"smtp-starttls" env:"SMTP_STARTTLS" description:"require STARTTLS before sending"`
+	InsecureSkipVerify bool             `long:"smtp-insecure" env:"SMTP_INSECURE" description:"skip TLS certificate verification"`
+	Interval           time.Duration    `long:"smtp-interval" env:"SMTP_INTERVAL" description:"generate and email a report on this interval; zero to only send on request"`
+	Dir                string           `long:"smtp-dir" env:"SMTP_DIR" default:"mail" description:"folder the emailed reports are generated in, apart from the served ones"`
+}
+
+// Mailer emails generated reports as CSV attachments.
+type Mailer struct {
+	Options MailOptions
+	stop    chan struct{}
+
+	// to are the parsed Options.To.
+	to []*mail.Address
+
+	// mu serialises the reports generated into Options.Dir.
+	mu sync.Mutex
+}
+
+// NewMailer constructs a Mailer from options, parsing the recipients.
+func NewMailer(opts MailOptions) (*Mailer, error) {
+	m := &Mailer{Options: opts}
+	if len(opts.To) > 0 {
+		to, err := ParseRecipients(opts.To)
+		if err != nil {
+			return nil, err
+		}
+		m.to = to
+	}
+	return m, nil
+}
+
+// ParseRecipients parses a list of RFC 5322 addresses, such as
+// "Name <a@example.com>"; it is an error if there are none.
+func ParseRecipients(list []string) ([]*mail.Address, error) {
+	if len(list) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	to := make([]*mail.Address, len(list))
+	for i, s := range list {
+		addr, err := mail.ParseAddress(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %v", s, err)
+		}
+		to[i] = addr
+	}
+	return to, nil
+}
+
+// formatAddresses returns the addresses formatted for a header.
+func formatAddresses(to []*mail.Address) []string {
+	list := make([]string, len(to))
+	for i, addr := range to {
+		list[i] = addr.String()
+	}
+	return list
+}
+
+// Enabled reports whether an SMTP host is configured.
+func (m *Mailer) Enabled() bool {
+	return m != nil && m.Options.Host != ""
+}
+
+// Start emails a new report every Interval, until Stop.
+func (m *Mailer) Start() {
+	if !m.Enabled() || m.Options.Interval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	m.stop = stop
+	go func() {
+		ticker := time.NewTicker(m.Options.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := m.MailReport(m.to); err != nil {
+					log.WithField("err", err).Error("scheduled report email failed")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops scheduled emails.
+func (m *Mailer) Stop() {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+// MailReport generates a new random report into Options.Dir, replacing the
+// last one, and emails it to the recipients. The served reports and the
+// output folder are left alone.
+func (m *Mailer) MailReport(to []*mail.Address) (string, error) {
+	if len(to) == 0 {
+		return "", errors.New("no recipients")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(m.Options.Dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := RemoveContents(m.Options.Dir); err != nil {
+		return "", err
+	}
+	fileName, err := generateReport(m.Options.Dir, ReportParams{})
+	if err != nil {
+		return fileName, err
+	}
+	return fileName, m.SendReport(filepath.Join(m.Options.Dir, fileName), to)
+}
+
+// SendReport emails the report file at path to the recipients, sealed if
+// encryption is enabled.
+func (m *Mailer) SendReport(path string, to []*mail.Address) error {
+	if len(to) == 0 {
+		return errors.New("no recipients")
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	fileName := filepath.Base(path)
+	attachment, contentType := fileName, "text/csv"
+	if encryptor.Enabled() {
+		if body, err = encryptor.Seal(body, encryptor.Options.WrongKey); err != nil {
+			return err
+		}
+		attachment, contentType = fileName+".enc", "application/octet-stream"
+	}
+	msg, err := BuildReportMessage(m.Options.From, to, m.Options.Subject+" "+fileName, attachment, contentType, body, clock.Now())
+	if err != nil {
+		return err
+	}
+
+	err = m.send(to, msg)
+	log.WithFields(log.Fields{"file": fileName, "to": formatAddresses(to), "host": m.Options.Host, "err": err}).Info("report email")
+	return err
+}
+
+// send delivers msg over SMTP, with optional STARTTLS and AUTH PLAIN.
+func (m *Mailer) send(to []*mail.Address, msg []byte) error {
+	host, _, err := net.SplitHostPort(m.Options.Host)
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.Dial(m.Options.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close() // nolint:errcheck
+
+	if m.Options.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server does not support STARTTLS")
+		}
+		err = c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: m.Options.InsecureSkipVerify}) // nolint:gosec
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.Options.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.Options.Username, string(m.Options.Password), host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(m.Options.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(msg); err != nil {
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// BuildReportMessage builds a multipart/mixed message with a short text
+// body and the report file of contentType as a base64 attachment.
+func BuildReportMessage(from string, to []*mail.Address, subject, fileName, contentType string, file []byte, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	token, _ := uuid.NewV4()
+	hostname := from[strings.LastIndex(from, "@")+1:]
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(formatAddresses(to), ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", token.String(), hostname)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"7bit"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "Please find attached the usage report %s.\r\n", fileName)
+
+	attachment, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": fileName})},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": fileName})},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Base64 lines must not exceed 76 characters (RFC 2045).
+	encoded := base64.StdEncoding.EncodeToString(file)
+	for len(encoded) > 76 {
+		fmt.Fprintf(attachment, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(attachment, "%s\r\n", encoded)
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HandleEmailReport generates a report and emails it right away,
+// to ?to=<address> (repeatable) or the configured recipients.
+func (m *Mailer) HandleEmailReport(w http.ResponseWriter, r *http.Request) {
+	if !m.Enabled() {
+		server.WriteJSONErrorWithStatus(w, errors.New("email delivery is disabled"), http.StatusNotFound)
+		return
+	}
+
+	to := m.to
+	if list := r.URL.Query()["to"]; len(list) > 0 {
+		parsed, err := ParseRecipients(list)
+		if err != nil {
+			server.WriteJSONErrorWithStatus(w, err, http.StatusBadRequest)
+			return
+		}
+		to = parsed
+	}
+	if len(to) == 0 {
+		server.WriteJSONErrorWithStatus(w, errors.New("no recipients"), http.StatusBadRequest)
+		return
+	}
+
+	fileName, err := m.MailReport(to)
+	if err != nil {
+		server.WriteJSONErrorWithStatus(w, err, http.StatusBadGateway)
+		return
+	}
+
+	server.WriteJSON(w, map[string]interface{}{"file": fileName, "to": formatAddresses(to)})
+}
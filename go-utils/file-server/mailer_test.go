@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fbatroni/fusemail/go-utils/smtpsink"
+)
+
+func TestBuildReportMessage(t *testing.T) {
+	csv := bytes.Repeat([]byte("sender1@sender1.com,receiver1@receiver1.com,4/10/2018 7:26\n"), 20)
+
+	to := []*mail.Address{{Address: "a@example.com"}, {Name: "Béa, Usage", Address: "b@example.com"}}
+	raw, err := BuildReportMessage("reports@zix.example", to,
+		"Zix usage report", "report.csv", "text/csv", csv, time.Date(2018, 10, 4, 7, 26, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := msg.Header.AddressList("To"); err != nil || len(got) != 2 || *got[1] != *to[1] {
+		t.Errorf("To = %v, %v", got, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content type = %q, %v", mediaType, err)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal("missing text part: ", err)
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal("missing attachment: ", err)
+	}
+	if part.FileName() != "report.csv" {
+		t.Errorf("attachment name = %q", part.FileName())
+	}
+
+	encoded, _ := ioutil.ReadAll(part)
+	for _, line := range bytes.Split(encoded, []byte("\r\n")) {
+		if len(line) > 76 {
+			t.Errorf("base64 line of %d characters", len(line))
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.Replace(encoded, []byte("\r\n"), nil, -1)))
+	if err != nil || !bytes.Equal(decoded, csv) {
+		t.Errorf("attachment does not round trip: %v", err)
+	}
+}
+
+func TestMailer_MailReport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random reports of up to 60000 rows exceed the default message size.
+	config := smtpsink.NewConfig()
+	config.MaxSize = 0
+	sink := smtpsink.New(config)
+	go sink.Serve(l) // nolint:errcheck
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		sink.Shutdown(ctx) // nolint:errcheck
+	}()
+
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Reports served from the output folder are left alone.
+	os.MkdirAll(folder, os.ModePerm) // nolint:errcheck
+	served := filepath.Join(folder, "served.csv")
+	ioutil.WriteFile(served, []byte("served"), 0644) // nolint:errcheck
+	defer os.Remove(served)
+
+	m, err := NewMailer(MailOptions{Host: l.Addr().String(), From: "reports@zix.example", To: []string{"a@example.com"}, Subject: "Zix usage report", Dir: dir, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := m.MailReport([]*mail.Address{{Address: "b@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+		t.Errorf("report not in the mail folder: %v", err)
+	}
+
+	// Scheduled reports too.
+	m.Start()
+	deadline := time.Now().Add(30 * time.Second)
+	for list, _ := sink.Store.List(); len(list) < 2 && time.Now().Before(deadline); list, _ = sink.Store.List() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Stop()
+
+	list, _ := sink.Store.List()
+	if len(list) < 2 {
+		t.Fatalf("sink received %d messages, want 2", len(list))
+	}
+	requested := 0
+	for _, msg := range list {
+		if msg.From != "reports@zix.example" || len(msg.To) != 1 || !strings.HasPrefix(msg.Subject, "Zix usage report zix-usage-data-") {
+			t.Errorf("unexpected message %+v", msg)
+		}
+		if msg.To[0] == "b@example.com" && msg.Subject == "Zix usage report "+name {
+			requested++
+		}
+	}
+	if requested != 1 {
+		t.Errorf("%d messages of the requested report", requested)
+	}
+	if b, err := ioutil.ReadFile(served); err != nil || string(b) != "served" {
+		t.Errorf("served report changed: %q, %v", b, err)
+	}
+}
+
+func TestMailer_HandleEmailReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewMailer(MailOptions{To: []string{"not an address"}}); err == nil {
+		t.Error("invalid configured recipient accepted")
+	}
+
+	// Nothing listens on the SMTP host.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := l.Addr().String()
+	l.Close() // nolint:errcheck
+
+	m, err := NewMailer(MailOptions{Host: host, From: "reports@zix.example", Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusBadRequest},
+		{"?to=a@example.com&to=nope", http.StatusBadRequest},
+		{"?to=" + url.QueryEscape("A <a@example.com>"), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		m.HandleEmailReport(w, httptest.NewRequest(http.MethodPost, "/report/email"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%q: status %d, want %d: %s", tt.query, w.Code, tt.code, w.Body)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/satori/go.uuid"
@@ -18,6 +20,8 @@ import (
 	"bitbucket.org/fusemail/fm-lib-commons-golang/sys"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/fbatroni/fusemail/go-utils/smtpsink"
 )
 
 // exit code constants
@@ -27,18 +31,48 @@ const (
 	Port = 9091
 )
 
-var tokenString string
+// sessions holds the expiry of each session by token, by the clock.
+var sessions = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
 
 var flagErrorCode int
 
 var HttpErrors map[int]string
 
+var webhooks *Webhook
+
+var encryptor *Encryptor
+
+var authenticator *Authenticator
+
+var mailer *Mailer
+
+var sink *smtpsink.Server
+
 var options struct {
 	System      sys.Options               `group:"Default System Options"`
 	Application server.ApplicationOptions `group:"Default Application Server Options"`
 
 	// Plus your own opts. (remove this for command-line app)
-
+	Reports    ReportOptions     `group:"Report Options"`
+	Webhook    WebhookOptions    `group:"Webhook Options"`
+	Integrity  IntegrityOptions  `group:"Integrity Options"`
+	Encryption EncryptionOptions `group:"Encryption Options"`
+	Auth       AuthOptions       `group:"Authentication Options"`
+	Mail       MailOptions       `group:"Email Delivery Options"`
+	Sink       SinkOptions       `group:"SMTP Sink Options"`
+	Corpus     CorpusOptions     `group:"Message Corpus Options"`
+	Pool       PoolOptions       `group:"Report Pool Options"`
+	Events     EventOptions      `group:"Event Stream Options"`
+	NSQ        NSQOptions        `group:"NSQ Publishing Options"`
+	Clock      ClockOptions      `group:"Clock Options"`
+	Timestamp  TimestampOptions  `group:"Timestamp Options"`
+	Address    AddressOptions    `group:"Address Options"`
+	CSV        DialectOptions    `group:"CSV Dialect Options"`
+	Export     ExportOptions     `group:"Partitioned Export Options"`
+	Upload     UploadOptions     `group:"Upload Drop Box Options"`
 }
 
 func init() {
@@ -73,10 +107,119 @@ func main() {
 	// to display README as service home page
 	// bindata.Setup(Asset, AssetDir, AssetNames)
 
+	var err error
+	clock, err = NewClock(options.Clock)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup clock")
+		return
+	}
+
+	timestamps, err = NewTimestamps(options.Timestamp)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup timestamps")
+		return
+	}
+
+	addressMix, err = NewAddressMix(options.Address)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup address mix")
+		return
+	}
+
+	csvDialect, err = NewDialect(options.CSV)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup CSV dialect")
+		return
+	}
+
+	if err := LoadSigningKey(options.Integrity.SigningKey); err != nil {
+		log.WithField("err", err).Error("Cannot load manifest signing key")
+		return
+	}
+
+	exporter, err = NewExporter(options.Export)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup partitioned export")
+		return
+	}
+
+	encryptor, err = NewEncryptor(options.Encryption)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup report encryption")
+		return
+	}
+
+	authenticator, err = NewAuthenticator(options.Auth)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup report authentication")
+		return
+	}
+
+	webhooks = NewWebhook(options.Webhook)
+
+	mailer, err = NewMailer(options.Mail)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup report email")
+		return
+	}
+
+	sink, err = NewSink(options.Sink)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup SMTP sink")
+		return
+	}
+
+	// Reports left by a previous run are not tracked, so never removed.
+	if err := os.RemoveAll(folder); err != nil {
+		log.WithField("err", err).Error("Cannot clear the output folder")
+		return
+	}
+
+	pool, err = NewReportPool(options.Pool)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup report pool")
+		return
+	}
+
+	publisher, err = NewReportPublisher(options.NSQ)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup NSQ publishing")
+		return
+	}
+
+	events, err = NewEventStream(options.Events)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup event stream")
+		return
+	}
+
+	uploads, err = NewUploads(options.Upload)
+	if err != nil {
+		log.WithField("err", err).Error("Cannot setup upload drop box")
+		return
+	}
+
 	router := mux.NewRouter()
 
 	router.HandleFunc("/login", HandleLogin)
-	router.HandleFunc("/report", HandleReport)
+	router.HandleFunc("/report", authenticator.Wrap(HandleReport))
+	router.HandleFunc(RouteLoginForm, authenticator.HandleLoginForm)
+	router.HandleFunc(RouteLoginRedirect, authenticator.HandleLoginRedirect)
+	router.HandleFunc("/files/{id}/{name}", authenticator.Wrap(HandleFile))
+	router.HandleFunc("/webhooks/deliveries", webhooks.HandleDeliveries)
+	router.HandleFunc("/manifest/key", HandlePublicKey)
+	router.HandleFunc("/report/email", mailer.HandleEmailReport).Methods(http.MethodPost)
+	router.HandleFunc("/events", events.HandleEvents).Methods(http.MethodGet)
+	router.HandleFunc("/upload", uploads.HandleUpload).Methods(http.MethodPut, http.MethodPost)
+	router.HandleFunc("/upload", uploads.HandleUploads).Methods(http.MethodGet, http.MethodDelete)
+	router.HandleFunc("/upload/{id}", uploads.HandleUploadFile).Methods(http.MethodGet)
+	if options.Clock.Admin {
+		router.HandleFunc("/admin/clock", clock.HandleClock).Methods(http.MethodGet, http.MethodPost)
+	}
+	if sink != nil {
+		smtpsink.SetLogger(system)
+		router.PathPrefix("/smtp/").Handler(sink.Handler("/smtp"))
+	}
 
 	server.SetLogger(system)
 	_, ok := server.Setup(&server.Config{
@@ -96,7 +239,11 @@ func main() {
 
 	// Setup metrics.
 	metrics.SetLogger(system)
-	metrics.Register() // No additional metrics.
+	metrics.Register(SinkVectors()...)
+	metrics.Register(PoolVectors()...)
+	metrics.Register(EventVectors()...)
+	metrics.Register(NSQVectors()...)
+	metrics.Register(UploadVectors()...)
 	metrics.Serve()
 
 	// Setup health with dependencies.
@@ -112,6 +259,15 @@ func main() {
 
 	// Start serving the application
 	server.Serve()
+	mailer.Start()
+	pool.Start()
+	if sink != nil {
+		go func() {
+			if err := sink.ListenAndServe(); err != nil {
+				log.WithField("err", err).Fatal("failed to start SMTP sink")
+			}
+		}()
+	}
 
 	// Consul get datacenter
 	if options.Application.ConsulRegistration {
@@ -129,6 +285,15 @@ func main() {
 
 	sys.BlockAndFunc(func(os.Signal) {
 		server.ShutdownAll() // ShutdownAllWithTimeout, ShutdownAllWithContext.
+		mailer.Stop()
+		pool.Stop()
+		events.Stop()
+		publisher.Wait()
+		if sink != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), server.ShutdownAllDefaultTimeout)
+			sink.Shutdown(ctx) // nolint:errcheck
+			cancel()
+		}
 		// All dependencies that need to be close
 	})
 
@@ -137,15 +302,35 @@ func main() {
 
 func HandleLogin(w http.ResponseWriter, r *http.Request) { //nolint
 
+	SetSessionCookie(w)
+
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "Login succeded")
+
+}
+
+// SetSessionCookie starts a new session and sets its JSESSIONID cookie, sent
+// to /report and /upload alike. The sessions of other clients stay valid.
+func SetSessionCookie(w http.ResponseWriter) {
+
 	token, _ := uuid.NewV4()
-	tokenString = token.String()
+	tokenString := token.String()
 	rawc := "JSESSIONID=" + tokenString
 
-	expire := time.Now().AddDate(0, 0, 1)
+	now := clock.Now()
+	expire := now.AddDate(0, 0, 1)
+	sessions.Lock()
+	for t, expires := range sessions.expires {
+		if !now.Before(expires) {
+			delete(sessions.expires, t)
+		}
+	}
+	sessions.expires[tokenString] = expire
+	sessions.Unlock()
 	cookie := http.Cookie{
 		Name:       "JSESSIONID",
 		Value:      tokenString,
-		Path:       "/report",
+		Path:       "/",
 		Domain:     "localhost:9091",
 		Expires:    expire,
 		RawExpires: expire.Format(time.UnixDate),
@@ -157,10 +342,19 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) { //nolint
 	}
 
 	http.SetCookie(w, &cookie)
+}
 
-	w.WriteHeader(http.StatusOK)
-	io.WriteString(w, "Login succeded")
-
+// HasSession reports whether r carries the cookie of a session, unexpired by
+// the clock.
+func HasSession(r *http.Request) bool {
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil {
+		return false
+	}
+	sessions.Lock()
+	expires, ok := sessions.expires[cookie.Value]
+	sessions.Unlock()
+	return ok && clock.Now().Before(expires)
 }
 
 func HandleReport(w http.ResponseWriter, r *http.Request) { //nolint
@@ -171,13 +365,45 @@ func HandleReport(w http.ResponseWriter, r *http.Request) { //nolint
 		log.Info("Using input error")
 	} else {
 
-		fileName, err := CreateFile()
+		params, err := ParseReportParams(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+		export, err := ParseExportParams(r.URL.Query(), options.Export)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		report, err := CreateReport(params)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			io.WriteString(w, err.Error())
+			return
+		}
+
+		SetCorpusHeaders(w, report)
+
+		if export.Parts > 0 {
+			m, err := exporter.Export(report, export)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+			server.WriteJSON(w, m)
+		} else if encryptor.Enabled() {
+			encryptor.ServeEncrypted(w, r, report.Path())
+		} else {
+			SetIntegrityHeaders(w, r, report.Path())
+			http.ServeFile(w, r, report.Path())
 		}
 
-		http.ServeFile(w, r, "./output/"+fileName)
+		webhooks.Notify(report)
+		publisher.Notify(report)
 
 	}
 
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/metrics"
+	"github.com/fbatroni/fusemail/go-utils/nsqpub"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+	log "github.com/sirupsen/logrus"
+)
+
+// NSQOptions configures the publication of the served reports to NSQ.
+type NSQOptions struct {
+	Address   string        `long:"nsqd-http-address" env:"NSQD_HTTP_ADDRESS" description:"publish the rows of every served report as JSON messages to this nsqd HTTP address"`
+	Topic     string        `long:"nsq-topic" env:"NSQ_TOPIC" default:"zix_usage" description:"NSQ topic of the published rows"`
+	BatchSize int           `long:"nsq-batch-size" env:"NSQ_BATCH_SIZE" default:"100" description:"rows published per /mpub request; one /pub per row if 1"`
+	Rate      float64       `long:"nsq-rate" env:"NSQ_RATE" default:"0" description:"rows published per second of each report, unlimited if 0"`
+	Defer     time.Duration `long:"nsq-defer" env:"NSQ_DEFER" default:"0" description:"delay the delivery of the published rows by nsqd; rows are then published one /pub at a time"`
+}
+
+// NSQ publication results, as counted in nsq_publish_messages_total.
+const (
+	NSQPublished = "published"
+	NSQFailed    = "failed"
+)
+
+// metrics vectors
+var (
+	nsqPublishMessagesTotal = metrics.NewMetric(&metrics.Vector{
+		Type:   metrics.TypeCounter,
+		Name:   "nsq_publish_messages_total",
+		Desc:   "Report rows published to nsqd by topic and result",
+		Labels: []string{"topic", "result"},
+	})
+)
+
+// NSQVectors returns the NSQ publication metric vectors, to pass to metrics.Register.
+func NSQVectors() []*metrics.Vector {
+	return metrics.NewMetricVectors([]*metrics.Metric{
+		nsqPublishMessagesTotal,
+	})
+}
+
+// publisher publishes the served reports when enabled, see NewReportPublisher.
+var publisher *ReportPublisher
+
+// ReportPublisher publishes the rows of reports to an nsqd, as UsageEvent
+// messages numbered by row.
+type ReportPublisher struct {
+	Options NSQOptions
+
+	wg sync.WaitGroup
+}
+
+// NewReportPublisher constructs a ReportPublisher, validating the options,
+// or returns nil if disabled.
+func NewReportPublisher(opts NSQOptions) (*ReportPublisher, error) {
+	if opts.Address == "" {
+		return nil, nil
+	}
+	if _, err := nsqpub.New(opts.publisherOptions()); err != nil {
+		return nil, err
+	}
+	return &ReportPublisher{Options: opts}, nil
+}
+
+func (opts NSQOptions) publisherOptions() nsqpub.Options {
+	return nsqpub.Options{
+		Addr:      opts.Address,
+		Topic:     opts.Topic,
+		BatchSize: opts.BatchSize,
+		Rate:      opts.Rate,
+		Defer:     opts.Defer,
+	}
+}
+
+// Notify publishes the rows of the report in the background. The report is
+// opened before returning, so it is published whole even if removed meanwhile.
+func (rp *ReportPublisher) Notify(report Report) {
+	if rp == nil {
+		return
+	}
+	logger := log.WithFields(log.Fields{"file": report.Name, "topic": rp.Options.Topic})
+	f, dialect, err := openReport(report.Path())
+	if err != nil {
+		logger.WithField("err", err).Error("cannot publish report to nsqd")
+		return
+	}
+
+	rp.wg.Add(1)
+	go func() {
+		defer rp.wg.Done()
+		defer f.Close()
+		stats, err := rp.publish(f, dialect)
+		if err != nil {
+			logger.WithFields(log.Fields{"err": err, "failed": stats.Failed}).Error("cannot publish report to nsqd")
+			return
+		}
+		logger.WithField("published", stats.Published).Info("report published to nsqd")
+	}()
+}
+
+// Wait waits for the reports being published.
+func (rp *ReportPublisher) Wait() {
+	if rp == nil {
+		return
+	}
+	rp.wg.Wait()
+}
+
+// openReport opens the report at path, and returns the dialect of its manifest.
+func openReport(path string) (*os.File, usagegen.Dialect, error) {
+	var dialect usagegen.Dialect
+	if m, err := LoadManifest(path); err == nil && m.Dialect != nil {
+		dialect = *m.Dialect
+	}
+	f, err := os.Open(path)
+	return f, dialect, err
+}
+
+// Publish publishes the rows of the report at path, read in the dialect of
+// its manifest. Failed batches do not stop the publication; the last error is
+// returned with the counts.
+func (rp *ReportPublisher) Publish(path string) (nsqpub.Stats, error) {
+	f, dialect, err := openReport(path)
+	if err != nil {
+		return nsqpub.Stats{}, err
+	}
+	defer f.Close()
+	return rp.publish(f, dialect)
+}
+
+// publish publishes the rows of the report read from f, see Publish.
+func (rp *ReportPublisher) publish(f io.Reader, dialect usagegen.Dialect) (nsqpub.Stats, error) {
+	p, err := nsqpub.New(rp.Options.publisherOptions())
+	if err != nil {
+		return nsqpub.Stats{}, err
+	}
+
+	r := dialect.NewReader(f)
+	if _, err := r.Read(); err != nil {
+		return nsqpub.Stats{}, err
+	}
+
+	var lastErr error
+	for row := int64(1); ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rp.count(p.Stats()), err
+		}
+
+		msg, err := json.Marshal(NewUsageEvent(row, record))
+		if err != nil {
+			return rp.count(p.Stats()), err
+		}
+		if err := p.Publish(msg); err != nil {
+			lastErr = err
+		}
+	}
+	if err := p.Flush(); err != nil {
+		lastErr = err
+	}
+	return rp.count(p.Stats()), lastErr
+}
+
+func (rp *ReportPublisher) count(stats nsqpub.Stats) nsqpub.Stats {
+	nsqPublishMessagesTotal.Add(float64(stats.Published), rp.Options.Topic, NSQPublished)
+	nsqPublishMessagesTotal.Add(float64(stats.Failed), rp.Options.Topic, NSQFailed)
+	return stats
+}
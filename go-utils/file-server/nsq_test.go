@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fbatroni/fusemail/go-utils/nsqpub"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+func TestReportPublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "report.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := usagegen.WriteCSV(f, usagegen.Options{Rows: 5, Seed: 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fake := &nsqpub.FakeNSQD{}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	if rp, err := NewReportPublisher(NSQOptions{}); rp != nil || err != nil {
+		t.Errorf("disabled publisher %v, %v", rp, err)
+	}
+	if _, err := NewReportPublisher(NSQOptions{Address: ts.URL, Topic: "bad topic"}); err == nil {
+		t.Error("invalid topic accepted")
+	}
+
+	rp, err := NewReportPublisher(NSQOptions{Address: ts.URL, Topic: "zix_usage", BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := rp.Publish(path)
+	if err != nil || stats != (nsqpub.Stats{Published: 5, Requests: 3}) {
+		t.Fatalf("Publish() = %+v, %v", stats, err)
+	}
+
+	g := usagegen.New(usagegen.Options{Rows: 5, Seed: 3})
+	for i, m := range fake.Messages() {
+		g.Next()
+		var e UsageEvent
+		if err := json.Unmarshal(m.Body, &e); err != nil {
+			t.Fatal(err)
+		}
+		if want := NewUsageEvent(int64(i+1), g.Row().Record); e != want {
+			t.Errorf("message %d = %+v, want %+v", i, e, want)
+		}
+	}
+
+	fake.FailStatus = http.StatusServiceUnavailable
+	stats, err = rp.Publish(path)
+	if err == nil || stats.Failed != 5 {
+		t.Errorf("Publish() to a failing nsqd = %+v, %v", stats, err)
+	}
+
+	// A report removed once notified is still published whole.
+	fake.FailStatus = 0
+	report := Report{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Name: "report.csv"}
+	os.MkdirAll(report.Dir(), os.ModePerm) // nolint:errcheck
+	os.Rename(path, report.Path())         // nolint:errcheck
+	defer os.RemoveAll(report.Dir())       // nolint:errcheck
+	published := len(fake.Messages())
+	rp.Notify(report)
+	os.RemoveAll(report.Dir()) // nolint:errcheck
+	rp.Wait()
+	if n := len(fake.Messages()) - published; n != 5 {
+		t.Errorf("published %d rows of a removed report, want 5", n)
+	}
+}
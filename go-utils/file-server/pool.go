@@ -0,0 +1,314 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// PoolOptions configures the pool of pre-generated reports.
+type PoolOptions struct {
+	Size    int           `long:"report-pool-size" env:"REPORT_POOL_SIZE" default:"0" description:"reports kept pre-generated to serve /report instantly; generated on demand if 0"`
+	Workers int           `long:"report-pool-workers" env:"REPORT_POOL_WORKERS" default:"1" description:"background workers refilling the report pool"`
+	Dir     string        `long:"report-pool-dir" env:"REPORT_POOL_DIR" default:"output-pool" description:"directory of the pre-generated reports, outside the output folder"`
+	Retry   time.Duration `long:"report-pool-retry" env:"REPORT_POOL_RETRY" default:"5s" description:"delay before a worker retries a failed generation"`
+}
+
+// Pool request results, as counted in report_pool_requests_total.
+const (
+	PoolHit    = "hit"
+	PoolMiss   = "miss"
+	PoolBypass = "bypass"
+)
+
+// metrics vectors
+var (
+	poolReports = metrics.NewMetric(&metrics.Vector{
+		Type: metrics.TypeGauge,
+		Name: "report_pool_reports",
+		Desc: "Pre-generated reports ready in the pool",
+	})
+	poolRequestsTotal = metrics.NewMetric(&metrics.Vector{
+		Type:   metrics.TypeCounter,
+		Name:   "report_pool_requests_total",
+		Desc:   "Report requests by pool result: hit, miss when empty, bypass when parameters are set",
+		Labels: []string{"result"},
+	})
+	poolHitRatio = metrics.NewMetric(&metrics.Vector{
+		Type: metrics.TypeGauge,
+		Name: "report_pool_hit_ratio",
+		Desc: "Share of the report requests without parameters served from the pool",
+	})
+	poolRefillLag = metrics.NewMetric(&metrics.Vector{
+		Type:    metrics.TypeHistogram,
+		Name:    "report_pool_refill_lag_seconds",
+		Desc:    "Time from taking a report from the pool until its replacement is ready",
+		Buckets: metrics.DefaultTimeBuckets,
+	})
+)
+
+// PoolVectors returns the pool metric vectors, to pass to metrics.Register.
+func PoolVectors() []*metrics.Vector {
+	return metrics.NewMetricVectors([]*metrics.Metric{
+		poolReports,
+		poolRequestsTotal,
+		poolHitRatio,
+		poolRefillLag,
+	})
+}
+
+// pool serves /report when enabled, see NewReportPool.
+var pool *ReportPool
+
+// pooledReport is a report generated alone in its directory.
+type pooledReport struct {
+	dir  string
+	name string
+}
+
+// PoolStats counts the requests to a ReportPool.
+type PoolStats struct {
+	Hits     int
+	Misses   int
+	Bypassed int
+}
+
+// ReportPool keeps Size reports pre-generated by background workers, each in
+// its own directory under Dir until taken.
+type ReportPool struct {
+	Options PoolOptions
+
+	ready chan pooledReport
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	mu    sync.Mutex
+	seq   int
+	taken []time.Time
+	stats PoolStats
+}
+
+// NewReportPool constructs a ReportPool, or returns nil if disabled.
+func NewReportPool(opts PoolOptions) (*ReportPool, error) {
+	if opts.Size <= 0 {
+		return nil, nil
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+
+	// Reports left by a previous run may be partial.
+	if err := os.RemoveAll(opts.Dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &ReportPool{
+		Options: opts,
+		ready:   make(chan pooledReport, opts.Size),
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// Start starts the workers filling the pool, until Stop.
+func (p *ReportPool) Start() {
+	if p == nil {
+		return
+	}
+	for i := 0; i < p.Options.Workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+// Stop stops the workers, once their current report is generated.
+func (p *ReportPool) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *ReportPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		report, err := p.generate()
+		if err != nil {
+			log.WithField("err", err).Error("report pool generation failed")
+			select {
+			case <-time.After(p.Options.Retry):
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+
+		select {
+		case p.ready <- report:
+			p.refilled()
+		case <-p.stop:
+			os.RemoveAll(report.dir) // nolint:errcheck
+			return
+		}
+	}
+}
+
+func (p *ReportPool) generate() (pooledReport, error) {
+	p.mu.Lock()
+	p.seq++
+	dir := filepath.Join(p.Options.Dir, strconv.Itoa(p.seq))
+	p.mu.Unlock()
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return pooledReport{}, err
+	}
+	name, err := generateReport(dir, ReportParams{})
+	if err != nil {
+		os.RemoveAll(dir) // nolint:errcheck
+	}
+	return pooledReport{dir: dir, name: name}, err
+}
+
+// refilled records a report added to the pool, replacing the oldest taken one.
+func (p *ReportPool) refilled() {
+	poolReports.Set(float64(len(p.ready)))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.taken) > 0 {
+		poolRefillLag.SinceStart(p.taken[0])
+		p.taken = p.taken[1:]
+	}
+}
+
+// Take moves a pooled report into dir and returns its name, if params allow
+// any report and the pool is not empty. A nil pool is always empty. Taken
+// reports are renamed and their manifest dated by the clock, as if generated
+// then; none is taken while the report window is configured, as the send
+// dates of pooled reports are drawn when generated.
+func (p *ReportPool) Take(dir string, params ReportParams) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	if !params.IsZero() || options.Clock.ReportWindow != "" {
+		p.count(PoolBypass)
+		return "", false
+	}
+
+	for {
+		var report pooledReport
+		select {
+		case report = <-p.ready:
+		default:
+			p.count(PoolMiss)
+			return "", false
+		}
+
+		p.mu.Lock()
+		p.taken = append(p.taken, time.Now())
+		p.mu.Unlock()
+		poolReports.Set(float64(len(p.ready)))
+
+		if err := moveContents(report.dir, dir); err != nil {
+			log.WithField("err", err).Error("cannot take report from the pool")
+			os.RemoveAll(report.dir) // nolint:errcheck
+			continue
+		}
+		name, err := restamp(dir, report.name, clock.Now())
+		if err != nil {
+			log.WithField("err", err).Error("cannot take report from the pool")
+			RemoveContents(dir) // nolint:errcheck
+			continue
+		}
+		p.count(PoolHit)
+		return name, true
+	}
+}
+
+func (p *ReportPool) count(result string) {
+	poolRequestsTotal.AddOne(result)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch result {
+	case PoolHit:
+		p.stats.Hits++
+	case PoolMiss:
+		p.stats.Misses++
+	case PoolBypass:
+		p.stats.Bypassed++
+	}
+	if served := p.stats.Hits + p.stats.Misses; served > 0 {
+		poolHitRatio.Set(float64(p.stats.Hits) / float64(served))
+	}
+}
+
+// Stats returns the request counts.
+func (p *ReportPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Len returns the number of reports ready.
+func (p *ReportPool) Len() int {
+	return len(p.ready)
+}
+
+// moveContents moves the files of src into dst, and removes src.
+func moveContents(src, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Rename(filepath.Join(src, f.Name()), filepath.Join(dst, f.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(src)
+}
+
+// restamp renames the report name in dir and its sidecar files as generated
+// at t, dates its manifest t and writes it again, and returns the new name.
+func restamp(dir, name string, t time.Time) (string, error) {
+	newName := reportName(t)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return name, err
+	}
+	base, newBase := strings.TrimSuffix(name, ".csv"), strings.TrimSuffix(newName, ".csv")
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), base) {
+			continue
+		}
+		renamed := newBase + strings.TrimPrefix(f.Name(), base)
+		if err := os.Rename(filepath.Join(dir, f.Name()), filepath.Join(dir, renamed)); err != nil {
+			return name, err
+		}
+	}
+
+	m, err := LoadManifest(filepath.Join(dir, newName))
+	if err != nil {
+		return newName, err
+	}
+	m.File = newName
+	m.Generated = t
+	return newName, WriteManifest(dir, m)
+}
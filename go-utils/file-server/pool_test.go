@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseReportParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    ReportParams
+		wantErr bool
+	}{
+		{"", ReportParams{}, false},
+		{"rows=100&seed=-7&senders=3&domains=2", ReportParams{Rows: 100, Seed: -7, Senders: 3, Domains: 2}, false},
+		{"rows=0", ReportParams{}, true},
+		{"senders=x", ReportParams{}, true},
+		{"seed=1.5", ReportParams{}, true},
+		{"window=yesterday", ReportParams{Window: WindowYesterday}, false},
+		{"window=soon", ReportParams{}, true},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := ParseReportParams(query)
+		if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+			t.Errorf("ParseReportParams(%q) = %+v, %v", tt.query, got, err)
+		}
+	}
+}
+
+func TestReportPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := NewReportPool(PoolOptions{Size: 2, Workers: 2, Dir: filepath.Join(dir, "pool"), Retry: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	defer p.Stop()
+
+	for deadline := time.Now().Add(30 * time.Second); p.Len() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool filled with %d reports", p.Len())
+		}
+	}
+
+	out := filepath.Join(dir, "out")
+	os.Mkdir(out, os.ModePerm) // nolint:errcheck
+
+	// Taken reports are named and dated by the clock, even virtual.
+	defer func(c *Clock) { clock = c }(clock)
+	clock = &Clock{}
+	clock.Freeze()
+	clock.Set(time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	name, ok := p.Take(out, ReportParams{})
+	if !ok {
+		t.Fatal("no report taken from a full pool")
+	}
+	if name != "zix-usage-data-20190301120000.csv" {
+		t.Errorf("taken report named %s", name)
+	}
+	for _, file := range []string{name, name + SuffixManifest, name + SuffixSHA256} {
+		if _, err := os.Stat(filepath.Join(out, file)); err != nil {
+			t.Errorf("taken report misses %s: %v", file, err)
+		}
+	}
+	m, err := LoadManifest(filepath.Join(out, name))
+	if err != nil || m.File != name || !m.Generated.Equal(clock.Now()) {
+		t.Errorf("taken report manifest %+v, %v", m, err)
+	}
+	if sidecar, _ := ioutil.ReadFile(filepath.Join(out, name+SuffixSHA256)); string(sidecar) != m.SHA256+"  "+name+"\n" {
+		t.Errorf("taken report sha256 sidecar %q", sidecar)
+	}
+
+	if _, ok := p.Take(out, ReportParams{Rows: 10}); ok {
+		t.Error("report taken for a request with parameters")
+	}
+
+	// Drain the pool faster than it refills.
+	misses := 0
+	for i := 0; i < 10 && misses == 0; i++ {
+		if _, ok := p.Take(out, ReportParams{}); !ok {
+			misses++
+		}
+	}
+
+	stats := p.Stats()
+	if stats.Hits < 2 || stats.Misses != misses || stats.Bypassed != 1 {
+		t.Errorf("stats = %+v, %d misses", stats, misses)
+	}
+
+	var nilPool *ReportPool
+	if _, ok := nilPool.Take(out, ReportParams{}); ok {
+		t.Error("report taken from a disabled pool")
+	}
+}
+
+func TestGenerateReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name, err := generateReport(dir, ReportParams{Rows: 25, Seed: 9, Senders: 2, Domains: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, name+SuffixManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil || m.Rows != 25 || m.Seed != 9 {
+		t.Errorf("manifest = %+v, %v", m, err)
+	}
+}
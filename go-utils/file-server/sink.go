@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/metrics"
+	"github.com/fbatroni/fusemail/go-utils/smtpsink"
+)
+
+// SinkOptions configures the embedded SMTP sink.
+type SinkOptions struct {
+	Port        int      `long:"smtp-sink-port" env:"SMTP_SINK_PORT" description:"port of the embedded SMTP sink; disabled if zero"`
+	Hostname    string   `long:"smtp-sink-hostname" env:"SMTP_SINK_HOSTNAME" default:"localhost" description:"hostname announced by the SMTP sink"`
+	Dir         string   `long:"smtp-sink-dir" env:"SMTP_SINK_DIR" description:"directory to store captured messages in; kept in memory if empty"`
+	MaxSize     int64    `long:"smtp-sink-max-size" env:"SMTP_SINK_MAX_SIZE" default:"10485760" description:"maximum message size in bytes"`
+	TLSCert     string   `long:"smtp-sink-tls-cert" env:"SMTP_SINK_TLS_CERT" description:"certificate path to enable STARTTLS"`
+	TLSKey      string   `long:"smtp-sink-tls-key" env:"SMTP_SINK_TLS_KEY" description:"key path to enable STARTTLS"`
+	Users       []string `long:"smtp-sink-user" env:"SMTP_SINK_USERS" env-delim:"," description:"AUTH PLAIN credentials as user:password"`
+	RequireAuth bool     `long:"smtp-sink-require-auth" env:"SMTP_SINK_REQUIRE_AUTH" description:"reject MAIL before AUTH"`
+	Faults      []string `long:"smtp-sink-fault" env:"SMTP_SINK_FAULTS" env-delim:"," description:"SMTP faults as stage[:code][:every][:disconnect][:delay=duration]"`
+}
+
+// metrics vectors
+var (
+	sinkConnectionsTotal = metrics.NewMetric(&metrics.Vector{
+		Type: metrics.TypeCounter,
+		Name: "smtp_sink_connections_total",
+		Desc: "SMTP sink accepted connections",
+	})
+	sinkRepliesTotal = metrics.NewMetric(&metrics.Vector{
+		Type:   metrics.TypeCounter,
+		Name:   "smtp_sink_replies_total",
+		Desc:   "SMTP sink replies by command and reply code",
+		Labels: []string{"command", "code"},
+	})
+	sinkMessagesTotal = metrics.NewMetric(&metrics.Vector{
+		Type:   metrics.TypeCounter,
+		Name:   "smtp_sink_messages_total",
+		Desc:   "SMTP sink messages by result",
+		Labels: []string{"result"},
+	})
+	sinkMessageBytes = metrics.NewMetric(&metrics.Vector{
+		Type:    metrics.TypeHistogram,
+		Name:    "smtp_sink_message_bytes",
+		Desc:    "SMTP sink accepted message size in bytes",
+		Buckets: metrics.DefaultSizeBuckets,
+	})
+)
+
+// SinkVectors returns the SMTP sink metric vectors, to pass to metrics.Register.
+func SinkVectors() []*metrics.Vector {
+	return metrics.NewMetricVectors([]*metrics.Metric{
+		sinkConnectionsTotal,
+		sinkRepliesTotal,
+		sinkMessagesTotal,
+		sinkMessageBytes,
+	})
+}
+
+// sinkMetrics counts the sink events in the vectors.
+type sinkMetrics struct{}
+
+func (sinkMetrics) Connection() {
+	sinkConnectionsTotal.AddOne()
+}
+
+func (sinkMetrics) Reply(command, code string) {
+	sinkRepliesTotal.AddOne(command, code)
+}
+
+func (sinkMetrics) Message(result string) {
+	sinkMessagesTotal.AddOne(result)
+}
+
+func (sinkMetrics) MessageSize(bytes int) {
+	sinkMessageBytes.Add(float64(bytes))
+}
+
+// NewSink constructs the SMTP sink from options, or nil if disabled.
+func NewSink(opts SinkOptions) (*smtpsink.Server, error) {
+	if opts.Port == 0 {
+		return nil, nil
+	}
+
+	config := smtpsink.NewConfig()
+	config.Port = opts.Port
+	config.Hostname = opts.Hostname
+	config.MaxSize = opts.MaxSize
+	config.RequireAuth = opts.RequireAuth
+
+	if opts.Dir != "" {
+		store, err := smtpsink.NewDirStore(opts.Dir)
+		if err != nil {
+			return nil, err
+		}
+		config.Store = store
+	}
+
+	if opts.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if len(opts.Users) > 0 {
+		config.Users = make(map[string]string)
+		for _, u := range opts.Users {
+			parts := strings.SplitN(u, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid smtp sink user %q, expected user:password", u)
+			}
+			config.Users[parts[0]] = parts[1]
+		}
+	}
+
+	for _, s := range opts.Faults {
+		f, err := smtpsink.ParseFault(s)
+		if err != nil {
+			return nil, err
+		}
+		config.Faults = append(config.Faults, f)
+	}
+
+	smtpsink.SetMetrics(sinkMetrics{})
+	return smtpsink.New(config), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// TimestampOptions configures the sentTimestamp column of the reports and
+// event streams.
+type TimestampOptions struct {
+	Layout    string  `long:"timestamp-layout" env:"TIMESTAMP_LAYOUT" description:"Go time layout, or strftime pattern if it contains %, of the sent timestamps; %-d/%-m/%Y %-H:%-M if empty"`
+	Zone      string  `long:"timestamp-zone" env:"TIMESTAMP_ZONE" description:"IANA time zone of the sent timestamps, UTC if empty"`
+	UTCOffset bool    `long:"timestamp-utc-offset" env:"TIMESTAMP_UTC_OFFSET" description:"append the UTC offset to the sent timestamps, as +02:00"`
+	Mix       bool    `long:"timestamp-mix" env:"TIMESTAMP_MIX" description:"mix the timestamp layouts of known vendors across rows"`
+	DST       string  `long:"timestamp-dst" env:"TIMESTAMP_DST" description:"also send rows in the DST gap or overlap of the time zone, when the report window has one"`
+	DSTRate   float64 `long:"timestamp-dst-rate" env:"TIMESTAMP_DST_RATE" default:"0.05" description:"share of the rows sent in the DST gap or overlap"`
+}
+
+// Timestamps are the timestamp formats and DST mode of the generated rows,
+// see NewTimestamps.
+type Timestamps struct {
+	Formats []*usagegen.TimestampFormat
+	DST     string
+	DSTRate float64
+}
+
+// timestamps formats the generated rows, FormatDate unless set up otherwise.
+var timestamps = &Timestamps{}
+
+// NewTimestamps constructs Timestamps, validating the options. With a DST
+// mode, the zone must have such a transition in a year from October 2018.
+func NewTimestamps(opts TimestampOptions) (*Timestamps, error) {
+	formats, err := usagegen.ParseFormats(opts.Layout, opts.Zone, opts.UTCOffset, opts.Mix)
+	if err != nil {
+		return nil, err
+	}
+	t := &Timestamps{Formats: formats, DST: opts.DST, DSTRate: opts.DSTRate}
+	if err := usagegen.CheckDST(t.Apply(usagegen.Options{
+		Start: usagegen.WindowStart,
+		End:   usagegen.WindowStart.AddDate(1, 0, 0),
+	})); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Apply returns opts with the timestamp formats and DST mode.
+func (t *Timestamps) Apply(opts usagegen.Options) usagegen.Options {
+	opts.Formats = t.Formats
+	opts.DST = t.DST
+	opts.DSTRate = t.DSTRate
+	return opts
+}
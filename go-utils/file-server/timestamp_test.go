@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+func TestNewTimestamps(t *testing.T) {
+	tests := []struct {
+		opts    TimestampOptions
+		wantErr bool
+	}{
+		{TimestampOptions{}, false},
+		{TimestampOptions{Layout: "%F %T", Zone: "Europe/Paris", UTCOffset: true}, false},
+		{TimestampOptions{Mix: true, Zone: "America/New_York", DST: usagegen.DSTGap, DSTRate: 0.1}, false},
+		{TimestampOptions{Layout: "%Q"}, true},
+		{TimestampOptions{Zone: "Nowhere/Special"}, true},
+		{TimestampOptions{DST: usagegen.DSTOverlap, DSTRate: 0.1}, true},
+		{TimestampOptions{Zone: "Europe/Paris", DST: "fall", DSTRate: 0.1}, true},
+	}
+	for _, tt := range tests {
+		if _, err := NewTimestamps(tt.opts); (err != nil) != tt.wantErr {
+			t.Errorf("NewTimestamps(%+v) = %v", tt.opts, err)
+		}
+	}
+}
+
+func TestGenerateReport_Timestamps(t *testing.T) {
+	ts, err := NewTimestamps(TimestampOptions{Layout: "2006-01-02T15:04", Zone: "Europe/Paris", UTCOffset: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := timestamps
+	timestamps = ts
+	defer func() { timestamps = saved }()
+
+	dir, err := ioutil.TempDir("", "timestamps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name, err := generateReport(dir, ReportParams{Rows: 50, Seed: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// October 2018 in Paris is CEST until the 28th, then CET.
+	want := regexp.MustCompile(`^2018-(10|11)-\d\dT\d\d:\d\d \+0[12]:00$`)
+	for _, record := range records[1:] {
+		if !want.MatchString(record[2]) {
+			t.Fatalf("timestamp %q", record[2])
+		}
+	}
+}
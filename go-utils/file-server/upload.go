@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/metrics"
+	"bitbucket.org/fusemail/fm-lib-commons-golang/server"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// UploadOptions configures the /upload drop box, where suppression lists and
+// policy files are uploaded to be validated and kept for assertions.
+type UploadOptions struct {
+	Dir      string        `long:"upload-dir" env:"UPLOAD_DIR" default:"uploads" description:"folder of the stored uploads"`
+	MaxSize  int64         `long:"upload-max-size" env:"UPLOAD_MAX_SIZE" default:"10485760" description:"largest accepted file, in bytes; larger requests are answered 413 Request Entity Too Large"`
+	Schema   string        `long:"upload-schema" env:"UPLOAD_SCHEMA" default:"email:email,reason:text?" description:"columns of the uploaded CSV files as name:type, ? marking optional values; types are text, email, domain, int and date; per request with ?schema="`
+	NoHeader bool          `long:"upload-no-header" env:"UPLOAD_NO_HEADER" description:"uploaded files have no header row; per request with ?header=false"`
+	AckDelay time.Duration `long:"upload-ack-delay" env:"UPLOAD_ACK_DELAY" default:"0" description:"delay of the upload reports after the files are received, to exercise client timeouts; per request with ?ack_delay="`
+}
+
+// Column types of an upload schema.
+const (
+	ColumnText   = "text"
+	ColumnEmail  = "email"
+	ColumnDomain = "domain"
+	ColumnInt    = "int"
+	ColumnDate   = "date"
+)
+
+// Upload statuses, as counted in uploads_total.
+const (
+	UploadAccepted = "accepted"
+	UploadPartial  = "partial"
+	UploadRejected = "rejected"
+)
+
+const (
+	maxUploads      = 500
+	maxUploadErrors = 100
+
+	// Files per request, and room for the multipart headers of each.
+	maxUploadFiles    = 20
+	maxUploadOverhead = 4096
+)
+
+// errBodyTooLarge is the message of the http.MaxBytesReader error.
+const errBodyTooLarge = "http: request body too large"
+
+var domainPattern = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)+$`)
+
+// metrics vectors
+var (
+	uploadsTotal = metrics.NewMetric(&metrics.Vector{
+		Type:   metrics.TypeCounter,
+		Name:   "uploads_total",
+		Desc:   "Files uploaded to /upload by status",
+		Labels: []string{"status"},
+	})
+)
+
+// UploadVectors returns the upload metric vectors, to pass to metrics.Register.
+func UploadVectors() []*metrics.Vector {
+	return metrics.NewMetricVectors([]*metrics.Metric{
+		uploadsTotal,
+	})
+}
+
+// UploadColumn is a column of an upload schema.
+type UploadColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// ParseUploadSchema parses comma separated name:type columns, such as
+// "email:email,reason:text?"; the type is text if omitted.
+func ParseUploadSchema(spec string) ([]UploadColumn, error) {
+	var columns []UploadColumn
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		c := UploadColumn{Name: field, Type: ColumnText}
+		if i := strings.Index(field, ":"); i >= 0 {
+			c.Name, c.Type = field[:i], field[i+1:]
+		}
+		if strings.HasSuffix(c.Type, "?") {
+			c.Type, c.Optional = strings.TrimSuffix(c.Type, "?"), true
+		}
+		switch c.Type {
+		case ColumnText, ColumnEmail, ColumnDomain, ColumnInt, ColumnDate:
+		default:
+			return nil, fmt.Errorf("unknown type %q of column %s, want text, email, domain, int or date", c.Type, c.Name)
+		}
+		if c.Name == "" {
+			return nil, fmt.Errorf("column %q has no name", field)
+		}
+		columns = append(columns, c)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("upload schema %q has no column", spec)
+	}
+	return columns, nil
+}
+
+// check returns why value is not valid in column c, or "".
+func (c UploadColumn) check(value string) string {
+	if value == "" {
+		if c.Optional {
+			return ""
+		}
+		return "missing value"
+	}
+	switch c.Type {
+	case ColumnEmail:
+		if addr, err := mail.ParseAddress(value); err != nil || addr.Address != unquoteLocal(value) {
+			return "invalid email address"
+		}
+	case ColumnDomain:
+		if len(value) > 253 || !domainPattern.MatchString(value) {
+			return "invalid domain"
+		}
+	case ColumnInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return "not an integer"
+		}
+	case ColumnDate:
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				return "not a date, want YYYY-MM-DD or RFC 3339"
+			}
+		}
+	}
+	return ""
+}
+
+// unquoteLocal returns addr with a quoted local part unquoted, as
+// net/mail returns it.
+func unquoteLocal(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 || !strings.HasPrefix(addr, `"`) || addr[i-1] != '"' {
+		return addr
+	}
+	local := strings.Replace(addr[1:i-1], `\"`, `"`, -1)
+	return strings.Replace(local, `\\`, `\`, -1) + addr[i:]
+}
+
+// UploadReport is the accept/reject report of an uploaded file.
+type UploadReport struct {
+	ID       string    `json:"id"`
+	File     string    `json:"file"`
+	Received time.Time `json:"received"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Status   string    `json:"status"`
+	// Rows excludes the header.
+	Rows     int           `json:"rows"`
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Errors   []UploadError `json:"errors,omitempty"`
+}
+
+// UploadError is a rejected row or file; only the first errors are listed.
+type UploadError struct {
+	Line   int    `json:"line,omitempty"`
+	Column string `json:"column,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// uploadParams are the per-request options of an upload.
+type uploadParams struct {
+	schema   []UploadColumn
+	header   bool
+	ackDelay time.Duration
+}
+
+// Uploads stores uploaded files and their reports.
+type Uploads struct {
+	Options UploadOptions
+	schema  []UploadColumn
+
+	mu      sync.Mutex
+	reports []UploadReport
+}
+
+// uploads is the drop box served at /upload.
+var uploads *Uploads
+
+// NewUploads constructs Uploads, validating the schema and creating the
+// folder of the stored uploads.
+func NewUploads(opts UploadOptions) (*Uploads, error) {
+	schema, err := ParseUploadSchema(opts.Schema)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxSize <= 0 {
+		return nil, fmt.Errorf("upload max size must be positive, got %d", opts.MaxSize)
+	}
+	if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Uploads{Options: opts, schema: schema}, nil
+}
+
+// parseParams reads the schema, header and ack_delay query parameters.
+func (u *Uploads) parseParams(query url.Values) (uploadParams, error) {
+	p := uploadParams{schema: u.schema, header: !u.Options.NoHeader, ackDelay: u.Options.AckDelay}
+	if v := query.Get("schema"); v != "" {
+		schema, err := ParseUploadSchema(v)
+		if err != nil {
+			return p, err
+		}
+		p.schema = schema
+	}
+	if v := query.Get("header"); v != "" {
+		header, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("header must be a boolean, got %q", v)
+		}
+		p.header = header
+	}
+	if v := query.Get("ack_delay"); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil || delay < 0 {
+			return p, fmt.Errorf("ack_delay must be a non-negative duration, got %q", v)
+		}
+		p.ackDelay = delay
+	}
+	return p, nil
+}
+
+// requireSession answers 401 Unauthorized, and reports false, if r does not
+// carry the session cookie.
+func requireSession(w http.ResponseWriter, r *http.Request) bool {
+	if HasSession(r) {
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	io.WriteString(w, "Session cookie required, log in at /login")
+	return false
+}
+
+// HandleUpload stores and validates the files of a multipart PUT or POST,
+// answering with their reports: 200 OK unless every file is rejected, 422
+// Unprocessable Entity then. Requests must carry the session cookie.
+func (u *Uploads) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+	params, err := u.parseParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadFiles*(u.Options.MaxSize+maxUploadOverhead))
+	mr, err := r.MultipartReader()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	// Every file is read and checked before any is stored, so that a
+	// rejected request stores nothing.
+	var names []string
+	var contents [][]byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uploadReadError(w, err)
+			return
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		if len(names) == maxUploadFiles {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "More than %d files uploaded", maxUploadFiles)
+			return
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, io.LimitReader(part, u.Options.MaxSize+1)); err != nil {
+			uploadReadError(w, err)
+			return
+		}
+		if int64(buf.Len()) > u.Options.MaxSize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "%s is larger than %d bytes", part.FileName(), u.Options.MaxSize)
+			return
+		}
+		names = append(names, filepath.Base(part.FileName()))
+		contents = append(contents, buf.Bytes())
+	}
+	if len(names) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "No file uploaded")
+		return
+	}
+
+	var files []UploadReport
+	for i, name := range names {
+		report, err := u.store(name, contents[i], params)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, err.Error())
+			return
+		}
+		files = append(files, report)
+	}
+
+	// Slow acknowledgements, as from vendors validating synchronously.
+	if params.ackDelay > 0 {
+		select {
+		case <-time.After(params.ackDelay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	status := http.StatusUnprocessableEntity
+	for _, f := range files {
+		if f.Status != UploadRejected {
+			status = http.StatusOK
+		}
+	}
+	server.WriteJSONWithStatus(w, files, status)
+}
+
+// uploadReadError answers a failed read of an upload: 413 Request Entity Too
+// Large past the limit of the request body, 400 Bad Request otherwise.
+func uploadReadError(w http.ResponseWriter, err error) {
+	if strings.Contains(err.Error(), errBodyTooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	io.WriteString(w, err.Error())
+}
+
+// store validates and stores an uploaded file, and records its report.
+func (u *Uploads) store(name string, b []byte, params uploadParams) (UploadReport, error) {
+	id, _ := uuid.NewV4()
+	sum := sha256.Sum256(b)
+	report := ValidateUpload(b, params.schema, params.header)
+	report.ID = id.String()
+	report.File = name
+	report.Received = clock.Now()
+	report.Size = int64(len(b))
+	report.SHA256 = hex.EncodeToString(sum[:])
+
+	if err := ioutil.WriteFile(filepath.Join(u.Options.Dir, report.ID), b, 0644); err != nil {
+		return report, err
+	}
+	uploadsTotal.AddOne(report.Status)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.reports = append(u.reports, report)
+	if len(u.reports) > maxUploads {
+		os.Remove(filepath.Join(u.Options.Dir, u.reports[0].ID)) // nolint:errcheck
+		u.reports = u.reports[1:]
+	}
+	return report, nil
+}
+
+// ValidateUpload returns the report of the CSV file b against the columns
+// of schema, after a header row naming them if header is set. Rows are
+// rejected one by one; the file is rejected if the header or the CSV is
+// invalid, or if every row is rejected.
+func ValidateUpload(b []byte, schema []UploadColumn, header bool) UploadReport {
+	var report UploadReport
+	reject := func(e UploadError) {
+		if len(report.Errors) < maxUploadErrors {
+			report.Errors = append(report.Errors, e)
+		}
+	}
+
+	// The zero dialect drops a UTF-8 byte order mark.
+	r := (usagegen.Dialect{}).NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if pe, ok := err.(*csv.ParseError); ok {
+				line = pe.Line
+			}
+			reject(UploadError{Line: line, Reason: err.Error()})
+			report.Status = UploadRejected
+			return report
+		}
+
+		if header && line == 1 {
+			names := make([]string, len(schema))
+			for i, c := range schema {
+				names[i] = c.Name
+			}
+			got := make([]string, len(record))
+			for i, name := range record {
+				got[i] = strings.ToLower(strings.TrimSpace(name))
+			}
+			if strings.Join(got, ",") != strings.ToLower(strings.Join(names, ",")) {
+				reject(UploadError{Line: 1, Value: strings.Join(record, ","), Reason: "header must be " + strings.Join(names, ",")})
+				report.Status = UploadRejected
+				return report
+			}
+			continue
+		}
+
+		report.Rows++
+		if len(record) != len(schema) {
+			report.Rejected++
+			reject(UploadError{Line: line, Reason: fmt.Sprintf("%d fields, want %d", len(record), len(schema))})
+			continue
+		}
+		rejected := false
+		for i, c := range schema {
+			if reason := c.check(record[i]); reason != "" {
+				rejected = true
+				reject(UploadError{Line: line, Column: c.Name, Value: record[i], Reason: reason})
+			}
+		}
+		if rejected {
+			report.Rejected++
+		} else {
+			report.Accepted++
+		}
+	}
+
+	switch {
+	case report.Accepted == 0:
+		if report.Rows == 0 {
+			reject(UploadError{Reason: "no rows"})
+		}
+		report.Status = UploadRejected
+	case report.Rejected > 0:
+		report.Status = UploadPartial
+	default:
+		report.Status = UploadAccepted
+	}
+	return report
+}
+
+// Reports returns the reports of the stored uploads, oldest first.
+func (u *Uploads) Reports() []UploadReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]UploadReport(nil), u.reports...)
+}
+
+// HandleUploads lists the reports of the stored uploads, and forgets them
+// on DELETE. Filter with ?file=<name> or ?status=<status>.
+func (u *Uploads) HandleUploads(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		u.mu.Lock()
+		for _, report := range u.reports {
+			os.Remove(filepath.Join(u.Options.Dir, report.ID)) // nolint:errcheck
+		}
+		u.reports = nil
+		u.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	file := r.URL.Query().Get("file")
+	status := r.URL.Query().Get("status")
+	list := []UploadReport{}
+	for _, report := range u.Reports() {
+		if (file != "" && report.File != file) || (status != "" && report.Status != status) {
+			continue
+		}
+		list = append(list, report)
+	}
+	server.WriteJSON(w, list)
+}
+
+// HandleUploadFile serves a stored upload by id, under its uploaded name.
+func (u *Uploads) HandleUploadFile(w http.ResponseWriter, r *http.Request) {
+	if !requireSession(w, r) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	var report *UploadReport
+	for _, rep := range u.Reports() {
+		if rep.ID == id {
+			report = &rep
+			break
+		}
+	}
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "Upload not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": report.File}))
+	http.ServeFile(w, r, filepath.Join(u.Options.Dir, report.ID))
+}
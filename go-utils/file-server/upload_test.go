@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidateUpload(t *testing.T) {
+	schema, err := ParseUploadSchema("email:email,domain:domain?,count:int?,added:date?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		content  string
+		header   bool
+		status   string
+		accepted int
+		rejected int
+	}{
+		{"accepted", "\ufeffEmail,domain,count,added\na@b.com,b.com,1,2018-10-04\n\"\"\"x y\"\"@b.com\",,,\n", true, UploadAccepted, 2, 0},
+		{"partial", "email,domain,count,added\na@b.com,-b.com,one,04/10/2018\nnot an address,,,\na@b.com\n,b.com,,\nc@d.org,,,\n", true, UploadPartial, 1, 4},
+		{"no header", "a@b.com,b.com,1,2018-10-04T07:06:05Z\n", false, UploadAccepted, 1, 0},
+		{"wrong header", "address,domain,count,added\na@b.com,,,\n", true, UploadRejected, 0, 0},
+		{"invalid CSV", "email,domain,count,added\n\"a@b.com,,,\n", true, UploadRejected, 0, 0},
+		{"empty", "email,domain,count,added\n", true, UploadRejected, 0, 0},
+	}
+	for _, tt := range tests {
+		report := ValidateUpload([]byte(tt.content), schema, tt.header)
+		if report.Status != tt.status || report.Accepted != tt.accepted || report.Rejected != tt.rejected {
+			t.Errorf("%s: %s, %d accepted, %d rejected: %+v", tt.name, report.Status, report.Accepted, report.Rejected, report.Errors)
+		}
+		if tt.status != UploadAccepted && len(report.Errors) == 0 {
+			t.Errorf("%s: no errors", tt.name)
+		}
+	}
+
+	for _, spec := range []string{"", "email:mailbox", ":int"} {
+		if _, err := ParseUploadSchema(spec); err == nil {
+			t.Errorf("schema %q accepted", spec)
+		}
+	}
+}
+
+func TestUploads_HandleUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, err := NewUploads(UploadOptions{Dir: dir, MaxSize: 64, Schema: "email:email,reason:text?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/upload", u.HandleUpload).Methods(http.MethodPut, http.MethodPost)
+	router.HandleFunc("/upload", u.HandleUploads).Methods(http.MethodGet, http.MethodDelete)
+	router.HandleFunc("/upload/{id}", u.HandleUploadFile).Methods(http.MethodGet)
+
+	login := httptest.NewRecorder()
+	SetSessionCookie(login)
+	cookie := login.Result().Cookies()[0]
+	do := func(method, target string, files map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, content := range files {
+			fw, _ := mw.CreateFormFile("file", name)
+			fw.Write([]byte(content)) // nolint:errcheck
+		}
+		mw.Close()
+		r := httptest.NewRequest(method, target, &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	suppressions := "email,reason\na@b.com,bounced\nnope,\n"
+	start := time.Now()
+	w := do(http.MethodPost, "/upload?ack_delay=50ms", map[string]string{"suppressions.csv": suppressions})
+	if w.Code != http.StatusOK || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("status %d after %v: %s", w.Code, time.Since(start), w.Body)
+	}
+	var reports []UploadReport
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Status != UploadPartial || reports[0].File != "suppressions.csv" || len(reports[0].Errors) != 1 || reports[0].Errors[0].Line != 3 {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+
+	if w := do(http.MethodPut, "/upload", map[string]string{"policies.csv": "policy,action\n"}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("rejected file: status %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/upload", map[string]string{"large.csv": string(bytes.Repeat([]byte("a"), 65))}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large file: status %d", w.Code)
+	}
+	// A large file stores none of the files of its request.
+	before := len(u.Reports())
+	if w := do(http.MethodPut, "/upload", map[string]string{"small.csv": suppressions, "large.csv": string(bytes.Repeat([]byte("a"), 65))}); w.Code != http.StatusRequestEntityTooLarge || len(u.Reports()) != before {
+		t.Errorf("large file with a small one: status %d, %d reports, want %d", w.Code, len(u.Reports()), before)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("padding", string(bytes.Repeat([]byte("a"), maxUploadFiles*(64+maxUploadOverhead)))) // nolint:errcheck
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPut, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), errBodyTooLarge) {
+		t.Errorf("large request: status %d, %q", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/upload?schema=email:mailbox", map[string]string{"a.csv": suppressions}); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid schema: status %d", w.Code)
+	}
+
+	// Stored uploads are listed and served back as uploaded.
+	w = do(http.MethodGet, "/upload?status="+UploadPartial, nil)
+	var listed []UploadReport
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 1 || listed[0].ID != reports[0].ID {
+		t.Fatalf("listed %+v, %v", listed, err)
+	}
+	if w := do(http.MethodGet, "/upload/"+reports[0].ID, nil); w.Code != http.StatusOK || w.Body.String() != suppressions {
+		t.Errorf("stored upload: status %d, %q", w.Code, w.Body)
+	}
+	if w := do(http.MethodDelete, "/upload", nil); w.Code != http.StatusNoContent || len(u.Reports()) != 0 {
+		t.Errorf("delete: status %d, %d reports left", w.Code, len(u.Reports()))
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/upload", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without session: status %d", w.Code)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/client"
+	"bitbucket.org/fusemail/fm-lib-commons-golang/server"
+	"bitbucket.org/fusemail/fm-lib-commons-golang/sys"
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhook delivery modes.
+const (
+	WebhookModeNotify = "notify"
+	WebhookModeFile   = "file"
+)
+
+// Webhook delivery headers.
+const (
+	HeaderSignature = "X-Webhook-Signature"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderAttempt   = "X-Webhook-Attempt"
+	HeaderEvent     = "X-Webhook-Event"
+)
+
+// Delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	webhookEvent    = "report.ready"
+	maxDeliveryLogs = 500
+)
+
+// WebhookOptions configures push delivery of generated reports.
+type WebhookOptions struct {
+	URLs        []string         `long:"webhook-url" env:"WEBHOOK_URLS" env-delim:"," description:"callback URLs that receive every generated report"`
+	Secret      sys.MaskedString `long:"webhook-secret" env:"WEBHOOK_SECRET" description:"shared secret used to sign deliveries with HMAC-SHA256"`
+	Mode        string           `long:"webhook-mode" env:"WEBHOOK_MODE" default:"notify" choice:"notify" choice:"file" description:"push the report file itself or a report ready notification with a download link"`
+	BaseURL     string           `long:"webhook-base-url" env:"WEBHOOK_BASE_URL" default:"http://localhost:9091" description:"base URL used to build download links"`
+	MaxAttempts int              `long:"webhook-max-attempts" env:"WEBHOOK_MAX_ATTEMPTS" default:"5" description:"maximum delivery attempts per callback"`
+	Backoff     time.Duration    `long:"webhook-backoff" env:"WEBHOOK_BACKOFF" default:"1s" description:"delay before the first retry, doubled on every further attempt"`
+}
+
+// Attempt holds the outcome of a single delivery attempt.
+type Attempt struct {
+	Number   int       `json:"number"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Delivery tracks every attempt to push one report to one callback URL.
+type Delivery struct {
+	ID        string     `json:"id"`
+	URL       string     `json:"url"`
+	Report    string     `json:"report"`
+	File      string     `json:"file"`
+	Mode      string     `json:"mode"`
+	Timestamp int64      `json:"timestamp"`
+	State     string     `json:"state"`
+	Attempts  []*Attempt `json:"attempts"`
+}
+
+func (d *Delivery) String() string {
+	return fmt.Sprintf("{%T: %v %v -> %v (%v)}", d, d.ID, d.File, d.URL, d.State)
+}
+
+// Notification is the payload pushed in notify mode.
+type Notification struct {
+	Event      string `json:"event"`
+	DeliveryID string `json:"delivery_id"`
+	File       string `json:"file"`
+	URL        string `json:"url"`
+	Size       int64  `json:"size"`
+}
+
+// Webhook pushes generated reports to the configured callback URLs.
+type Webhook struct {
+	Options WebhookOptions
+	Client  *client.Client
+
+	mu         sync.Mutex
+	deliveries []*Delivery
+	wg         sync.WaitGroup
+}
+
+// NewWebhook constructs a Webhook with the default web client.
+func NewWebhook(opts WebhookOptions) *Webhook {
+	return &Webhook{
+		Options: opts,
+		Client:  client.NewClient(),
+	}
+}
+
+// Enabled reports whether any callback URL is configured.
+func (wh *Webhook) Enabled() bool {
+	return wh != nil && len(wh.Options.URLs) > 0
+}
+
+// Sign returns the signature header value for the given timestamp and body.
+// The signed content is "<timestamp>.<body>", so a replayed body with a new
+// timestamp does not verify.
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10))) // nolint:errcheck
+	mac.Write([]byte("."))                              // nolint:errcheck
+	mac.Write(body)                                     // nolint:errcheck
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify queues one delivery per callback URL for the given report, and
+// delivers them in the background.
+func (wh *Webhook) Notify(report Report) {
+	if !wh.Enabled() {
+		return
+	}
+
+	for _, url := range wh.Options.URLs {
+		token, _ := uuid.NewV4()
+		d := &Delivery{
+			ID:     token.String(),
+			URL:    url,
+			Report: report.ID,
+			File:   report.Name,
+			Mode:   wh.Options.Mode,
+			State:  DeliveryPending,
+
+			// Timestamp and signature are fixed per delivery, so receivers
+			// can dedupe retries on the delivery id.
+			Timestamp: time.Now().Unix(),
+		}
+
+		body, headers, err := wh.payload(d)
+		if err != nil {
+			log.WithFields(log.Fields{"delivery": d, "err": err}).Error("cannot build webhook payload")
+			d.State = DeliveryFailed
+			d.Attempts = append(d.Attempts, &Attempt{Started: time.Now(), Error: err.Error()})
+			wh.record(d)
+			continue
+		}
+
+		wh.record(d)
+		wh.wg.Add(1)
+		go func(d *Delivery) {
+			defer wh.wg.Done()
+			wh.deliver(d, body, headers)
+		}(d)
+	}
+}
+
+// Wait blocks until all queued deliveries are done.
+func (wh *Webhook) Wait() {
+	wh.wg.Wait()
+}
+
+// payload builds the request body for the delivery mode, and its content
+// headers. Pushed files are sealed when encryption is enabled.
+func (wh *Webhook) payload(d *Delivery) ([]byte, map[string]string, error) {
+	report := Report{ID: d.Report, Name: d.File}
+	path := report.Path()
+
+	if d.Mode == WebhookModeFile {
+		body, err := ioutil.ReadFile(path)
+		if err != nil || !encryptor.Enabled() {
+			return body, map[string]string{"Content-Type": "text/csv"}, err
+		}
+		body, err = encryptor.Seal(body, encryptor.Options.WrongKey)
+		return body, map[string]string{
+			"Content-Type":   "application/octet-stream",
+			HeaderEncryption: encryptor.Algorithm(),
+			HeaderKeyID:      encryptor.Options.KeyID,
+		}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The link serves the report sealed when encryption is enabled.
+	size := info.Size()
+	if encryptor.Enabled() {
+		size += sealOverhead
+	}
+	body, err := json.Marshal(&Notification{
+		Event:      webhookEvent,
+		DeliveryID: d.ID,
+		File:       d.File,
+		URL:        report.URL(wh.Options.BaseURL, d.File),
+		Size:       size,
+	})
+	return body, map[string]string{"Content-Type": "application/json"}, err
+}
+
+// deliver posts the payload with its content headers until it is accepted or
+// attempts run out, backing off exponentially between attempts.
+func (wh *Webhook) deliver(d *Delivery, body []byte, headers map[string]string) {
+	logger := log.WithFields(log.Fields{"id": d.ID, "url": d.URL, "file": d.File})
+
+	maxAttempts := wh.Options.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	backoff := wh.Options.Backoff
+	signature := Sign([]byte(wh.Options.Secret), d.Timestamp, body)
+
+	for n := 1; n <= maxAttempts; n++ {
+		a := &Attempt{Number: n, Started: time.Now()}
+
+		h := map[string]string{
+			HeaderSignature: signature,
+			HeaderDelivery:  d.ID,
+			HeaderTimestamp: strconv.FormatInt(d.Timestamp, 10),
+			HeaderAttempt:   strconv.Itoa(n),
+			HeaderEvent:     webhookEvent,
+		}
+		for k, v := range headers {
+			h[k] = v
+		}
+		resp, err := wh.Client.Do(http.MethodPost, d.URL, bytes.NewReader(body), h)
+		a.Duration = time.Since(a.Started).String()
+
+		if err != nil {
+			a.Error = err.Error()
+		} else {
+			a.Status = resp.StatusCode
+			io.Copy(ioutil.Discard, resp.Body) // nolint:errcheck
+			resp.Body.Close()                  // nolint:errcheck
+		}
+
+		wh.mu.Lock()
+		d.Attempts = append(d.Attempts, a)
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			d.State = DeliveryDelivered
+			wh.mu.Unlock()
+			logger.Info("webhook delivered")
+			return
+		}
+		wh.mu.Unlock()
+
+		logger.WithField("attempt", a).Warn("webhook delivery attempt failed")
+
+		if n < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	wh.mu.Lock()
+	d.State = DeliveryFailed
+	wh.mu.Unlock()
+	logger.Error("webhook delivery failed")
+}
+
+// record appends d to the delivery log, dropping the oldest entries.
+func (wh *Webhook) record(d *Delivery) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	wh.deliveries = append(wh.deliveries, d)
+	if len(wh.deliveries) > maxDeliveryLogs {
+		wh.deliveries = wh.deliveries[len(wh.deliveries)-maxDeliveryLogs:]
+	}
+}
+
+// Deliveries returns the delivery log, newest last.
+func (wh *Webhook) Deliveries() []Delivery {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	list := make([]Delivery, 0, len(wh.deliveries))
+	for _, d := range wh.deliveries {
+		c := *d
+		c.Attempts = make([]*Attempt, len(d.Attempts))
+		copy(c.Attempts, d.Attempts)
+		list = append(list, c)
+	}
+	return list
+}
+
+// HandleDeliveries lists webhook deliveries and their attempts.
+// Filter with ?id=<delivery id> or ?file=<report name>.
+func (wh *Webhook) HandleDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	file := r.URL.Query().Get("file")
+
+	list := []Delivery{}
+	for _, d := range wh.Deliveries() {
+		if (id != "" && d.ID != id) || (file != "" && d.File != file) {
+			continue
+		}
+		list = append(list, d)
+	}
+
+	server.WriteJSON(w, list)
+}
+
+// HandleFile serves a file of a previously generated report by report ID and
+// name, encrypted if enabled.
+func HandleFile(w http.ResponseWriter, r *http.Request) { //nolint
+
+	vars := mux.Vars(r)
+	name := filepath.Base(vars["name"])
+	path := filepath.Join(folder, filepath.Base(vars["id"]), name)
+
+	if _, err := uuid.FromString(vars["id"]); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "Report not found")
+		return
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "Report not found")
+		return
+	}
+	if exporter.ServeFault(w, r, filepath.Dir(path), name) {
+		return
+	}
+	if encryptor.Enabled() {
+		encryptor.ServeEncrypted(w, r, path)
+		return
+	}
+
+	SetIntegrityHeaders(w, r, path)
+	http.ServeFile(w, r, path)
+}
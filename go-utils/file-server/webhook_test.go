@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook_Notify(t *testing.T) {
+	report := Report{ID: "1b4e28ba-2fa1-11d2-883f-0016d3cca427", Name: "webhook-test.csv"}
+
+	tests := []struct {
+		name      string
+		mode      string
+		failures  int
+		attempts  int
+		wantState string
+	}{
+		{"notify mode is delivered on first attempt", WebhookModeNotify, 0, 3, DeliveryDelivered},
+		{"file mode is retried until accepted", WebhookModeFile, 2, 3, DeliveryDelivered},
+		{"delivery fails once attempts run out", WebhookModeNotify, 5, 3, DeliveryFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.MkdirAll(report.Dir(), os.ModePerm)                      // nolint:errcheck
+			ioutil.WriteFile(report.Path(), []byte("a,b\n1,2\n"), 0644) // nolint:errcheck
+			defer os.RemoveAll(report.Dir())                            // nolint:errcheck
+
+			var (
+				mu       sync.Mutex
+				requests []*http.Request
+				bodies   [][]byte
+			)
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				defer mu.Unlock()
+				requests = append(requests, r)
+				bodies = append(bodies, body)
+				if len(requests) <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer receiver.Close()
+
+			wh := NewWebhook(WebhookOptions{
+				URLs:        []string{receiver.URL},
+				Secret:      "secret",
+				Mode:        tt.mode,
+				BaseURL:     "http://localhost:9091",
+				MaxAttempts: tt.attempts,
+				Backoff:     time.Millisecond,
+			})
+			wh.Notify(report)
+			wh.Wait()
+
+			deliveries := wh.Deliveries()
+			if len(deliveries) != 1 {
+				t.Fatalf("got %d deliveries, want 1", len(deliveries))
+			}
+			d := deliveries[0]
+			if d.State != tt.wantState {
+				t.Errorf("state = %q, want %q", d.State, tt.wantState)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(d.Attempts) != len(requests) {
+				t.Errorf("logged %d attempts, receiver saw %d", len(d.Attempts), len(requests))
+			}
+
+			for i, r := range requests {
+				if got := r.Header.Get(HeaderDelivery); got != d.ID {
+					t.Errorf("attempt %d: delivery id = %q, want %q", i+1, got, d.ID)
+				}
+				if got := r.Header.Get(HeaderAttempt); got != strconv.Itoa(i+1) {
+					t.Errorf("attempt %d: attempt header = %q", i+1, got)
+				}
+				ts, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+				if err != nil {
+					t.Fatalf("attempt %d: bad timestamp: %v", i+1, err)
+				}
+				if got, want := r.Header.Get(HeaderSignature), Sign([]byte("secret"), ts, bodies[i]); got != want {
+					t.Errorf("attempt %d: signature = %q, want %q", i+1, got, want)
+				}
+			}
+
+			if tt.mode == WebhookModeNotify {
+				var n Notification
+				if err := json.Unmarshal(bodies[0], &n); err != nil {
+					t.Fatal(err)
+				}
+				if n.DeliveryID != d.ID || n.URL != "http://localhost:9091/files/"+report.ID+"/"+report.Name {
+					t.Errorf("unexpected notification %+v", n)
+				}
+			} else if string(bodies[0]) != "a,b\n1,2\n" {
+				t.Errorf("unexpected file body %q", bodies[0])
+			}
+		})
+	}
+}
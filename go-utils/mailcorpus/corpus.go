@@ -0,0 +1,204 @@
+// Package mailcorpus generates the RFC 5322 messages of usage rows, packed as
+// zip or mbox with an index CSV, and the Exim message ids they are sent with,
+// as written by file-creator and file-server.
+//
+//	ids := mailcorpus.NewMessageIDs(seed)
+//	c, err := mailcorpus.NewWriter("usage.csv", mailcorpus.Zip, "zix.example")
+//	...
+//	sent, msgID := ids.Next(row.Date)
+//	err = c.Write(row.Number, sent, msgID, row.Record)
+//	...
+//	err = c.Close()
+package mailcorpus
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/utils"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// Corpus formats.
+const (
+	Zip  = "zip"
+	Mbox = "mbox"
+)
+
+var indexHeader = []string{"row", "messageId", "recipientUuid", "file", "senderAddress", "recipientAddress", "sentTimestamp", "subject"}
+
+// ArchiveName returns the corpus archive name for a report and format.
+func ArchiveName(fileName, format string) string {
+	base := strings.TrimSuffix(fileName, ".csv")
+	if format == Zip {
+		return base + ".eml.zip"
+	}
+	return base + ".mbox"
+}
+
+// IndexName returns the name of the CSV joining report rows to corpus messages.
+func IndexName(fileName string) string {
+	return strings.TrimSuffix(fileName, ".csv") + ".messages.csv"
+}
+
+// Writer writes one message per usage row into a zip or mbox archive,
+// plus an index CSV pairing each row with its Message-ID and recipient UUID.
+type Writer struct {
+	Format   string
+	Domain   string
+	Messages int
+
+	file      *os.File
+	zip       *zip.Writer
+	mbox      *bufio.Writer
+	indexFile *os.File
+	index     *csv.Writer
+}
+
+// NewWriter creates the archive and index files for the report at path.
+func NewWriter(path, format, domain string) (*Writer, error) {
+	if format != Zip && format != Mbox {
+		return nil, fmt.Errorf("unknown corpus format %q", format)
+	}
+
+	file, err := os.Create(ArchiveName(path, format))
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.Create(IndexName(path))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	c := &Writer{
+		Format:    format,
+		Domain:    domain,
+		file:      file,
+		indexFile: indexFile,
+		index:     csv.NewWriter(indexFile),
+	}
+	if format == Zip {
+		c.zip = zip.NewWriter(file)
+	} else {
+		c.mbox = bufio.NewWriter(file)
+	}
+
+	if err := c.index.Write(indexHeader); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Write adds the message with msgID for a usage row sent at date.
+func (c *Writer) Write(row int, date time.Time, msgID string, record usagegen.Record) error {
+	recipientUUID := utils.MsgRecipientUUID(msgID, record[1])
+	name := msgID + ".eml"
+
+	msg := BuildMessage(c.Domain, row, date, msgID, record)
+	var err error
+	if c.zip != nil {
+		err = c.writeZip(name, date, msg)
+	} else {
+		err = c.writeMbox(record[0], date, msg)
+	}
+	if err != nil {
+		return err
+	}
+	c.Messages++
+
+	return c.index.Write([]string{strconv.Itoa(row), msgID, recipientUUID, name, record[0], record[1], record[2], record[3]})
+}
+
+// BuildMessage returns the RFC 5322 message for a usage row, as received by mx.domain.
+func BuildMessage(domain string, row int, date time.Time, msgID string, record usagegen.Record) []byte {
+	var b bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+
+	sender, recipient := record[0], record[1]
+	recipientUUID := utils.MsgRecipientUUID(msgID, recipient)
+	header("Return-Path", "<"+sender+">")
+	header("Received", fmt.Sprintf("from %s by mx.%s with ESMTP id %s for <%s>; %s",
+		sender[strings.LastIndex(sender, "@")+1:], domain, msgID, recipient, date.Format(time.RFC1123Z)))
+	header("Message-ID", "<"+msgID+"@"+domain+">")
+	header("Date", date.Format(time.RFC1123Z))
+	header("From", sender)
+	header("To", recipient)
+	header("Subject", record[3])
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "7bit")
+	header("X-Policy-Types", record[4])
+	header("X-Policy-Names", record[5])
+	header("X-Delivery-Method", record[6])
+	header("X-Recipient-UUID", recipientUUID)
+	header("X-Usage-Row", strconv.Itoa(row))
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "%s,\r\n\r\nThis message was generated for usage row %d.\r\n", record[3], row)
+	fmt.Fprintf(&b, "Policies applied: %s (%s).\r\n", record[5], record[4])
+
+	return b.Bytes()
+}
+
+func (c *Writer) writeZip(name string, date time.Time, msg []byte) error {
+	fh := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	fh.SetModTime(date)
+	w, err := c.zip.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// writeMbox appends msg in mboxrd format: LF line endings and ">" quoted From lines.
+func (c *Writer) writeMbox(sender string, date time.Time, msg []byte) error {
+	if _, err := fmt.Fprintf(c.mbox, "From %s %s\n", sender, date.Format(time.ANSIC)); err != nil {
+		return err
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(msg, []byte("\r\n")), []byte("\r\n"))
+	for _, line := range lines {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			c.mbox.WriteByte('>') // nolint:errcheck
+		}
+		c.mbox.Write(line)     // nolint:errcheck
+		c.mbox.WriteByte('\n') // nolint:errcheck
+	}
+	return c.mbox.WriteByte('\n')
+}
+
+// Close flushes and closes the archive and index.
+func (c *Writer) Close() error {
+	var first error
+	keep := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+
+	if c.zip != nil {
+		keep(c.zip.Close())
+	}
+	if c.mbox != nil {
+		keep(c.mbox.Flush())
+	}
+	keep(c.file.Close())
+
+	c.index.Flush()
+	keep(c.index.Error())
+	keep(c.indexFile.Close())
+
+	return first
+}
@@ -0,0 +1,148 @@
+package mailcorpus
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/utils"
+	"github.com/fbatroni/fusemail/go-utils/usagegen"
+)
+
+// eximPattern matches Exim message ids.
+var eximPattern = regexp.MustCompile(`^[0-9A-Za-z]{6}-[0-9A-Za-z]{6}-[0-9A-Za-z]{2}$`)
+
+func TestMessageIDs_ID(t *testing.T) {
+	// More messages in one second than an Exim id has fractions of it.
+	date := time.Date(2018, time.October, 5, 9, 30, 12, 0, time.UTC)
+	ids := NewMessageIDs(42)
+	seen := make(map[string]bool)
+	for i := 0; i < 3*fractions; i++ {
+		id := ids.ID(date)
+		if !eximPattern.MatchString(id) || seen[id] || !strings.HasPrefix(id, "1g8MR2-") {
+			t.Fatalf("id %d: invalid or duplicate message id %q", i, id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestWriter(t *testing.T) {
+	date := time.Date(2018, time.October, 5, 9, 30, 0, 0, time.UTC)
+	record := usagegen.NewRecord(1, 2, usagegen.FormatDate(date))
+	rows := 3
+
+	tests := []struct {
+		name   string
+		format string
+	}{
+		{"zip archive", Zip},
+		{"mbox", Mbox},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "corpus")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "usage.csv")
+
+			c, err := NewWriter(path, tt.format, "zix.example")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Identical rows must still get distinct message ids.
+			ids := NewMessageIDs(42)
+			for i := 1; i <= rows; i++ {
+				sent, msgID := ids.Next(date)
+				if err := c.Write(i, sent, msgID, record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			messages := readCorpus(t, ArchiveName(path, tt.format), tt.format)
+			if len(messages) != rows {
+				t.Fatalf("corpus has %d messages, want %d", len(messages), rows)
+			}
+
+			f, _ := os.Open(IndexName(path))
+			defer f.Close()
+			index, err := csv.NewReader(f).ReadAll()
+			if err != nil || len(index) != rows+1 {
+				t.Fatalf("index: %v, %d lines", err, len(index))
+			}
+
+			seen := make(map[string]bool)
+			for i, m := range messages {
+				row := index[i+1]
+				id := row[1]
+				if !eximPattern.MatchString(id) || seen[id] {
+					t.Errorf("row %d: invalid or duplicate message id %q", i+1, id)
+				}
+				seen[id] = true
+
+				if got := m.Header.Get("Message-ID"); got != "<"+id+"@zix.example>" {
+					t.Errorf("row %d: Message-ID = %q, index id %q", i+1, got, id)
+				}
+				if want := utils.MsgRecipientUUID(id, record[1]); row[2] != want || m.Header.Get("X-Recipient-UUID") != want {
+					t.Errorf("row %d: recipient uuid = %q, want %q", i+1, row[2], want)
+				}
+				if m.Header.Get("From") != record[0] || m.Header.Get("To") != record[1] || m.Header.Get("Subject") != record[3] {
+					t.Errorf("row %d: addresses or subject do not match the usage row: %v", i+1, m.Header)
+				}
+				sent, err := m.Header.Date()
+				if err != nil || !sent.Truncate(time.Minute).Equal(date) {
+					t.Errorf("row %d: Date = %v, want within %v", i+1, sent, date)
+				}
+			}
+		})
+	}
+}
+
+func readCorpus(t *testing.T, path, format string) []*mail.Message {
+	var raws [][]byte
+	if format == Zip {
+		z, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer z.Close()
+		for _, f := range z.File {
+			r, _ := f.Open()
+			b, _ := ioutil.ReadAll(r)
+			r.Close()
+			raws = append(raws, b)
+		}
+	} else {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, part := range strings.Split(string(b), "\nFrom ") {
+			raw := part[strings.Index(part, "\n")+1:]
+			raws = append(raws, []byte(raw))
+		}
+	}
+
+	var messages []*mail.Message
+	for _, raw := range raws {
+		m, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
@@ -0,0 +1,61 @@
+package mailcorpus
+
+import (
+	"math/rand"
+	"os"
+	"time"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/utils"
+)
+
+// MessageIDs assigns usage rows a send time to the nanosecond and an Exim
+// message id, unique within a run.
+type MessageIDs struct {
+	// Seconds and nanoseconds are not part of the usage row, so they are drawn here
+	// to keep the report itself identical whether or not messages are generated.
+	rnd *rand.Rand
+	ids map[string]bool
+	pid int
+
+	// collisions counts the ids taken again, to step past them.
+	collisions int
+}
+
+// NewMessageIDs constructs MessageIDs drawing send times from seed.
+func NewMessageIDs(seed int64) *MessageIDs {
+	return &MessageIDs{
+		rnd: rand.New(rand.NewSource(seed)),
+		ids: make(map[string]bool),
+		pid: os.Getpid(),
+	}
+}
+
+// Next returns the send time and message id of a row sent in the minute of date.
+func (m *MessageIDs) Next(date time.Time) (time.Time, string) {
+	date = date.Add(time.Duration(m.rnd.Intn(60))*time.Second + time.Duration(m.rnd.Intn(999999999)+1))
+	return date, m.ID(date)
+}
+
+// ID generates the Exim message id of a message received at date. An id
+// already taken moves on to the fractions, then pids, after those of the
+// earlier collisions, so that busy seconds do not walk the same ids again.
+func (m *MessageIDs) ID(date time.Time) string {
+	gen := utils.NewMsgIDGenerator(date)
+	gen.ProcessID = m.pid
+	id := gen.Generate()
+	sec, fraction := date.Unix(), date.Nanosecond()%fractions
+	for m.ids[id] {
+		m.collisions++
+		n := fraction + m.collisions
+		gen.ProcessID = m.pid + n/fractions
+		// Generate takes the fraction from the nanoseconds, which are kept
+		// above zero so that it does not fall back to the backup date.
+		gen.Date = time.Unix(sec, int64(fractions+n%fractions))
+		id = gen.Generate()
+	}
+	m.ids[id] = true
+	return id
+}
+
+// fractions is the number of sub-second parts of an Exim message id, 62².
+const fractions = 62 * 62
@@ -0,0 +1,130 @@
+package nsqpub
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Message is a message received by a FakeNSQD.
+type Message struct {
+	Topic string
+	Body  []byte
+	Defer time.Duration
+}
+
+// FakeNSQD is an http.Handler serving the /pub and /mpub endpoints of nsqd,
+// for tests of publishers without an nsqd.
+type FakeNSQD struct {
+	// FailStatus, if set, is returned to every request.
+	FailStatus int
+
+	mu       sync.Mutex
+	messages []Message
+	requests int
+}
+
+// Messages returns the messages received so far.
+func (f *FakeNSQD) Messages() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Message(nil), f.messages...)
+}
+
+// Requests returns the number of requests received so far.
+func (f *FakeNSQD) Requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func (f *FakeNSQD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests++
+	f.mu.Unlock()
+
+	if f.FailStatus != 0 {
+		http.Error(w, "E_FAILED", f.FailStatus)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := r.URL.Query().Get("topic")
+	if !topicPattern.MatchString(topic) {
+		http.Error(w, "INVALID_TOPIC", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "INVALID_BODY", http.StatusBadRequest)
+		return
+	}
+
+	var received []Message
+	switch r.URL.Path {
+	case "/pub":
+		m := Message{Topic: topic, Body: body}
+		if v := r.URL.Query().Get("defer"); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil || ms < 0 {
+				http.Error(w, "INVALID_DEFER", http.StatusBadRequest)
+				return
+			}
+			m.Defer = time.Duration(ms) * time.Millisecond
+		}
+		received = append(received, m)
+	case "/mpub":
+		if r.URL.Query().Get("binary") != "true" {
+			http.Error(w, "BINARY_REQUIRED", http.StatusBadRequest)
+			return
+		}
+		bodies, err := splitBinary(body)
+		if err != nil {
+			http.Error(w, "BAD_BODY", http.StatusBadRequest)
+			return
+		}
+		for _, b := range bodies {
+			received = append(received, Message{Topic: topic, Body: b})
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	f.messages = append(f.messages, received...)
+	f.mu.Unlock()
+	w.Write([]byte("OK")) // nolint:errcheck
+}
+
+// splitBinary returns the messages of a binary /mpub body.
+func splitBinary(body []byte) ([][]byte, error) {
+	if len(body) < 4 {
+		return nil, errors.New("missing message count")
+	}
+	n := binary.BigEndian.Uint32(body)
+	body = body[4:]
+
+	var bodies [][]byte
+	for i := uint32(0); i < n; i++ {
+		if len(body) < 4 {
+			return nil, errors.New("missing message size")
+		}
+		size := binary.BigEndian.Uint32(body)
+		if uint32(len(body)-4) < size {
+			return nil, errors.New("truncated message")
+		}
+		bodies = append(bodies, body[4:4+size])
+		body = body[4+size:]
+	}
+	if len(body) > 0 {
+		return nil, errors.New("trailing data")
+	}
+	return bodies, nil
+}
@@ -0,0 +1,203 @@
+// Package nsqpub publishes messages to a topic through the nsqd HTTP API, in
+// /mpub batches or one /pub at a time, at an optional rate.
+//
+//	p, err := nsqpub.New(nsqpub.Options{Addr: "127.0.0.1:4151", Topic: "zix_usage", BatchSize: 100})
+//	...
+//	for _, msg := range messages {
+//		if err := p.Publish(msg); err != nil {
+//			...
+//		}
+//	}
+//	err = p.Flush()
+package nsqpub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// topicPattern matches the topic names nsqd accepts.
+var topicPattern = regexp.MustCompile(`^[.a-zA-Z0-9_-]{1,64}(#ephemeral)?$`)
+
+// Options configures a Publisher.
+type Options struct {
+	// Addr is the nsqd HTTP address, http://127.0.0.1:4151 by default.
+	Addr  string
+	Topic string
+	// BatchSize is the number of messages per /mpub request; each message
+	// has its own /pub request if 1 or less.
+	BatchSize int
+	// Rate is the number of messages published per second, unlimited if 0.
+	Rate float64
+	// Defer delays the delivery of the messages by nsqd. As /mpub takes no
+	// delay, deferred messages are published one at a time.
+	Defer time.Duration
+	// Client defaults to a client with a 10 seconds timeout.
+	Client *http.Client
+}
+
+// Stats counts the messages and requests of a Publisher.
+type Stats struct {
+	Published int
+	Failed    int
+	Requests  int
+}
+
+// PublishError is the response of nsqd to a rejected request.
+type PublishError struct {
+	Status   int
+	Message  string
+	Messages int
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("nsqd rejected %d messages: %d %s", e.Messages, e.Status, e.Message)
+}
+
+// Publisher publishes messages to a topic. It is not safe for concurrent use.
+type Publisher struct {
+	opts    Options
+	base    string
+	pending [][]byte
+	start   time.Time
+	stats   Stats
+}
+
+// New constructs a Publisher, validating the address and topic.
+func New(opts Options) (*Publisher, error) {
+	if !topicPattern.MatchString(opts.Topic) {
+		return nil, fmt.Errorf("invalid topic name %q", opts.Topic)
+	}
+	if opts.Rate < 0 || opts.Defer < 0 {
+		return nil, errors.New("rate and defer must not be negative")
+	}
+
+	addr := opts.Addr
+	if addr == "" {
+		addr = "127.0.0.1:4151"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid nsqd address %q", opts.Addr)
+	}
+
+	if opts.BatchSize < 1 || opts.Defer > 0 {
+		opts.BatchSize = 1
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Publisher{opts: opts, base: strings.TrimSuffix(u.String(), "/")}, nil
+}
+
+// Publish queues msg, publishing the batch once full. The error of a failed
+// request is returned, the messages of its batch counted as failed.
+func (p *Publisher) Publish(msg []byte) error {
+	p.pending = append(p.pending, msg)
+	if len(p.pending) < p.opts.BatchSize {
+		return nil
+	}
+	return p.Flush()
+}
+
+// Flush publishes the queued messages.
+func (p *Publisher) Flush() error {
+	if len(p.pending) == 0 {
+		return nil
+	}
+	batch := p.pending
+	p.pending = nil
+	p.wait()
+
+	var err error
+	if len(batch) == 1 {
+		err = p.pub(batch[0])
+	} else {
+		err = p.mpub(batch)
+	}
+	p.stats.Requests++
+	if err != nil {
+		p.stats.Failed += len(batch)
+		if perr, ok := err.(*PublishError); ok {
+			perr.Messages = len(batch)
+		}
+		return err
+	}
+	p.stats.Published += len(batch)
+	return nil
+}
+
+// Stats returns the counts so far.
+func (p *Publisher) Stats() Stats {
+	return p.stats
+}
+
+// wait paces the requests so that the messages sent so far keep to the rate.
+func (p *Publisher) wait() {
+	if p.opts.Rate <= 0 {
+		return
+	}
+	if p.start.IsZero() {
+		p.start = time.Now()
+		return
+	}
+	sent := p.stats.Published + p.stats.Failed
+	due := p.start.Add(time.Duration(float64(sent) / p.opts.Rate * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (p *Publisher) pub(msg []byte) error {
+	query := url.Values{"topic": {p.opts.Topic}}
+	if p.opts.Defer > 0 {
+		query.Set("defer", strconv.FormatInt(int64(p.opts.Defer/time.Millisecond), 10))
+	}
+	return p.post("/pub?"+query.Encode(), msg)
+}
+
+// mpub publishes batch in the binary format, which allows newlines in the
+// messages: the message count, then each message prefixed by its size.
+func (p *Publisher) mpub(batch [][]byte) error {
+	size := 4
+	for _, msg := range batch {
+		size += 4 + len(msg)
+	}
+	body := make([]byte, 4, size)
+	binary.BigEndian.PutUint32(body, uint32(len(batch)))
+	for _, msg := range batch {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(msg)))
+		body = append(body, n[:]...)
+		body = append(body, msg...)
+	}
+
+	query := url.Values{"topic": {p.opts.Topic}, "binary": {"true"}}
+	return p.post("/mpub?"+query.Encode(), body)
+}
+
+func (p *Publisher) post(path string, body []byte) error {
+	res, err := p.opts.Client.Post(p.base+path, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	reply, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return &PublishError{Status: res.StatusCode, Message: strings.TrimSpace(string(reply))}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package nsqpub
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{Options{Topic: "zix_usage"}, false},
+		{Options{Topic: "zix.usage-1#ephemeral", Addr: "https://nsqd:4151/"}, false},
+		{Options{Topic: ""}, true},
+		{Options{Topic: "bad topic"}, true},
+		{Options{Topic: "t", Rate: -1}, true},
+		{Options{Topic: "t", Addr: "http://"}, true},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.opts); (err != nil) != tt.wantErr {
+			t.Errorf("New(%+v) error %v", tt.opts, err)
+		}
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         Options
+		wantRequests int
+		wantDefer    time.Duration
+	}{
+		{"batched", Options{BatchSize: 4}, 3, 0},
+		{"single", Options{BatchSize: 1}, 10, 0},
+		{"deferred", Options{BatchSize: 4, Defer: 1500 * time.Millisecond}, 10, 1500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &FakeNSQD{}
+			ts := httptest.NewServer(fake)
+			defer ts.Close()
+
+			tt.opts.Addr = ts.URL
+			tt.opts.Topic = "usage"
+			p, err := New(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				// Newlines are kept by the binary /mpub format.
+				if err := p.Publish([]byte(fmt.Sprintf("{\"n\":%d}\n", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := fake.Messages()
+			if len(got) != 10 || fake.Requests() != tt.wantRequests {
+				t.Fatalf("%d messages in %d requests", len(got), fake.Requests())
+			}
+			for i, m := range got {
+				if want := fmt.Sprintf("{\"n\":%d}\n", i); string(m.Body) != want || m.Topic != "usage" || m.Defer != tt.wantDefer {
+					t.Errorf("message %d = %+v", i, m)
+				}
+			}
+			if s := p.Stats(); s != (Stats{Published: 10, Requests: tt.wantRequests}) {
+				t.Errorf("stats = %+v", s)
+			}
+		})
+	}
+}
+
+func TestPublisher_Error(t *testing.T) {
+	ts := httptest.NewServer(&FakeNSQD{FailStatus: http.StatusServiceUnavailable})
+	defer ts.Close()
+
+	p, err := New(Options{Addr: ts.URL, Topic: "usage", BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Publish([]byte("a")) // nolint:errcheck
+	p.Publish([]byte("b")) // nolint:errcheck
+	err = p.Publish([]byte("c"))
+
+	perr, ok := err.(*PublishError)
+	if !ok || perr.Status != http.StatusServiceUnavailable || perr.Messages != 3 || perr.Message != "E_FAILED" {
+		t.Fatalf("error %v", err)
+	}
+	if s := p.Stats(); s != (Stats{Failed: 3, Requests: 1}) {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestPublisher_Rate(t *testing.T) {
+	ts := httptest.NewServer(&FakeNSQD{})
+	defer ts.Close()
+
+	p, err := New(Options{Addr: ts.URL, Topic: "usage", BatchSize: 2, Rate: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		p.Publish([]byte("x")) // nolint:errcheck
+	}
+	// The last batch is due after the first 8 messages.
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("10 messages at 100/s published in %v", elapsed)
+	}
+}
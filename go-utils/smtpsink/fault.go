@@ -0,0 +1,156 @@
+package smtpsink
+
+// Provides configurable SMTP faults.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault stages, i.e. where in the session a fault applies.
+const (
+	StageConnect = "connect" // Before the banner; Delay gives a slow banner.
+	StageHelo    = "helo"    // EHLO or HELO.
+	StageAuth    = "auth"
+	StageMail    = "mail"
+	StageRcpt    = "rcpt"
+	StageData    = "data"    // Reply to the DATA command.
+	StageMessage = "message" // Reply after the message body.
+)
+
+var stages = map[string]bool{
+	StageConnect: true, StageHelo: true, StageAuth: true, StageMail: true,
+	StageRcpt: true, StageData: true, StageMessage: true,
+}
+
+// Fault replaces the normal reply at a stage with an error reply,
+// a disconnect, or delays it.
+type Fault struct {
+	Stage      string        `json:"stage"`
+	Code       int           `json:"code,omitempty"`    // 4xx or 5xx reply code; zero keeps the normal reply.
+	Message    string        `json:"message,omitempty"` // Reply text, defaults per code class.
+	Disconnect bool          `json:"disconnect,omitempty"`
+	Delay      time.Duration `json:"delay,omitempty"`
+	Every      int           `json:"every,omitempty"` // Apply on every nth hit of the stage; zero or one for always.
+}
+
+func (f *Fault) String() string {
+	return fmt.Sprintf("{%T: %v %v every %v, delay %v, disconnect %v}", f, f.Stage, f.Code, f.Every, f.Delay, f.Disconnect)
+}
+
+// Validate checks the fault definition.
+func (f *Fault) Validate() error {
+	if !stages[f.Stage] {
+		return fmt.Errorf("unknown fault stage %q", f.Stage)
+	}
+	if f.Code != 0 && (f.Code < 400 || f.Code > 599) {
+		return fmt.Errorf("fault code %d is not a 4xx or 5xx reply", f.Code)
+	}
+	if f.Every < 0 {
+		return fmt.Errorf("fault every %d is negative", f.Every)
+	}
+	return nil
+}
+
+func (f *Fault) reply() string {
+	msg := f.Message
+	if msg == "" {
+		msg = "Requested action aborted: local error in processing"
+		if f.Code >= 500 {
+			msg = "Requested action not taken: rejected by policy"
+		}
+	}
+	return fmt.Sprintf("%d %s", f.Code, msg)
+}
+
+/*
+ParseFault parses a fault from "stage[:code][:every][:disconnect][:delay=duration][:msg=text]",
+e.g.:
+
+	"mail:451"            temporary failure on every MAIL.
+	"rcpt:550:3"          reject every third RCPT.
+	"connect:delay=10s"   slow banner.
+	"message:disconnect"  drop the connection after the message body.
+*/
+func ParseFault(s string) (*Fault, error) {
+	parts := strings.Split(s, ":")
+	f := &Fault{Stage: strings.ToLower(parts[0])}
+
+	numbers := 0
+	for _, part := range parts[1:] {
+		switch {
+		case part == "disconnect":
+			f.Disconnect = true
+		case strings.HasPrefix(part, "delay="):
+			d, err := time.ParseDuration(part[len("delay="):])
+			if err != nil {
+				return nil, err
+			}
+			f.Delay = d
+		case strings.HasPrefix(part, "msg="):
+			f.Message = part[len("msg="):]
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fault part %q in %q", part, s)
+			}
+			if numbers == 0 {
+				f.Code = n
+			} else {
+				f.Every = n
+			}
+			numbers++
+		}
+	}
+
+	return f, f.Validate()
+}
+
+// faultSet holds the active faults and their hit counters.
+type faultSet struct {
+	mu     sync.Mutex
+	faults []*Fault
+	hits   map[*Fault]int
+}
+
+func newFaultSet(faults []*Fault) *faultSet {
+	fs := &faultSet{}
+	fs.set(faults)
+	return fs
+}
+
+func (fs *faultSet) set(faults []*Fault) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults = faults
+	fs.hits = make(map[*Fault]int)
+}
+
+func (fs *faultSet) list() []*Fault {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	list := make([]*Fault, len(fs.faults))
+	copy(list, fs.faults)
+	return list
+}
+
+// match counts a hit of stage, and returns the first fault due.
+func (fs *faultSet) match(stage string) *Fault {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var due *Fault
+	for _, f := range fs.faults {
+		if f.Stage != stage {
+			continue
+		}
+		fs.hits[f]++
+		if due == nil && (f.Every <= 1 || fs.hits[f]%f.Every == 0) {
+			due = f
+		}
+	}
+	return due
+}
@@ -0,0 +1,165 @@
+package smtpsink
+
+// Provides the HTTP API to inspect captured messages and manage faults.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+/*
+Handler returns the handler of the sink endpoints, mounted under prefix:
+
+	GET    {prefix}/messages           list messages as JSON.
+	DELETE {prefix}/messages           delete all messages.
+	GET    {prefix}/messages/{id}      message as JSON.
+	GET    {prefix}/messages/{id}.eml  raw message.
+	GET    {prefix}/faults             active faults.
+	PUT    {prefix}/faults             replace faults with a JSON list.
+	GET    {prefix}/stats              sink statistics.
+*/
+func (s *Server) Handler(prefix string) http.Handler {
+	return http.StripPrefix(prefix, http.HandlerFunc(s.route))
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case path == "/messages":
+		if allow(w, r, http.MethodGet, http.MethodDelete) {
+			if r.Method == http.MethodDelete {
+				s.handleClear(w, r)
+			} else {
+				s.handleList(w, r)
+			}
+		}
+	case strings.HasPrefix(path, "/messages/"):
+		id := strings.TrimPrefix(path, "/messages/")
+		raw := strings.HasSuffix(id, ".eml")
+		id = strings.TrimSuffix(id, ".eml")
+		if id == "" || strings.ContainsAny(id, "/.") {
+			http.NotFound(w, r)
+			return
+		}
+		if allow(w, r, http.MethodGet) {
+			if raw {
+				s.handleRaw(w, id)
+			} else {
+				s.handleGet(w, id)
+			}
+		}
+	case path == "/faults":
+		if allow(w, r, http.MethodGet, http.MethodPut) {
+			s.handleFaults(w, r)
+		}
+	case path == "/stats":
+		if allow(w, r, http.MethodGet) {
+			s.handleStats(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allow replies 405 unless the request method is one of methods.
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	list, err := s.Store.List()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+func (s *Server) handleClear(w http.ResponseWriter, r *http.Request) {
+	if err := s.Store.Clear(); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, id string) {
+	m, ok := s.lookup(w, id)
+	if ok {
+		writeJSON(w, m)
+	}
+}
+
+func (s *Server) handleRaw(w http.ResponseWriter, id string) {
+	m, ok := s.lookup(w, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+m.ID+`.eml"`)
+	w.Write(m.Raw) // nolint:errcheck
+}
+
+func (s *Server) lookup(w http.ResponseWriter, id string) (*Message, bool) {
+	m, err := s.Store.Get(id)
+	switch {
+	case err == ErrNotFound:
+		writeError(w, err, http.StatusNotFound)
+		return nil, false
+	case err != nil:
+		writeError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	return m, true
+}
+
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var faults []*Fault
+		if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		for _, f := range faults {
+			if err := f.Validate(); err != nil {
+				writeError(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		s.SetFaults(faults)
+	}
+	writeJSON(w, s.Faults())
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	// Sessions keep counting while the snapshot is written.
+	stats := Stats.Snapshot()
+	writeJSON(w, &stats)
+}
+
+// writeJSON writes data as JSON, as the fm-lib-commons server does.
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	d, err := json.Marshal(data)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d) // nolint:errcheck
+}
+
+// writeError writes err as a JSON object with status.
+func writeError(w http.ResponseWriter, err error, status int) {
+	d, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(d) // nolint:errcheck
+}
@@ -0,0 +1,34 @@
+package smtpsink
+
+// Provides the hooks to instrument the sink.
+
+// Metrics is told of the sink events, to count them, as file-server does in
+// smtp_sink_connections_total, smtp_sink_replies_total,
+// smtp_sink_messages_total and smtp_sink_message_bytes.
+type Metrics interface {
+	// Connection counts an accepted connection.
+	Connection()
+	// Reply counts a reply by command, or fault stage, and code; the command
+	// is "unknown" for an unsupported one, and the code "disconnect" for a
+	// disconnect fault.
+	Reply(command, code string)
+	// Message counts a message by result: accepted, too_big, fault or error.
+	Message(result string)
+	// MessageSize observes the size of an accepted message.
+	MessageSize(bytes int)
+}
+
+// Package metrics, set with SetMetrics; none by default.
+var metrics Metrics = noMetrics{}
+
+// SetMetrics sets the package metrics.
+func SetMetrics(m Metrics) {
+	metrics = m
+}
+
+type noMetrics struct{}
+
+func (noMetrics) Connection()                {}
+func (noMetrics) Reply(command, code string) {}
+func (noMetrics) Message(result string)      {}
+func (noMetrics) MessageSize(bytes int)      {}
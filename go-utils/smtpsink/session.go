@@ -0,0 +1,529 @@
+package smtpsink
+
+// Provides the SMTP session state machine.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"bitbucket.org/fusemail/fm-lib-commons-golang/utils"
+)
+
+// errDisconnect ends a session on a disconnect fault.
+var errDisconnect = fmt.Errorf("fault disconnect")
+
+// errLineTooLong is returned by readLine for lines over maxLineLength.
+var errLineTooLong = fmt.Errorf("line too long")
+
+// maxLineLength is the longest command line read, CRLF included: that of
+// the AUTH responses of RFC 4954, the longest of the supported commands.
+const maxLineLength = 12288
+
+// commands are the supported commands, by which replies are counted; any
+// other verb is counted as "unknown".
+var commands = map[string]bool{
+	"EHLO": true, "HELO": true, "STARTTLS": true, "AUTH": true, "MAIL": true,
+	"RCPT": true, "DATA": true, "RSET": true, "NOOP": true, "VRFY": true, "QUIT": true,
+}
+
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	remote string
+
+	helo     string
+	tls      bool
+	authUser string
+	mail     bool // MAIL was given, if with the null reverse-path <>.
+	from     string
+	to       []string
+	body8Bit bool
+}
+
+func newSession(s *Server, conn net.Conn) *session {
+	return &session{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		remote: conn.RemoteAddr().String(),
+	}
+}
+
+func (ss *session) serve() {
+	defer ss.conn.Close() // nolint:errcheck
+
+	countConnection()
+	metrics.Connection()
+	log.Debugf("smtp sink connection from %s", ss.remote)
+
+	if handled, _ := ss.fault(StageConnect); handled {
+		return
+	}
+	if ss.reply(fmt.Sprintf("220 %s ESMTP sink ready", ss.server.Config.Hostname)) != nil {
+		return
+	}
+
+	for {
+		line, err := ss.readLine()
+		if err == errLineTooLong {
+			if ss.replyCode("", "500 5.5.2 Line too long") != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("smtp sink read from %s failed: %v", ss.remote, err)
+			}
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		verb = strings.ToUpper(verb)
+
+		if err := ss.handle(verb, arg); err != nil {
+			if err != errDisconnect && err != io.EOF {
+				log.Debugf("smtp sink session of %s ended: %v", ss.remote, err)
+			}
+			return
+		}
+		if verb == "QUIT" {
+			return
+		}
+	}
+}
+
+func (ss *session) handle(verb, arg string) error {
+	switch verb {
+	case "EHLO", "HELO":
+		return ss.cmdHelo(verb, arg)
+	case "STARTTLS":
+		return ss.cmdStartTLS()
+	case "AUTH":
+		return ss.cmdAuth(arg)
+	case "MAIL":
+		return ss.cmdMail(arg)
+	case "RCPT":
+		return ss.cmdRcpt(arg)
+	case "DATA":
+		return ss.cmdData()
+	case "RSET":
+		ss.resetTransaction()
+		return ss.replyCode(verb, "250 OK")
+	case "NOOP":
+		return ss.replyCode(verb, "250 OK")
+	case "VRFY":
+		return ss.replyCode(verb, "252 Cannot VRFY user, but will accept message")
+	case "QUIT":
+		return ss.replyCode(verb, fmt.Sprintf("221 %s closing connection", ss.server.Config.Hostname))
+	default:
+		return ss.replyCode(verb, "502 Command not implemented")
+	}
+}
+
+func (ss *session) cmdHelo(verb, arg string) error {
+	if arg == "" {
+		return ss.replyCode(verb, "501 Syntax: "+verb+" hostname")
+	}
+	if handled, err := ss.fault(StageHelo); handled {
+		return err
+	}
+
+	ss.helo = arg
+	ss.resetTransaction()
+
+	if verb == "HELO" {
+		return ss.replyCode(verb, "250 "+ss.server.Config.Hostname)
+	}
+
+	lines := []string{ss.server.Config.Hostname + " greets " + arg, "8BITMIME", "ENHANCEDSTATUSCODES"}
+	if ss.server.Config.MaxSize > 0 {
+		lines = append(lines, "SIZE "+strconv.FormatInt(ss.server.Config.MaxSize, 10))
+	} else {
+		lines = append(lines, "SIZE")
+	}
+	if ss.server.Config.TLSConfig != nil && !ss.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if len(ss.server.Config.Users) > 0 {
+		lines = append(lines, "AUTH PLAIN")
+	}
+
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		lines[i] = "250" + sep + line
+	}
+	return ss.replyCode(verb, strings.Join(lines, "\r\n"))
+}
+
+func (ss *session) cmdStartTLS() error {
+	if ss.server.Config.TLSConfig == nil || ss.tls {
+		return ss.replyCode("STARTTLS", "502 5.5.1 STARTTLS not available")
+	}
+	if err := ss.replyCode("STARTTLS", "220 2.0.0 Ready to start TLS"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(ss.conn, ss.server.Config.TLSConfig)
+	ss.setDeadline()
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	// Discard all state from before TLS, as per RFC 3207.
+	ss.conn = tlsConn
+	ss.reader = bufio.NewReader(tlsConn)
+	ss.writer = bufio.NewWriter(tlsConn)
+	ss.tls = true
+	ss.helo = ""
+	ss.authUser = ""
+	ss.resetTransaction()
+	return nil
+}
+
+func (ss *session) cmdAuth(arg string) error {
+	if len(ss.server.Config.Users) == 0 {
+		return ss.replyCode("AUTH", "502 5.5.1 AUTH not available")
+	}
+	if ss.authUser != "" {
+		return ss.replyCode("AUTH", "503 5.5.1 Already authenticated")
+	}
+
+	parts := strings.Fields(arg)
+	if len(parts) == 0 || strings.ToUpper(parts[0]) != "PLAIN" {
+		return ss.replyCode("AUTH", "504 5.5.4 Unrecognized authentication type")
+	}
+
+	response := ""
+	if len(parts) > 1 {
+		response = parts[1]
+	} else {
+		if err := ss.reply("334 "); err != nil {
+			return err
+		}
+		line, err := ss.readLine()
+		if err == errLineTooLong {
+			return ss.replyCode("AUTH", "500 5.5.6 Authentication exchange line is too long")
+		}
+		if err != nil {
+			return err
+		}
+		response = line
+	}
+	if response == "*" {
+		return ss.replyCode("AUTH", "501 5.7.0 Authentication cancelled")
+	}
+
+	if handled, err := ss.fault(StageAuth); handled {
+		return err
+	}
+
+	// PLAIN: [authzid] NUL authcid NUL passwd.
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	fields := bytes.Split(decoded, []byte{0})
+	if err != nil || len(fields) != 3 {
+		return ss.replyCode("AUTH", "501 5.5.2 Cannot decode AUTH PLAIN response")
+	}
+
+	user, pass := string(fields[1]), fields[2]
+	want, found := ss.server.Config.Users[user]
+	if !found || subtle.ConstantTimeCompare(pass, []byte(want)) != 1 {
+		return ss.replyCode("AUTH", "535 5.7.8 Authentication credentials invalid")
+	}
+
+	ss.authUser = user
+	return ss.replyCode("AUTH", "235 2.7.0 Authentication successful")
+}
+
+func (ss *session) cmdMail(arg string) error {
+	if ss.helo == "" {
+		return ss.replyCode("MAIL", "503 5.5.1 Send EHLO first")
+	}
+	if ss.mail {
+		return ss.replyCode("MAIL", "503 5.5.1 Nested MAIL command")
+	}
+	if ss.server.Config.RequireAuth && ss.authUser == "" {
+		return ss.replyCode("MAIL", "530 5.7.0 Authentication required")
+	}
+
+	addr, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		return ss.replyCode("MAIL", "501 5.5.4 Syntax: MAIL FROM:<address>")
+	}
+
+	for _, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		switch strings.ToUpper(kv[0]) {
+		case "SIZE":
+			if len(kv) != 2 {
+				return ss.replyCode("MAIL", "501 5.5.4 Invalid SIZE parameter")
+			}
+			size, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return ss.replyCode("MAIL", "501 5.5.4 Invalid SIZE parameter")
+			}
+			if limit := ss.server.Config.MaxSize; limit > 0 && size > limit {
+				return ss.replyCode("MAIL", "552 5.3.4 Message size exceeds fixed maximum message size")
+			}
+		case "BODY":
+			if len(kv) == 2 && strings.ToUpper(kv[1]) == "8BITMIME" {
+				ss.body8Bit = true
+			}
+		}
+	}
+
+	if handled, err := ss.fault(StageMail); handled {
+		return err
+	}
+
+	ss.mail = true
+	ss.from = addr
+	return ss.replyCode("MAIL", "250 2.1.0 OK")
+}
+
+func (ss *session) cmdRcpt(arg string) error {
+	if !ss.mail {
+		return ss.replyCode("RCPT", "503 5.5.1 Need MAIL before RCPT")
+	}
+
+	addr, _, ok := parsePath(arg, "TO:")
+	if !ok || addr == "" {
+		return ss.replyCode("RCPT", "501 5.5.4 Syntax: RCPT TO:<address>")
+	}
+	if limit := ss.server.Config.MaxRecipients; limit > 0 && len(ss.to) >= limit {
+		return ss.replyCode("RCPT", "452 4.5.3 Too many recipients")
+	}
+
+	if handled, err := ss.fault(StageRcpt); handled {
+		return err
+	}
+
+	ss.to = append(ss.to, addr)
+	return ss.replyCode("RCPT", "250 2.1.5 OK")
+}
+
+func (ss *session) cmdData() error {
+	if len(ss.to) == 0 {
+		return ss.replyCode("DATA", "503 5.5.1 Need RCPT before DATA")
+	}
+	if handled, err := ss.fault(StageData); handled {
+		return err
+	}
+	if err := ss.replyCode("DATA", "354 End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+
+	raw, tooBig, err := ss.readData()
+	if err != nil {
+		return err
+	}
+	defer ss.resetTransaction()
+
+	if tooBig {
+		atomic.AddInt64(&Stats.Rejected, 1)
+		metrics.Message("too_big")
+		return ss.replyCode("DATA", "552 5.3.4 Message size exceeds fixed maximum message size")
+	}
+
+	if handled, err := ss.fault(StageMessage); handled {
+		metrics.Message("fault")
+		return err
+	}
+
+	m := &Message{
+		Received: time.Now(),
+		Remote:   ss.conn.RemoteAddr().String(),
+		Helo:     ss.helo,
+		TLS:      ss.tls,
+		AuthUser: ss.authUser,
+		From:     ss.from,
+		To:       ss.to,
+		Size:     len(raw),
+		Body8Bit: ss.body8Bit,
+		Raw:      raw,
+	}
+	m.parseHeaders()
+
+	// Exim ids are only unique per process to a fraction of a second.
+	for m.ID = utils.GenerateMsgID(m.Received); ss.server.Store.Has(m.ID); {
+		m.ID = utils.GenerateMsgID(time.Now())
+	}
+
+	if err := ss.server.Store.Save(m); err != nil {
+		log.Errorf("cannot store message from %s: %v", ss.remote, err)
+		metrics.Message("error")
+		return ss.replyCode("DATA", "451 4.3.0 Cannot store message")
+	}
+
+	atomic.AddInt64(&Stats.Messages, 1)
+	metrics.Message("accepted")
+	metrics.MessageSize(m.Size)
+	log.Infof("smtp sink captured message %s from %s to %v, %d bytes", m.ID, m.From, m.To, m.Size)
+
+	return ss.replyCode("DATA", "250 2.0.0 OK queued as "+m.ID)
+}
+
+// readData reads the message body up to the terminating dot line,
+// undoing dot stuffing. Oversized bodies are read to the end but discarded.
+func (ss *session) readData() ([]byte, bool, error) {
+	var buf bytes.Buffer
+	limit := ss.server.Config.MaxSize
+	tooBig := false
+
+	for {
+		ss.setDeadline()
+		line, err := ss.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, false, err
+		}
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 1 && trimmed[0] == '.' {
+			break
+		}
+		if bytes.HasPrefix(trimmed, []byte("..")) {
+			trimmed = trimmed[1:]
+		}
+
+		if tooBig {
+			continue
+		}
+		buf.Write(trimmed)
+		buf.WriteString("\r\n")
+		if limit > 0 && int64(buf.Len()) > limit {
+			tooBig = true
+			buf.Reset()
+		}
+	}
+
+	return buf.Bytes(), tooBig, nil
+}
+
+func (ss *session) resetTransaction() {
+	ss.mail = false
+	ss.from = ""
+	ss.to = nil
+	ss.body8Bit = false
+}
+
+// fault applies the fault due at stage, if any. handled is true when the
+// fault replied or disconnected in place of the normal reply, in which case
+// the command returns err, and the session ends on errDisconnect.
+func (ss *session) fault(stage string) (handled bool, err error) {
+	f := ss.server.faults.match(stage)
+	if f == nil {
+		return false, nil
+	}
+
+	log.Infof("smtp sink fault %v for %s", f, ss.remote)
+	if f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+	if f.Disconnect {
+		metrics.Reply(stage, "disconnect")
+		return true, errDisconnect
+	}
+	if f.Code == 0 {
+		return false, nil
+	}
+
+	if stage == StageData || stage == StageMessage {
+		ss.resetTransaction()
+	}
+
+	metrics.Reply(stage, strconv.Itoa(f.Code))
+	if err := ss.reply(f.reply()); err != nil {
+		return true, err
+	}
+	if stage == StageConnect || f.Code == 421 {
+		return true, errDisconnect
+	}
+	return true, nil
+}
+
+// readLine reads a command line. A line over maxLineLength is read to its end
+// but discarded, and returns errLineTooLong.
+func (ss *session) readLine() (string, error) {
+	ss.setDeadline()
+	var line []byte
+	tooLong := false
+	for {
+		part, err := ss.reader.ReadSlice('\n')
+		if !tooLong && len(line)+len(part) > maxLineLength {
+			tooLong = true
+			line = nil
+		}
+		if !tooLong {
+			line = append(line, part...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (ss *session) setDeadline() {
+	if t := ss.server.Config.ReadTimeout; t > 0 {
+		ss.conn.SetDeadline(time.Now().Add(t)) // nolint:errcheck
+	}
+}
+
+// replyCode sends reply and counts it by command and code.
+func (ss *session) replyCode(verb, reply string) error {
+	command := "unknown"
+	if commands[verb] {
+		command = strings.ToLower(verb)
+	}
+	metrics.Reply(command, reply[:3])
+	return ss.reply(reply)
+}
+
+func (ss *session) reply(reply string) error {
+	if _, err := ss.writer.WriteString(reply + "\r\n"); err != nil {
+		return err
+	}
+	return ss.writer.Flush()
+}
+
+// parsePath parses "FROM:<addr> PARAMS..." or "TO:<addr> PARAMS...".
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	return rest[1:end], strings.Fields(rest[end+1:]), true
+}
@@ -0,0 +1,256 @@
+/*
+Package smtpsink provides an embeddable SMTP server that captures mail for tests.
+Duties:
+  - Provides Config to configure the sink: port, hostname, size limit, TLS, AUTH users and store.
+  - Accepts mail with EHLO/HELO, STARTTLS, AUTH PLAIN, SIZE and 8BITMIME.
+  - Stores messages in memory (MemoryStore) or on disk (DirStore).
+  - Exposes stored messages over HTTP as JSON and raw .eml via Handler.
+  - Injects configurable SMTP faults: 4xx/5xx replies, slow banner, disconnects.
+  - Reports connections, replies and messages to Metrics, set with SetMetrics.
+  - Generates statistics via Stats.
+  - Logs pertinent info to Logger, set with SetLogger.
+
+It only depends on the standard library, to be shared by the services of
+go-utils whatever they vendor.
+*/
+package smtpsink
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	stdlog "log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Stats contains sink statistics, updated atomically.
+	Stats Statistics
+
+	// Package logger, set with SetLogger.
+	log Logger = stdLogger{stdlog.New(os.Stderr, "smtpsink: ", stdlog.LstdFlags)}
+)
+
+// Statistics counts the connections and messages of the sinks.
+type Statistics struct {
+	Connections int64 `json:"connections"`
+	Messages    int64 `json:"messages"`
+	Rejected    int64 `json:"rejected"`
+}
+
+// Snapshot returns a copy of st, each count read atomically.
+func (st *Statistics) Snapshot() Statistics {
+	return Statistics{
+		Connections: atomic.LoadInt64(&st.Connections),
+		Messages:    atomic.LoadInt64(&st.Messages),
+		Rejected:    atomic.LoadInt64(&st.Rejected),
+	}
+}
+
+// Logger is the leveled logger of the package, as a logrus.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// SetLogger overrides the package logger.
+func SetLogger(logger Logger) {
+	log = logger
+}
+
+// stdLogger logs to a standard logger, without the debug messages.
+type stdLogger struct {
+	*stdlog.Logger
+}
+
+func (l stdLogger) Debugf(format string, args ...interface{}) {}
+
+func (l stdLogger) Infof(format string, args ...interface{}) {
+	l.Printf(format, args...)
+}
+
+func (l stdLogger) Errorf(format string, args ...interface{}) {
+	l.Printf("error: "+format, args...)
+}
+
+// Config provides the structure to setup a sink.
+type Config struct {
+	Port     int    `json:"port"`
+	Hostname string `json:"hostname"`
+
+	// Maximum message size in bytes, advertised with SIZE. Zero for no limit.
+	MaxSize int64 `json:"max_size"`
+
+	// Maximum recipients per message. Zero for no limit.
+	MaxRecipients int `json:"max_recipients"`
+
+	// Enables STARTTLS when set.
+	TLSConfig *tls.Config `json:"-"`
+
+	// Accepted AUTH PLAIN credentials by user name. AUTH is not advertised if empty.
+	Users map[string]string `json:"-"`
+
+	// Reject MAIL before a successful AUTH.
+	RequireAuth bool `json:"require_auth"`
+
+	ReadTimeout time.Duration `json:"read_timeout"`
+
+	// Defaults to a MemoryStore.
+	Store Store `json:"-"`
+
+	Faults []*Fault `json:"faults"`
+}
+
+// NewConfig constructs sink config instances with defaults.
+func NewConfig() *Config {
+	return &Config{
+		Port:          2525,
+		Hostname:      "localhost",
+		MaxSize:       10 << 20,
+		MaxRecipients: 100,
+		ReadTimeout:   time.Minute,
+	}
+}
+
+// Server is a live SMTP sink.
+type Server struct {
+	Config *Config
+	Store  Store
+
+	faults *faultSet
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	closing  bool
+}
+
+// New constructs a Server from config.
+func New(config *Config) *Server {
+	if config == nil {
+		config = NewConfig()
+	}
+	store := config.Store
+	if store == nil {
+		store = NewMemoryStore()
+	}
+
+	return &Server{
+		Config: config,
+		Store:  store,
+		faults: newFaultSet(config.Faults),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) String() string {
+	return fmt.Sprintf("{%T: %v:%v}", s, s.Config.Hostname, s.Config.Port)
+}
+
+// ListenAndServe listens on Config.Port and serves until Shutdown.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Config.Port))
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Shutdown.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	log.Infof("starting smtp sink %v on %s", s, l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			newSession(s, conn).serve()
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Addr returns the listening address, or nil before Serve.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown stops accepting connections and waits for live sessions to
+// finish, closing them when ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Infof("shutdown smtp sink %v", s)
+
+	s.mu.Lock()
+	s.closing = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close() // nolint:errcheck
+		}
+		s.mu.Unlock()
+		<-done
+	}
+
+	return err
+}
+
+// SetFaults replaces the active fault rules.
+func (s *Server) SetFaults(faults []*Fault) {
+	s.faults.set(faults)
+}
+
+// Faults returns the active fault rules.
+func (s *Server) Faults() []*Fault {
+	return s.faults.list()
+}
+
+func countConnection() {
+	atomic.AddInt64(&Stats.Connections, 1)
+}
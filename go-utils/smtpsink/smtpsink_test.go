@@ -0,0 +1,216 @@
+package smtpsink
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startSink serves a sink on a random local port.
+func startSink(t *testing.T, config *Config) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(config)
+	go s.Serve(l) // nolint:errcheck
+	return s, l.Addr().String()
+}
+
+func stopSink(s *Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Shutdown(ctx) // nolint:errcheck
+}
+
+func TestServer_SendMail(t *testing.T) {
+	config := NewConfig()
+	config.Users = map[string]string{"zix": "secret"}
+	config.RequireAuth = true
+	s, addr := startSink(t, config)
+	defer stopSink(s)
+
+	msg := "From: reports@zix.example\r\nTo: a@example.com\r\nSubject: Usage\r\nMessage-ID: <1@zix.example>\r\n\r\n" +
+		".leading dot\r\nbody\r\n"
+
+	auth := smtp.PlainAuth("", "zix", "secret", "127.0.0.1")
+	if err := smtp.SendMail(addr, auth, "reports@zix.example", []string{"a@example.com", "b@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	badAuth := smtp.PlainAuth("", "zix", "nope", "127.0.0.1")
+	if err := smtp.SendMail(addr, badAuth, "reports@zix.example", []string{"a@example.com"}, []byte(msg)); err == nil {
+		t.Error("mail accepted with invalid credentials")
+	}
+
+	list, _ := s.Store.List()
+	if len(list) != 1 {
+		t.Fatalf("stored %d messages, want 1", len(list))
+	}
+	m := list[0]
+	if m.From != "reports@zix.example" || len(m.To) != 2 || m.AuthUser != "zix" || m.Subject != "Usage" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if !strings.Contains(string(m.Raw), "\r\n.leading dot\r\n") {
+		t.Errorf("dot stuffing not undone: %q", m.Raw)
+	}
+
+	router := s.Handler("/smtp")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/smtp/messages/"+m.ID+".eml", nil))
+	if w.Code != http.StatusOK || w.Body.String() != string(m.Raw) {
+		t.Errorf("raw message: status = %d, body = %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/smtp/messages", nil))
+	var listed []*Message
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 1 || listed[0].ID != m.ID {
+		t.Errorf("message list: %v, %s", err, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/smtp/stats", nil))
+	var stats Statistics
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Messages < 1 || stats.Connections < 2 {
+		t.Errorf("stats: %v, %s", err, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/smtp/stats", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST stats: status = %d", w.Code)
+	}
+}
+
+func TestServer_Faults(t *testing.T) {
+	tests := []struct {
+		name    string
+		fault   string
+		wantErr string
+	}{
+		{"temporary MAIL failure", "mail:451", "451"},
+		{"permanent RCPT rejection", "rcpt:550", "550"},
+		{"message rejected after data", "message:554", "554"},
+		{"disconnect after data", "message:disconnect", "EOF"},
+		{"slow banner", "connect:delay=50ms", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFault(tt.fault)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := NewConfig()
+			config.Faults = []*Fault{f}
+			s, addr := startSink(t, config)
+			defer stopSink(s)
+
+			err = smtp.SendMail(addr, nil, "a@example.com", []string{"b@example.com"}, []byte("Subject: x\r\n\r\nx\r\n"))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+
+			list, _ := s.Store.List()
+			if stored := len(list) == 1; stored != (tt.wantErr == "") {
+				t.Errorf("stored %d messages", len(list))
+			}
+		})
+	}
+}
+
+func TestServer_MaxSize(t *testing.T) {
+	config := NewConfig()
+	config.MaxSize = 64
+	s, addr := startSink(t, config)
+	defer stopSink(s)
+
+	err := smtp.SendMail(addr, nil, "a@example.com", []string{"b@example.com"}, []byte("Subject: big\r\n\r\n"+strings.Repeat("x", 100)+"\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "552") {
+		t.Errorf("error = %v, want 552", err)
+	}
+}
+
+// replyCounter records the commands replies are counted by.
+type replyCounter struct {
+	noMetrics
+	mu       sync.Mutex
+	commands map[string]bool
+}
+
+func (c *replyCounter) Reply(command, code string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands[command] = true
+}
+
+func TestServer_Commands(t *testing.T) {
+	counter := &replyCounter{commands: make(map[string]bool)}
+	SetMetrics(counter)
+	defer SetMetrics(noMetrics{})
+
+	s, addr := startSink(t, NewConfig())
+	defer stopSink(s)
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line string
+		code int
+	}{
+		{"EHLO client.example", 250},
+		// The null reverse-path of bounces still starts a transaction.
+		{"MAIL FROM:<>", 250},
+		{"MAIL FROM:<>", 503},
+		{"RCPT TO:<b@example.com>", 250},
+		{"X" + strings.Repeat("x", maxLineLength), 500},
+		{"XYZZY1", 502},
+		{"XYZZY2", 502},
+		{"RSET", 250},
+		{"RCPT TO:<b@example.com>", 503},
+	}
+	for _, tt := range tests {
+		id, err := conn.Cmd("%s", tt.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.StartResponse(id)
+		code, msg, err := conn.ReadResponse(0)
+		conn.EndResponse(id)
+		if code != tt.code {
+			t.Errorf("%.20s: reply %d %s (%v), want %d", tt.line, code, msg, err, tt.code)
+		}
+	}
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	for command := range counter.commands {
+		if strings.HasPrefix(command, "xyzzy") || strings.HasPrefix(command, "xxx") {
+			t.Errorf("reply counted by client command %q", command)
+		}
+	}
+	if !counter.commands["unknown"] {
+		t.Error("unsupported commands not counted as unknown")
+	}
+}
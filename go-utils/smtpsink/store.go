@@ -0,0 +1,224 @@
+package smtpsink
+
+// Provides message stores.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for unknown message ids.
+var ErrNotFound = errors.New("message not found")
+
+// Message is a captured message with its envelope.
+type Message struct {
+	ID       string    `json:"id"`
+	Received time.Time `json:"received"`
+	Remote   string    `json:"remote"`
+	Helo     string    `json:"helo"`
+	TLS      bool      `json:"tls"`
+	AuthUser string    `json:"auth_user,omitempty"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Size     int       `json:"size"`
+	Body8Bit bool      `json:"body_8bit"`
+
+	// Main headers, parsed from the message when possible.
+	Subject   string              `json:"subject"`
+	MessageID string              `json:"message_id"`
+	Headers   map[string][]string `json:"headers"`
+
+	Raw []byte `json:"-"`
+}
+
+func (m *Message) String() string {
+	return fmt.Sprintf("{%T: %v from %v to %v, %d bytes}", m, m.ID, m.From, m.To, m.Size)
+}
+
+// parseHeaders fills the header fields from Raw, ignoring malformed messages.
+func (m *Message) parseHeaders() {
+	parsed, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+	if err != nil {
+		return
+	}
+	m.Headers = parsed.Header
+	m.Subject = parsed.Header.Get("Subject")
+	m.MessageID = parsed.Header.Get("Message-Id")
+}
+
+// Store persists captured messages.
+type Store interface {
+	Save(*Message) error
+	Get(id string) (*Message, error)
+	List() ([]*Message, error)
+	Has(id string) bool
+	Clear() error
+}
+
+// MemoryStore keeps messages in memory.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	messages map[string]*Message
+	order    []string
+}
+
+// NewMemoryStore constructs an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{messages: make(map[string]*Message)}
+}
+
+// Save stores m.
+func (s *MemoryStore) Save(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.messages[m.ID]; !found {
+		s.order = append(s.order, m.ID)
+	}
+	s.messages[m.ID] = m
+	return nil
+}
+
+// Get returns the message by id.
+func (s *MemoryStore) Get(id string) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, found := s.messages[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return m, nil
+}
+
+// Has reports whether id is stored.
+func (s *MemoryStore) Has(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, found := s.messages[id]
+	return found
+}
+
+// List returns all messages, oldest first.
+func (s *MemoryStore) List() ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*Message, 0, len(s.order))
+	for _, id := range s.order {
+		list = append(list, s.messages[id])
+	}
+	return list, nil
+}
+
+// Clear removes all messages.
+func (s *MemoryStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = make(map[string]*Message)
+	s.order = nil
+	return nil
+}
+
+// DirStore writes each message to Dir as <id>.eml, with its envelope as <id>.json.
+type DirStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// NewDirStore constructs a DirStore, creating dir if needed.
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &DirStore{Dir: dir}, nil
+}
+
+// Save writes m to disk.
+func (s *DirStore) Save(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.Dir, m.ID+".eml"), m.Raw, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Dir, m.ID+".json"), meta, 0644)
+}
+
+// Get reads the message by id.
+func (s *DirStore) Get(id string) (*Message, error) {
+	if id != filepath.Base(id) {
+		return nil, ErrNotFound
+	}
+
+	meta, err := ioutil.ReadFile(filepath.Join(s.Dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	if err := json.Unmarshal(meta, m); err != nil {
+		return nil, err
+	}
+	m.Raw, err = ioutil.ReadFile(filepath.Join(s.Dir, id+".eml"))
+	return m, err
+}
+
+// Has reports whether id is stored.
+func (s *DirStore) Has(id string) bool {
+	_, err := os.Stat(filepath.Join(s.Dir, filepath.Base(id)+".json"))
+	return err == nil
+}
+
+// List reads all messages, oldest first.
+func (s *DirStore) List() ([]*Message, error) {
+	names, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Message, 0, len(names))
+	for _, name := range names {
+		m, err := s.Get(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Received.Before(list[j].Received) })
+	return list, nil
+}
+
+// Clear removes all stored messages.
+func (s *DirStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pattern := range []string{"*.json", "*.eml"} {
+		names, err := filepath.Glob(filepath.Join(s.Dir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package usagegen
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Address kinds, mixed into the sender and recipient columns by an
+// AddressMix. Each is a valid spelling of the mailbox of the row that
+// address normalisation and deduplication may trip on.
+const (
+	// AddressUTF8 local parts need SMTPUTF8: sender1-josé@sender1.com.
+	AddressUTF8 = "utf8"
+	// AddressIDN domains are internationalized: sender1@sender1-bücher.com.
+	AddressIDN = "idn"
+	// AddressPunycode domains are the IDN domains in ASCII:
+	// sender1@xn--sender1-bcher-4ob.com.
+	AddressPunycode = "punycode"
+	// AddressPlus local parts have a subaddress: sender1+tag3@sender1.com.
+	AddressPlus = "plus"
+	// AddressQuoted local parts are quoted strings: "sender 1"@sender1.com.
+	AddressQuoted = "quoted"
+	// AddressLong addresses have a 64 octet local part and are 254 octets
+	// long, the limits of RFC 5321.
+	AddressLong = "long"
+	// AddressMixedCase addresses have random letter case: SeNdEr1@sENder1.COM.
+	AddressMixedCase = "case"
+	// AddressSubdomain domains have subdomains: sender1@mx1.eu.sender1.com.
+	AddressSubdomain = "subdomain"
+)
+
+// AddressKinds are the address kinds, in the order of their documentation.
+var AddressKinds = []string{AddressUTF8, AddressIDN, AddressPunycode, AddressPlus, AddressQuoted, AddressLong, AddressMixedCase, AddressSubdomain}
+
+// Words of the internationalized local parts and domains, picked by the
+// number of the sender or domain, so a mailbox keeps its spelling.
+var (
+	utf8Words = []string{"josé", "müller", "用户", "пользователь", "δοκιμή"}
+	idnWords  = []string{"bücher", "münchen", "пример", "δοκιμή", "例え"}
+	subLabels = []string{"mail", "mx1", "eu", "west", "corp", "relay", "internal"}
+)
+
+// AddressMix is the share of the addresses of each kind; the other addresses
+// are plain.
+type AddressMix []AddressShare
+
+// AddressShare is the share of the addresses of a kind, from 0 to 1.
+type AddressShare struct {
+	Kind string
+	Rate float64
+}
+
+// ParseAddressMix parses comma separated kind=rate pairs, such as
+// "plus=0.1,idn=0.05"; the kind all spreads its rate over every kind.
+func ParseAddressMix(spec string) (AddressMix, error) {
+	var mix AddressMix
+	total := 0.0
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("address mix %q is not kind=rate", pair)
+		}
+		kind := pair[:i]
+		rate, err := strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return nil, fmt.Errorf("rate of address kind %s must be above 0 and at most 1, got %q", kind, pair[i+1:])
+		}
+		total += rate
+
+		if kind == "all" {
+			for _, k := range AddressKinds {
+				mix = append(mix, AddressShare{Kind: k, Rate: rate / float64(len(AddressKinds))})
+			}
+			continue
+		}
+		known := false
+		for _, k := range AddressKinds {
+			known = known || k == kind
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown address kind %q, want one of %s or all", kind, strings.Join(AddressKinds, ", "))
+		}
+		mix = append(mix, AddressShare{Kind: kind, Rate: rate})
+	}
+	if total > 1 {
+		return nil, fmt.Errorf("address rates add up to %v, more than 1", total)
+	}
+	return mix, nil
+}
+
+// String returns the spec of the mix, as parsed by ParseAddressMix.
+func (m AddressMix) String() string {
+	pairs := make([]string, len(m))
+	for i, share := range m {
+		pairs[i] = share.Kind + "=" + strconv.FormatFloat(share.Rate, 'g', -1, 64)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// addresses returns the sender and recipient of a sender of a domain, of
+// kinds drawn from rnd.
+func (m AddressMix) addresses(rnd *rand.Rand, sender, domain int) (string, string) {
+	return m.address(rnd, "sender", sender, "sender", domain), m.address(rnd, "receiver", domain, "receiver", sender)
+}
+
+func (m AddressMix) address(rnd *rand.Rand, local string, localNumber int, domain string, domainNumber int) string {
+	kind := ""
+	f := rnd.Float64()
+	for _, share := range m {
+		if f < share.Rate {
+			kind = share.Kind
+			break
+		}
+		f -= share.Rate
+	}
+
+	local += strconv.Itoa(localNumber)
+	domain += strconv.Itoa(domainNumber)
+	switch kind {
+	case AddressUTF8:
+		local += "-" + utf8Words[localNumber%len(utf8Words)]
+	case AddressIDN:
+		domain += "-" + idnWords[domainNumber%len(idnWords)]
+	case AddressPunycode:
+		domain = ToASCII(domain + "-" + idnWords[domainNumber%len(idnWords)])
+	case AddressPlus:
+		local += "+tag" + strconv.Itoa(rnd.Intn(9)+1)
+	case AddressQuoted:
+		switch rnd.Intn(5) {
+		case 0:
+			// Quoted for no reason: the same mailbox as unquoted.
+			local = `"` + local + `"`
+		case 1:
+			local = `"` + strings.Replace(local, "r", "r ", 1) + `"`
+		case 2:
+			local = `"` + strings.Replace(local, "r", "r..", 1) + `"`
+		case 3:
+			local = `"` + strings.Replace(local, "r", `r\"`, 1) + `"`
+		default:
+			local = `"` + strings.Replace(local, "r", "r@", 1) + `"`
+		}
+	case AddressLong:
+		return longAddress(local, domain+".com")
+	case AddressMixedCase:
+		return mixCase(rnd, local+"@"+domain+".com")
+	case AddressSubdomain:
+		for n := rnd.Intn(4) + 2; n > 0; n-- {
+			domain = subLabels[rnd.Intn(len(subLabels))] + "." + domain
+		}
+	}
+	return local + "@" + domain + ".com"
+}
+
+// longAddress pads local to 64 octets, and prefixes domain with labels of up
+// to 63 octets until the address is 254 octets long.
+func longAddress(local, domain string) string {
+	local += "-" + strings.Repeat("x", 64-len(local)-1)
+	var prefix []string
+	for n := 254 - len(local) - 1 - len(domain); n > 0; {
+		// Each label takes a dot: leave none 1 octet short.
+		size := n - 1
+		if size > 63 {
+			size = 63
+		}
+		if n-size-1 == 1 {
+			size--
+		}
+		prefix = append(prefix, strings.Repeat("d", size))
+		n -= size + 1
+	}
+	prefix = append(prefix, domain)
+	return local + "@" + strings.Join(prefix, ".")
+}
+
+func mixCase(rnd *rand.Rand, s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' && rnd.Intn(2) == 0 {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	return string(b)
+}
+
+// ToASCII returns domain with its internationalized labels in punycode, as
+// xn-- labels (RFC 3492). Labels are expected in lower case.
+func ToASCII(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if utf8.RuneCountInString(label) != len(label) {
+			labels[i] = "xn--" + punycode(label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// Punycode parameters of RFC 3492.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+func punycode(label string) string {
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h := basic; h < len(runes); {
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
@@ -0,0 +1,125 @@
+package usagegen
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		domain, want string
+	}{
+		{"sender1.com", "sender1.com"},
+		{"bücher.com", "xn--bcher-kva.com"},
+		{"sender1-münchen.com", "xn--sender1-mnchen-osb.com"},
+		{"mail.пример.com", "mail.xn--e1afmkfd.com"},
+		{"δοκιμή", "xn--jxalpdlp"},
+		{"例え.jp", "xn--r8jz45g.jp"},
+	}
+	for _, tt := range tests {
+		if got := ToASCII(tt.domain); got != tt.want {
+			t.Errorf("ToASCII(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestParseAddressMix(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"plus=0.1, idn=0.05", "plus=0.1,idn=0.05", false},
+		{"all=0.8", "utf8=0.1,idn=0.1,punycode=0.1,plus=0.1,quoted=0.1,long=0.1,case=0.1,subdomain=0.1", false},
+		{"plus", "", true},
+		{"emoji=0.1", "", true},
+		{"plus=0", "", true},
+		{"plus=0.6,case=0.5", "", true},
+	}
+	for _, tt := range tests {
+		mix, err := ParseAddressMix(tt.spec)
+		if (err != nil) != tt.wantErr || mix.String() != tt.want {
+			t.Errorf("ParseAddressMix(%q) = %q, %v", tt.spec, mix, err)
+		}
+	}
+}
+
+func TestGenerator_Addresses(t *testing.T) {
+	opts := Options{Rows: 300, Seed: 3, Senders: 10, Domains: 10}
+	for _, kind := range AddressKinds {
+		mix, err := ParseAddressMix(kind + "=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Addresses = nil
+		plain := New(opts)
+		opts.Addresses = mix
+		g := New(opts)
+
+		for g.Next() && plain.Next() {
+			p, r := plain.Row().Record, g.Row().Record
+			// Addresses draw from their own source: the other columns are unchanged.
+			if strings.Join(p[2:], ",") != strings.Join(r[2:], ",") {
+				t.Fatalf("%s: %v, with addresses %v", kind, p, r)
+			}
+			for i, address := range r[:2] {
+				if err := checkKind(kind, address, p[i]); err != "" {
+					t.Fatalf("%s address %q of %q: %s", kind, address, p[i], err)
+				}
+			}
+		}
+	}
+}
+
+// checkKind returns what is wrong with address, of kind, for the plain address.
+func checkKind(kind, address, plain string) string {
+	at := strings.LastIndex(address, "@")
+	local, domain := address[:at], address[at+1:]
+	plainAt := strings.LastIndex(plain, "@")
+	plainLocal, plainDomain := plain[:plainAt], plain[plainAt+1:]
+
+	switch kind {
+	case AddressUTF8:
+		if !strings.HasPrefix(local, plainLocal+"-") || domain != plainDomain {
+			return "not a UTF-8 local part"
+		}
+	case AddressIDN, AddressPunycode:
+		name := strings.TrimSuffix(plainDomain, ".com")
+		number, _ := strconv.Atoi(strings.TrimLeft(name, "abcdefghijklmnopqrstuvwxyz"))
+		idn := name + "-" + idnWords[number%len(idnWords)]
+		if kind == AddressPunycode && !strings.HasPrefix(domain, "xn--") {
+			return "not in punycode"
+		}
+		if local != plainLocal || ToASCII(domain) != ToASCII(idn+".com") {
+			return "not the IDN domain " + idn
+		}
+	case AddressPlus:
+		if !strings.HasPrefix(local, plainLocal+"+tag") || domain != plainDomain {
+			return "no subaddress"
+		}
+	case AddressQuoted:
+		if local[0] != '"' || local[len(local)-1] != '"' || domain != plainDomain {
+			return "not quoted"
+		}
+	case AddressLong:
+		if len(address) != 254 || len(local) != 64 || !strings.HasSuffix(domain, "."+plainDomain) {
+			return "not at the limits"
+		}
+		for _, label := range strings.Split(domain, ".") {
+			if len(label) > 63 || label == "" {
+				return "invalid label " + label
+			}
+		}
+	case AddressMixedCase:
+		if strings.ToLower(address) != plain {
+			return "not the plain address"
+		}
+	case AddressSubdomain:
+		if local != plainLocal || strings.Count(domain, ".") < 3 || !strings.HasSuffix(domain, "."+plainDomain) {
+			return "no subdomains"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,342 @@
+package usagegen
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings of a Dialect.
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingWindows1252 = "windows-1252"
+	EncodingLatin1      = "iso-8859-1"
+	EncodingUTF16LE     = "utf-16le"
+)
+
+// Delimiters of a Dialect, by name.
+var Delimiters = map[string]string{
+	"comma":     ",",
+	"semicolon": ";",
+	"tab":       "\t",
+	"pipe":      "|",
+}
+
+// encodingAliases maps the accepted encoding names to the encodings.
+var encodingAliases = map[string]string{
+	"utf-8":        EncodingUTF8,
+	"utf8":         EncodingUTF8,
+	"windows-1252": EncodingWindows1252,
+	"cp1252":       EncodingWindows1252,
+	"iso-8859-1":   EncodingLatin1,
+	"latin1":       EncodingLatin1,
+	"utf-16le":     EncodingUTF16LE,
+	"utf16le":      EncodingUTF16LE,
+}
+
+// Dialect is the CSV dialect and character encoding of a usage file. The
+// zero value is the encoding/csv default: comma delimited, quoted as needed,
+// LF line endings, in UTF-8 without BOM.
+type Dialect struct {
+	// Delimiter is a single character, a comma if empty.
+	Delimiter string `json:"delimiter,omitempty"`
+	// AlwaysQuote quotes every field, empty ones included.
+	AlwaysQuote bool `json:"always_quote,omitempty"`
+	CRLF        bool `json:"crlf,omitempty"`
+	// BOM starts the file with a byte order mark, in UTF-8 or UTF-16LE.
+	BOM bool `json:"bom,omitempty"`
+	// Encoding is one of the Encoding constants, EncodingUTF8 if empty.
+	// Characters it cannot represent are written as '?'.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// ParseDialect returns the dialect of a delimiter, by character or name of
+// Delimiters, and an encoding name; empty for the defaults.
+func ParseDialect(delimiter, encoding string, alwaysQuote, crlf, bom bool) (Dialect, error) {
+	d := Dialect{AlwaysQuote: alwaysQuote, CRLF: crlf, BOM: bom}
+
+	if delimiter != "" && delimiter != "," && delimiter != "comma" {
+		d.Delimiter = Delimiters[strings.ToLower(delimiter)]
+		for _, c := range Delimiters {
+			if delimiter == c {
+				d.Delimiter = c
+			}
+		}
+		if d.Delimiter == "" {
+			return d, fmt.Errorf("unknown delimiter %q, want comma, semicolon, tab or pipe", delimiter)
+		}
+	}
+
+	if encoding != "" {
+		d.Encoding = encodingAliases[strings.ToLower(encoding)]
+		if d.Encoding == "" {
+			return d, fmt.Errorf("unknown encoding %q, want %s, %s, %s or %s", encoding, EncodingUTF8, EncodingWindows1252, EncodingLatin1, EncodingUTF16LE)
+		}
+		if d.Encoding == EncodingUTF8 {
+			d.Encoding = ""
+		}
+	}
+	if bom && d.Encoding != "" && d.Encoding != EncodingUTF16LE {
+		return d, fmt.Errorf("no byte order mark in %s", d.Encoding)
+	}
+	return d, nil
+}
+
+// IsDefault reports whether d writes as encoding/csv does.
+func (d Dialect) IsDefault() bool {
+	return d == Dialect{}
+}
+
+func (d Dialect) delimiter() byte {
+	if d.Delimiter == "" {
+		return ','
+	}
+	return d.Delimiter[0]
+}
+
+func (d Dialect) encoding() string {
+	if d.Encoding == "" {
+		return EncodingUTF8
+	}
+	return d.Encoding
+}
+
+// ContentType returns the media type of a usage file in d.
+func (d Dialect) ContentType() string {
+	return "text/csv; charset=" + d.encoding()
+}
+
+// byteOrderMark returns the BOM of d, if any.
+func (d Dialect) byteOrderMark() []byte {
+	if !d.BOM {
+		return nil
+	}
+	if d.Encoding == EncodingUTF16LE {
+		return []byte{0xff, 0xfe}
+	}
+	return []byte{0xef, 0xbb, 0xbf}
+}
+
+// AppendRecord appends the CSV line of record to dst, in UTF-8.
+func (d Dialect) AppendRecord(dst []byte, record []string) []byte {
+	comma := d.delimiter()
+	for i, field := range record {
+		if i > 0 {
+			dst = append(dst, comma)
+		}
+		if !d.AlwaysQuote && !d.needsQuotes(field) {
+			dst = append(dst, field...)
+			continue
+		}
+		dst = append(dst, '"')
+		dst = append(dst, strings.Replace(field, `"`, `""`, -1)...)
+		dst = append(dst, '"')
+	}
+	if d.CRLF {
+		return append(dst, '\r', '\n')
+	}
+	return append(dst, '\n')
+}
+
+// needsQuotes reports whether encoding/csv quotes field with the delimiter.
+func (d Dialect) needsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.IndexByte(field, d.delimiter()) >= 0 || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
+}
+
+// Encode appends the UTF-8 text s to dst in the encoding of d.
+func (d Dialect) Encode(dst, s []byte) []byte {
+	switch d.Encoding {
+	case "", EncodingUTF8:
+		return append(dst, s...)
+	case EncodingUTF16LE:
+		for len(s) > 0 {
+			r, size := utf8.DecodeRune(s)
+			s = s[size:]
+			if r >= 0x10000 {
+				r1, r2 := utf16.EncodeRune(r)
+				dst = append(dst, byte(r1), byte(r1>>8), byte(r2), byte(r2>>8))
+				continue
+			}
+			dst = append(dst, byte(r), byte(r>>8))
+		}
+		return dst
+	}
+
+	for len(s) > 0 {
+		r, size := utf8.DecodeRune(s)
+		s = s[size:]
+		switch {
+		case r < 0x80:
+			dst = append(dst, byte(r))
+		case d.Encoding == EncodingLatin1:
+			if r >= 0x100 {
+				r = '?'
+			}
+			dst = append(dst, byte(r))
+		case r >= 0xa0 && r < 0x100:
+			dst = append(dst, byte(r))
+		default:
+			dst = append(dst, windows1252Byte(r))
+		}
+	}
+	return dst
+}
+
+// windows1252 holds the characters of the bytes 0x80 to 0x9f in
+// Windows-1252; the five unassigned bytes stand for the C1 controls.
+var windows1252 = [32]rune{
+	0x20ac, 0x81, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x8d, 0x017d, 0x8f,
+	0x90, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x9d, 0x017e, 0x0178,
+}
+
+func windows1252Byte(r rune) byte {
+	for i, c := range windows1252 {
+		if c == r {
+			return byte(0x80 + i)
+		}
+	}
+	return '?'
+}
+
+// DialectWriter writes records in a Dialect, as csv.Writer does.
+type DialectWriter struct {
+	d       Dialect
+	w       *bufio.Writer
+	line    []byte
+	out     []byte
+	started bool
+	err     error
+}
+
+// NewWriter returns a DialectWriter writing to w.
+func (d Dialect) NewWriter(w io.Writer) *DialectWriter {
+	return &DialectWriter{d: d, w: bufio.NewWriter(w)}
+}
+
+// Write writes a record, after the byte order mark if it is the first.
+func (w *DialectWriter) Write(record []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.out = w.out[:0]
+	if !w.started {
+		w.out = append(w.out, w.d.byteOrderMark()...)
+		w.started = true
+	}
+	w.line = w.d.AppendRecord(w.line[:0], record)
+	w.out = w.d.Encode(w.out, w.line)
+	_, w.err = w.w.Write(w.out)
+	return w.err
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *DialectWriter) Flush() {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+}
+
+// Error reports any error of a previous Write or Flush.
+func (w *DialectWriter) Error() error {
+	return w.err
+}
+
+// NewReader returns a csv.Reader of a usage file in d, decoding it to UTF-8
+// without byte order mark.
+func (d Dialect) NewReader(r io.Reader) *csv.Reader {
+	reader := csv.NewReader(&decoder{d: d, r: bufio.NewReader(r), first: true})
+	reader.Comma = rune(d.delimiter())
+	return reader
+}
+
+// decoder decodes the encoding of a Dialect to UTF-8.
+type decoder struct {
+	d     Dialect
+	r     *bufio.Reader
+	raw   [4096]byte
+	out   []byte
+	first bool
+	err   error
+}
+
+func (dec *decoder) Read(p []byte) (int, error) {
+	for len(dec.out) == 0 {
+		if dec.err != nil {
+			return 0, dec.err
+		}
+		dec.fill()
+	}
+	n := copy(p, dec.out)
+	dec.out = dec.out[n:]
+	return n, nil
+}
+
+// fill decodes the next bytes into out.
+func (dec *decoder) fill() {
+	n, err := io.ReadAtLeast(dec.r, dec.raw[:], 1)
+	if err != nil {
+		dec.err = err
+		return
+	}
+	raw := dec.raw[:n]
+
+	switch dec.d.Encoding {
+	case "", EncodingUTF8:
+		dec.out = append(dec.out[:0], raw...)
+	case EncodingUTF16LE:
+		// Odd bytes and high surrogates wait for the rest of their character.
+		if n%2 == 1 {
+			if b, err := dec.r.ReadByte(); err == nil {
+				raw = append(raw, b)
+			}
+		}
+		units := make([]uint16, 0, len(raw)/2)
+		for i := 0; i+1 < len(raw); i += 2 {
+			units = append(units, uint16(raw[i])|uint16(raw[i+1])<<8)
+		}
+		if last := len(units) - 1; last >= 0 && utf16.IsSurrogate(rune(units[last])) && units[last] < 0xdc00 {
+			if b, err := dec.r.Peek(2); err == nil {
+				units = append(units, uint16(b[0])|uint16(b[1])<<8)
+				dec.r.Discard(2) // nolint:errcheck
+			}
+		}
+		dec.out = dec.out[:0]
+		for _, r := range utf16.Decode(units) {
+			dec.out = appendRune(dec.out, r)
+		}
+	default:
+		dec.out = dec.out[:0]
+		for _, b := range raw {
+			if b >= 0x80 && b < 0xa0 && dec.d.Encoding == EncodingWindows1252 {
+				dec.out = appendRune(dec.out, windows1252[b-0x80])
+			} else {
+				dec.out = appendRune(dec.out, rune(b))
+			}
+		}
+	}
+
+	if dec.first {
+		dec.first = false
+		dec.out = []byte(strings.TrimPrefix(string(dec.out), "\ufeff"))
+	}
+}
+
+func appendRune(dst []byte, r rune) []byte {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	return append(dst, buf[:n]...)
+}
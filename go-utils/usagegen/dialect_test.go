@@ -0,0 +1,121 @@
+package usagegen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDialect(t *testing.T) {
+	tests := []struct {
+		delimiter, encoding string
+		bom                 bool
+		want                Dialect
+		wantErr             bool
+	}{
+		{"", "", false, Dialect{}, false},
+		{"comma", "UTF-8", false, Dialect{}, false},
+		{"semicolon", "cp1252", false, Dialect{Delimiter: ";", Encoding: EncodingWindows1252}, false},
+		{"\t", "latin1", false, Dialect{Delimiter: "\t", Encoding: EncodingLatin1}, false},
+		{"Pipe", "utf-16le", true, Dialect{Delimiter: "|", Encoding: EncodingUTF16LE, BOM: true}, false},
+		{"", "", true, Dialect{BOM: true}, false},
+		{"colon", "", false, Dialect{}, true},
+		{"", "ebcdic", false, Dialect{}, true},
+		{"", "windows-1252", true, Dialect{}, true},
+	}
+	for _, tt := range tests {
+		d, err := ParseDialect(tt.delimiter, tt.encoding, false, false, tt.bom)
+		if (err != nil) != tt.wantErr || (err == nil && d != tt.want) {
+			t.Errorf("ParseDialect(%q, %q, %v) = %+v, %v", tt.delimiter, tt.encoding, tt.bom, d, err)
+		}
+	}
+}
+
+func TestDialect_AppendRecord(t *testing.T) {
+	record := []string{"a", "", "b,c", `say "hi"`, " lead", `\.`, "x;y", "line\nbreak"}
+
+	// The default dialect writes as encoding/csv.
+	var want bytes.Buffer
+	cw := csv.NewWriter(&want)
+	cw.Write(record) // nolint:errcheck
+	cw.Flush()
+	if got := (Dialect{}).AppendRecord(nil, record); string(got) != want.String() {
+		t.Errorf("default dialect: %q, want %q", got, want.String())
+	}
+
+	d := Dialect{Delimiter: ";", AlwaysQuote: true, CRLF: true}
+	if got, want := string(d.AppendRecord(nil, record[:5])), `"a";"";"b,c";"say ""hi""";" lead"`+"\r\n"; got != want {
+		t.Errorf("always quoted: %q, want %q", got, want)
+	}
+	if got, want := string((Dialect{Delimiter: ";"}).AppendRecord(nil, []string{"b,c", "x;y"})), `b,c;"x;y"`+"\n"; got != want {
+		t.Errorf("semicolon: %q, want %q", got, want)
+	}
+}
+
+func TestDialect_Encode(t *testing.T) {
+	text := "é€Ж"
+	tests := []struct {
+		d    Dialect
+		want []byte
+	}{
+		{Dialect{}, []byte(text)},
+		{Dialect{Encoding: EncodingWindows1252}, []byte{0xe9, 0x80, '?'}},
+		{Dialect{Encoding: EncodingLatin1}, []byte{0xe9, '?', '?'}},
+		{Dialect{Encoding: EncodingUTF16LE}, []byte{0xe9, 0x00, 0xac, 0x20, 0x16, 0x04}},
+	}
+	for _, tt := range tests {
+		if got := tt.d.Encode(nil, []byte(text)); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: % x, want % x", tt.d.ContentType(), got, tt.want)
+		}
+	}
+}
+
+func TestDialect_RoundTrip(t *testing.T) {
+	mix, err := ParseAddressMix("utf8=0.5,quoted=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Rows: 200, Seed: 11, Senders: 10, Domains: 10, Addresses: mix}
+
+	for _, d := range []Dialect{
+		{},
+		{Delimiter: "\t", AlwaysQuote: true, CRLF: true, BOM: true},
+		{Delimiter: "|", Encoding: EncodingWindows1252},
+		{Delimiter: ";", Encoding: EncodingLatin1},
+		{BOM: true, Encoding: EncodingUTF16LE},
+	} {
+		opts.Dialect = d
+		var buf bytes.Buffer
+		if _, err := WriteCSV(&buf, opts); err != nil {
+			t.Fatal(err)
+		}
+		if bom := d.byteOrderMark(); !bytes.HasPrefix(buf.Bytes(), bom) {
+			t.Errorf("%+v: no byte order mark % x", d, bom)
+		}
+
+		records, err := d.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatalf("%+v: %v", d, err)
+		}
+		if !reflect.DeepEqual(records[0], Header) {
+			t.Errorf("%+v: header %q", d, records[0])
+		}
+
+		// Characters out of the encoding are replaced, in both.
+		replace := func(s string) string {
+			return string(d.Encode(nil, []byte(s)))
+		}
+		if d.Encoding == EncodingUTF16LE {
+			replace = func(s string) string { return s }
+		}
+		g := New(opts)
+		for i := 1; g.Next(); i++ {
+			want := strings.Join(g.Row().Record, "|")
+			if got := strings.Join(records[i], "|"); replace(got) != replace(want) {
+				t.Fatalf("%+v: row %d %q, want %q", d, i, got, want)
+			}
+		}
+	}
+}
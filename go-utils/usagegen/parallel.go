@@ -0,0 +1,351 @@
+package usagegen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ChunkRows is the number of rows generated at a time by WriteCSVParallel.
+const ChunkRows = 4096
+
+// Largest Senders×Domains for which WriteCSVParallel precomputes the addresses.
+const maxPool = 1 << 16
+
+// chunkBuffers holds the CSV buffers of the chunks, reused across calls.
+var chunkBuffers = sync.Pool{
+	New: func() interface{} { return make([]byte, 0, ChunkRows*160) },
+}
+
+// WriteCSVParallel writes the rows of opts to w as WriteCSV does, generating
+// chunks of ChunkRows rows on workers goroutines, NumCPU if not positive, and
+// writing them in order. Each chunk has its own random source derived from
+// opts.Seed, so the output depends on the seed only, not on workers, but
+// differs from the rows of a Generator.
+//
+// If onRow is set it is called with every row, in order, before its chunk is
+// written; an error stops the generation.
+func WriteCSVParallel(w io.Writer, opts Options, workers int, onRow func(Row) error) (int, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	p := newPlan(opts, onRow != nil)
+
+	out := bufio.NewWriterSize(w, 256*1024)
+	if _, err := out.Write(p.header); err != nil {
+		return 0, err
+	}
+
+	// Chunks are started in order and their results queued in that order, at
+	// most workers ahead of the writer.
+	order := make(chan chan *chunk, workers)
+	done := make(chan struct{})
+	go func() {
+		defer close(order)
+		sem := make(chan struct{}, workers)
+		for c := 0; c*ChunkRows < opts.Rows-opts.Skip; c++ {
+			result := make(chan *chunk, 1)
+			select {
+			case order <- result:
+			case <-done:
+				return
+			}
+			sem <- struct{}{}
+			go func(c int) {
+				defer func() { <-sem }()
+				result <- p.generate(c)
+			}(c)
+		}
+	}()
+
+	var err error
+	stopped := false
+	rows := 0
+	for result := range order {
+		c := <-result
+		if err == nil && onRow != nil {
+			for _, row := range c.rows {
+				if err = onRow(row); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			_, err = out.Write(c.csv)
+			rows += c.n
+		}
+		p.release(c)
+
+		if err != nil && !stopped {
+			close(done)
+			stopped = true
+		}
+	}
+	if err != nil {
+		return rows, err
+	}
+	return rows, out.Flush()
+}
+
+type chunk struct {
+	n    int
+	csv  []byte
+	rows []Row
+}
+
+// plan holds what the chunks of a WriteCSVParallel share.
+type plan struct {
+	opts     Options
+	minutes  int64
+	keepRows bool
+
+	header []byte
+	// Policy and delivery columns, the same for every row.
+	tail []byte
+
+	// Precomputed "sender,recipient," of sender s and domain d at
+	// pairs[(s-1)*Domains+d-1], and ",subject" of domain d at subjects[d-1].
+	pairs    [][]byte
+	subjects [][]byte
+
+	// The row repeated by the spam rows, and its custom columns.
+	spam       Row
+	spamCustom custom
+
+	// Custom timestamps, nil for FormatDate.
+	stamps *stamps
+}
+
+// custom holds the columns of a row that are not precomputed: the timestamp
+// with stamps, and the addresses with an address mix.
+type custom struct {
+	stamp             string
+	sender, recipient string
+}
+
+func newPlan(opts Options, keepRows bool) *plan {
+	g := New(opts)
+	p := &plan{opts: g.opts, minutes: g.minutes, keepRows: keepRows, stamps: g.stamps}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(Header) // nolint:errcheck
+	cw.Flush()
+	p.header = append([]byte(nil), buf.Bytes()...)
+	if !opts.Dialect.IsDefault() {
+		p.header = opts.Dialect.Encode(opts.Dialect.byteOrderMark(), opts.Dialect.AppendRecord(nil, Header))
+	}
+
+	buf.Reset()
+	cw.Write([]string{"", PolicyTypes, PolicyNames, DeliveryMethod}) // nolint:errcheck
+	cw.Flush()
+	p.tail = append([]byte(nil), buf.Bytes()...)
+
+	if opts.Senders > 0 && opts.Domains > 0 && opts.Senders*opts.Domains <= maxPool && opts.Addresses == nil && opts.Dialect.IsDefault() {
+		// All in one arena, rather than an allocation each.
+		arena := make([]byte, 0, (opts.Senders*opts.Domains+opts.Domains)*48)
+		p.pairs = make([][]byte, opts.Senders*opts.Domains)
+		for s := 1; s <= opts.Senders; s++ {
+			for d := 1; d <= opts.Domains; d++ {
+				start := len(arena)
+				arena = appendAddresses(arena, s, d)
+				p.pairs[(s-1)*opts.Domains+d-1] = arena[start:len(arena):len(arena)]
+			}
+		}
+		p.subjects = make([][]byte, opts.Domains)
+		for d := 1; d <= opts.Domains; d++ {
+			start := len(arena)
+			arena = appendSubject(arena, d)
+			p.subjects[d-1] = arena[start:len(arena):len(arena)]
+		}
+	}
+
+	// The spam row comes from a source of its own, as its chunk may not
+	// be the one of the first spam row.
+	if p.opts.Spams > 0 {
+		index := p.opts.SpamStart + p.opts.FirstIndex - 1
+		p.spam = p.random(rand.New(rand.NewSource(p.opts.Seed-1)), p.opts.SpamStart-1, index)
+		p.spam.Spam = true
+		if p.stamps != nil {
+			p.spam.Date, p.spamCustom.stamp = p.stamps.stamp(rand.New(rand.NewSource((p.opts.Seed-1)^stampSalt)), p.spam.Date)
+		}
+		if p.opts.Addresses != nil {
+			p.spamCustom.sender, p.spamCustom.recipient = p.opts.Addresses.addresses(rand.New(rand.NewSource((p.opts.Seed-1)^addressSalt)), p.spam.Sender, p.spam.Domain)
+		}
+	}
+	return p
+}
+
+// random draws the row r of index, as a Generator does.
+func (p *plan) random(rnd *rand.Rand, r, index int) Row {
+	row := Row{Number: r + 1, Index: index, Sender: index, Domain: index}
+	row.Date = drawDate(rnd, p.opts.Start, p.minutes)
+	if p.opts.Domains > 0 {
+		row.Domain = rnd.Intn(p.opts.Domains) + 1
+	}
+	if p.opts.Senders > 0 {
+		row.Sender = rnd.Intn(p.opts.Senders) + 1
+	}
+	return row
+}
+
+func (p *plan) generate(c int) *chunk {
+	lo := p.opts.Skip + c*ChunkRows
+	hi := lo + ChunkRows
+	if hi > p.opts.Rows {
+		hi = p.opts.Rows
+	}
+
+	rnd := rand.New(rand.NewSource(p.opts.Seed + int64(c)<<32))
+	var stampRnd, addrRnd *rand.Rand
+	if p.stamps != nil {
+		stampRnd = rand.New(rand.NewSource((p.opts.Seed + int64(c)<<32) ^ stampSalt))
+	}
+	if p.opts.Addresses != nil {
+		addrRnd = rand.New(rand.NewSource((p.opts.Seed + int64(c)<<32) ^ addressSalt))
+	}
+	result := &chunk{n: hi - lo, csv: chunkBuffers.Get().([]byte)[:0]}
+	if p.keepRows {
+		result.rows = make([]Row, 0, hi-lo)
+	}
+
+	// Lines in another dialect are encoded from their record.
+	dialect := !p.opts.Dialect.IsDefault()
+	var line []byte
+
+	spamFirst, spamEnd := p.opts.SpamStart-1, p.opts.SpamStart-1+p.opts.Spams
+	for r := lo; r < hi; r++ {
+		var row Row
+		var cols custom
+		if p.opts.Spams > 0 && r >= spamFirst && r < spamEnd {
+			row = p.spam
+			row.Number = r + 1
+			cols = p.spamCustom
+		} else {
+			row = p.random(rnd, r, RowIndex(r, p.opts.Spams, p.opts.SpamStart)+p.opts.FirstIndex-1)
+			if p.stamps != nil {
+				row.Date, cols.stamp = p.stamps.stamp(stampRnd, row.Date)
+			}
+			if addrRnd != nil {
+				cols.sender, cols.recipient = p.opts.Addresses.addresses(addrRnd, row.Sender, row.Domain)
+			}
+		}
+
+		if !dialect {
+			result.csv = p.appendRow(result.csv, row, cols)
+		}
+		if p.keepRows || dialect {
+			if p.stamps == nil {
+				cols.stamp = FormatDate(row.Date)
+			}
+			row.Record = NewRecord(row.Sender, row.Domain, cols.stamp)
+			if p.opts.Addresses != nil {
+				row.Record[0], row.Record[1] = cols.sender, cols.recipient
+			}
+		}
+		if dialect {
+			line = p.opts.Dialect.AppendRecord(line[:0], row.Record)
+			result.csv = p.opts.Dialect.Encode(result.csv, line)
+		}
+		if p.keepRows {
+			result.rows = append(result.rows, row)
+		}
+	}
+	return result
+}
+
+func (p *plan) release(c *chunk) {
+	chunkBuffers.Put(c.csv[:0]) // nolint:staticcheck
+}
+
+// appendRow appends the CSV line of row, as encoding/csv writes it, with
+// its custom columns.
+func (p *plan) appendRow(dst []byte, row Row, cols custom) []byte {
+	switch {
+	case p.opts.Addresses != nil:
+		dst = append(appendField(dst, cols.sender), ',')
+		dst = append(appendField(dst, cols.recipient), ',')
+	case p.pairs != nil:
+		dst = append(dst, p.pairs[(row.Sender-1)*p.opts.Domains+row.Domain-1]...)
+	default:
+		dst = appendAddresses(dst, row.Sender, row.Domain)
+	}
+
+	if p.stamps != nil {
+		dst = appendField(dst, cols.stamp)
+	} else {
+		dst = appendDate(dst, row.Date)
+	}
+
+	if p.subjects != nil {
+		dst = append(dst, p.subjects[row.Domain-1]...)
+	} else {
+		dst = appendSubject(dst, row.Domain)
+	}
+	return append(dst, p.tail...)
+}
+
+// appendAddresses appends the sender and recipient columns, with their commas.
+func appendAddresses(dst []byte, sender, domain int) []byte {
+	dst = append(dst, "sender"...)
+	dst = strconv.AppendInt(dst, int64(sender), 10)
+	dst = append(dst, "@sender"...)
+	dst = strconv.AppendInt(dst, int64(domain), 10)
+	dst = append(dst, ".com,receiver"...)
+	dst = strconv.AppendInt(dst, int64(domain), 10)
+	dst = append(dst, "@receiver"...)
+	dst = strconv.AppendInt(dst, int64(sender), 10)
+	return append(dst, ".com,"...)
+}
+
+// appendDate appends t as FormatDate does.
+func appendDate(dst []byte, t time.Time) []byte {
+	year, month, day := t.Date()
+	hour, minute, _ := t.Clock()
+	dst = strconv.AppendInt(dst, int64(day), 10)
+	dst = append(dst, '/')
+	dst = strconv.AppendInt(dst, int64(month), 10)
+	dst = append(dst, '/')
+	dst = strconv.AppendInt(dst, int64(year), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(hour), 10)
+	dst = append(dst, ':')
+	return strconv.AppendInt(dst, int64(minute), 10)
+}
+
+// appendField appends field, quoted as encoding/csv does if needed.
+func appendField(dst []byte, field string) []byte {
+	if !fieldNeedsQuotes(field) {
+		return append(dst, field...)
+	}
+	dst = append(dst, '"')
+	dst = append(dst, strings.Replace(field, `"`, `""`, -1)...)
+	return append(dst, '"')
+}
+
+// fieldNeedsQuotes reports whether encoding/csv quotes field.
+func fieldNeedsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.ContainsAny(field, "\",\r\n") {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
+}
+
+// appendSubject appends the subject column, with its leading comma.
+func appendSubject(dst []byte, domain int) []byte {
+	dst = append(dst, ",Hello "...)
+	return strconv.AppendInt(dst, int64(domain), 10)
+}
@@ -0,0 +1,177 @@
+package usagegen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// benchRows is the number of rows written by each benchmark iteration.
+const benchRows = 60000
+
+func TestWriteCSVParallel(t *testing.T) {
+	mixed, err := MixedFormats("Europe/Paris", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses, err := ParseAddressMix("all=0.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"indexed", Options{Rows: 10000, Seed: 1}},
+		{"random pooled", Options{Rows: 3 * ChunkRows, Seed: 2, Senders: 150, Domains: 80}},
+		{"random unpooled", Options{Rows: 100, Seed: 3, Senders: 1000, Domains: 1000}},
+		{"spam across chunks", Options{Rows: 2*ChunkRows + 10, Seed: 4, Spams: ChunkRows, SpamStart: ChunkRows - 5}},
+		{"continued and skipped", Options{Rows: ChunkRows + 100, Skip: 50, Seed: 5, Spams: 3, SpamStart: 60, FirstIndex: 1000}},
+		{"empty", Options{Seed: 6}},
+		{"mixed timestamps", Options{Rows: ChunkRows + 10, Seed: 7, Spams: 5, SpamStart: 3, Formats: mixed}},
+		{"dst overlap", Options{Rows: 200, Seed: 8, Formats: mixed[:1], DST: DSTOverlap, DSTRate: 0.5}},
+		{"edge-case addresses", Options{Rows: ChunkRows + 10, Seed: 9, Spams: 5, SpamStart: 3, Senders: 20, Domains: 20, Addresses: addresses}},
+		{"dialect", Options{Rows: ChunkRows + 10, Seed: 10, Spams: 5, SpamStart: 3, Senders: 20, Domains: 20, Addresses: addresses, Formats: mixed,
+			Dialect: Dialect{Delimiter: ";", AlwaysQuote: true, CRLF: true, BOM: true, Encoding: EncodingUTF16LE}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			firstIndex := tt.opts.FirstIndex
+			if firstIndex == 0 {
+				firstIndex = 1
+			}
+
+			var buf bytes.Buffer
+			var rows []Row
+			n, err := WriteCSVParallel(&buf, tt.opts, 3, func(row Row) error {
+				rows = append(rows, row)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.opts.Rows - tt.opts.Skip; n != want || len(rows) != want {
+				t.Fatalf("%d rows, %d passed to onRow, want %d", n, len(rows), want)
+			}
+
+			// The lines are encoded as encoding/csv, or a DialectWriter,
+			// does from the rows passed to onRow.
+			var want bytes.Buffer
+			var cw interface {
+				Write([]string) error
+				Flush()
+			}
+			if cw = csv.NewWriter(&want); !tt.opts.Dialect.IsDefault() {
+				cw = tt.opts.Dialect.NewWriter(&want)
+			}
+			cw.Write(Header) // nolint:errcheck
+			for i, row := range rows {
+				cw.Write(row.Record) // nolint:errcheck
+				if row.Number != tt.opts.Skip+i+1 {
+					t.Fatalf("row %d: number %d", i, row.Number)
+				}
+				if wantIndex := RowIndex(row.Number-1, tt.opts.Spams, tt.opts.SpamStart) + firstIndex - 1; tt.opts.Senders == 0 && (row.Index != wantIndex || row.Sender != wantIndex) {
+					t.Fatalf("row %d: index %d, sender %d, want %d", row.Number, row.Index, row.Sender, wantIndex)
+				}
+				if row.Spam && !reflect.DeepEqual(row.Record, rows[i-1].Record) && rows[i-1].Spam {
+					t.Fatalf("row %d: spam differs from the previous row", row.Number)
+				}
+			}
+			cw.Flush()
+			if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+				t.Errorf("output differs from encoding/csv")
+			}
+
+			// The output does not depend on the number of workers.
+			var single bytes.Buffer
+			if _, err := WriteCSVParallel(&single, tt.opts, 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), single.Bytes()) {
+				t.Errorf("output differs with one worker")
+			}
+		})
+	}
+}
+
+func TestWriteCSVParallel_Spam(t *testing.T) {
+	opts := Options{Rows: 20, Seed: 1, Spams: 4, SpamStart: 3}
+	var spam []int
+	_, err := WriteCSVParallel(ioutil.Discard, opts, 2, func(row Row) error {
+		if row.Spam {
+			spam = append(spam, row.Number)
+		}
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(spam, []int{3, 4, 5, 6}) {
+		t.Errorf("spam rows %v, %v", spam, err)
+	}
+}
+
+func TestWriteCSVParallel_Error(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	n, err := WriteCSVParallel(ioutil.Discard, Options{Rows: 20 * ChunkRows, Seed: 1}, 2, func(row Row) error {
+		calls++
+		if row.Number == ChunkRows+1 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != ChunkRows || calls != ChunkRows+1 {
+		t.Errorf("got %d rows, %d calls, %v", n, calls, err)
+	}
+}
+
+func TestWriteCSVParallel_Speedup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures throughput")
+	}
+
+	// Relative to WriteCSV on the same machine, so that a slow or loaded
+	// one slows both alike.
+	parallel := testing.Benchmark(BenchmarkWriteCSVParallel)
+	sequential := testing.Benchmark(BenchmarkWriteCSVParallel_Sequential)
+	if parallel.NsPerOp() >= sequential.NsPerOp() {
+		t.Errorf("WriteCSVParallel takes %v per %d rows, WriteCSV %v", time.Duration(parallel.NsPerOp()), benchRows, time.Duration(sequential.NsPerOp()))
+	}
+}
+
+// benchmarkWrite runs write b.N times on benchRows rows.
+func benchmarkWrite(b *testing.B, write func(Options) error) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := write(Options{Rows: benchRows, Seed: int64(i), Senders: 150, Domains: 150}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteCSVParallel_Sequential writes the rows of
+// BenchmarkWriteCSVParallel with WriteCSV.
+func BenchmarkWriteCSVParallel_Sequential(b *testing.B) {
+	benchmarkWrite(b, func(opts Options) error {
+		_, err := WriteCSV(ioutil.Discard, opts)
+		return err
+	})
+}
+
+func BenchmarkWriteCSVParallel(b *testing.B) {
+	benchmarkWrite(b, func(opts Options) error {
+		_, err := WriteCSVParallel(ioutil.Discard, opts, 0, nil)
+		return err
+	})
+}
+
+func BenchmarkWriteCSVParallel_Corpus(b *testing.B) {
+	benchmarkWrite(b, func(opts Options) error {
+		_, err := WriteCSVParallel(ioutil.Discard, opts, 0, func(Row) error { return nil })
+		return err
+	})
+}
@@ -0,0 +1,404 @@
+package usagegen
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLayout is the strftime pattern of DateFormat, which no Go layout
+// can express: day, month, hour and minute are not padded.
+const DefaultLayout = "%-d/%-m/%Y %-H:%-M"
+
+// DST modes, generating send dates in the DST transitions of the zone.
+const (
+	// DSTGap dates are wall clock times skipped when the clocks go forward.
+	DSTGap = "gap"
+	// DSTOverlap dates are wall clock times repeated when the clocks go back.
+	DSTOverlap = "overlap"
+)
+
+// MixedLayouts are the layouts of the vendors seen so far, mixed across rows
+// by MixedFormats to expose fragile parsers.
+var MixedLayouts = []string{
+	DefaultLayout,
+	"%d/%m/%Y %H:%M",
+	"%m/%d/%Y %I:%M %p",
+	time.RFC3339,
+	"%d %b %Y %H:%M",
+	"%b %e, %Y %-I:%M %p",
+	"%Y-%m-%d %H:%M:%S %Z",
+}
+
+// TimestampFormat formats send dates with a Go time layout or a strftime
+// pattern, in a time zone.
+type TimestampFormat struct {
+	// Layout is the Go layout or strftime pattern, as given.
+	Layout   string
+	Location *time.Location
+	// OffsetSuffix appends the UTC offset, as " +02:00".
+	OffsetSuffix bool
+
+	strftime []strftimeToken
+}
+
+// strftimeToken is a literal, or a directive if verb is set.
+type strftimeToken struct {
+	literal string
+	verb    byte
+	nopad   bool
+}
+
+// NewTimestampFormat constructs a TimestampFormat. The layout is a strftime
+// pattern if it contains %, a Go layout otherwise, DefaultLayout if empty.
+// The zone is an IANA name, UTC if empty.
+func NewTimestampFormat(layout, zone string, offsetSuffix bool) (*TimestampFormat, error) {
+	if layout == "" {
+		layout = DefaultLayout
+	}
+	f := &TimestampFormat{Layout: layout, Location: time.UTC, OffsetSuffix: offsetSuffix}
+
+	if zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q: %v", zone, err)
+		}
+		f.Location = loc
+	}
+
+	if strings.Contains(layout, "%") {
+		tokens, err := parseStrftime(layout)
+		if err != nil {
+			return nil, err
+		}
+		f.strftime = tokens
+	} else if reference := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC); reference.Format(layout) == layout {
+		return nil, fmt.Errorf("layout %q has no date or time element", layout)
+	}
+	return f, nil
+}
+
+// MixedFormats returns the formats of MixedLayouts in the zone.
+func MixedFormats(zone string, offsetSuffix bool) ([]*TimestampFormat, error) {
+	formats := make([]*TimestampFormat, len(MixedLayouts))
+	for i, layout := range MixedLayouts {
+		f, err := NewTimestampFormat(layout, zone, offsetSuffix)
+		if err != nil {
+			return nil, err
+		}
+		formats[i] = f
+	}
+	return formats, nil
+}
+
+// ParseFormats returns the format of layout, or the MixedFormats if mix, in
+// zone; nil for FormatDate if all are unset.
+func ParseFormats(layout, zone string, offsetSuffix, mix bool) ([]*TimestampFormat, error) {
+	if mix {
+		if layout != "" {
+			return nil, fmt.Errorf("a layout cannot be set with mixed formats")
+		}
+		return MixedFormats(zone, offsetSuffix)
+	}
+	if layout == "" && zone == "" && !offsetSuffix {
+		return nil, nil
+	}
+	f, err := NewTimestampFormat(layout, zone, offsetSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return []*TimestampFormat{f}, nil
+}
+
+// CheckDST returns an error if the DST mode of opts is unknown, or if the
+// zone has no such transition within the window.
+func CheckDST(opts Options) error {
+	if opts.DST == "" {
+		return nil
+	}
+	if opts.DST != DSTGap && opts.DST != DSTOverlap {
+		return fmt.Errorf("unknown DST mode %q, want %s or %s", opts.DST, DSTGap, DSTOverlap)
+	}
+	if opts.DSTRate <= 0 || opts.DSTRate > 1 {
+		return fmt.Errorf("DST rate %v must be above 0 and at most 1", opts.DSTRate)
+	}
+	if g := New(opts); len(g.stamps.dst) == 0 {
+		return fmt.Errorf("no DST %s in %s between %s and %s", opts.DST, g.stamps.formats[0].Location, g.opts.Start.Format("2006-01-02"), g.opts.End.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// Format formats t in the zone of f.
+func (f *TimestampFormat) Format(t time.Time) string {
+	return f.format(t.In(f.Location))
+}
+
+// format formats t in its own location.
+func (f *TimestampFormat) format(t time.Time) string {
+	var s string
+	if f.strftime != nil {
+		s = string(appendStrftime(nil, f.strftime, t))
+	} else {
+		s = t.Format(f.Layout)
+	}
+	if f.OffsetSuffix {
+		s += " " + t.Format("-07:00")
+	}
+	return s
+}
+
+// Parse parses a timestamp formatted by f, in the zone of f unless the
+// timestamp has an offset of its own.
+func (f *TimestampFormat) Parse(s string) (time.Time, error) {
+	layout := f.Layout
+	if f.strftime != nil {
+		var err error
+		if layout, err = goLayout(f.strftime); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if f.OffsetSuffix {
+		layout += " -07:00"
+	}
+	return time.ParseInLocation(layout, s, f.Location)
+}
+
+// goLayout returns the Go layout parsing the timestamps of a strftime pattern.
+func goLayout(tokens []strftimeToken) (string, error) {
+	elements := map[byte][2]string{
+		'Y': {"2006", "2006"},
+		'y': {"06", "06"},
+		'm': {"01", "1"},
+		'd': {"02", "2"},
+		'e': {"_2", "2"},
+		'H': {"15", "15"},
+		'I': {"03", "3"},
+		'M': {"04", "4"},
+		'S': {"05", "5"},
+		'p': {"PM", "PM"},
+		'b': {"Jan", "Jan"},
+		'B': {"January", "January"},
+		'a': {"Mon", "Mon"},
+		'A': {"Monday", "Monday"},
+		'z': {"-0700", "-0700"},
+		'Z': {"MST", "MST"},
+		'F': {"2006-01-02", "2006-01-02"},
+		'T': {"15:04:05", "15:04:05"},
+		'%': {"%", "%"},
+	}
+	reference := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	var b strings.Builder
+	for _, tok := range tokens {
+		if tok.verb == 0 {
+			if reference.Format(tok.literal) != tok.literal {
+				return "", fmt.Errorf("strftime literal %q cannot be parsed", tok.literal)
+			}
+			b.WriteString(tok.literal)
+			continue
+		}
+		element, ok := elements[tok.verb]
+		if !ok {
+			return "", fmt.Errorf("strftime directive %%%c cannot be parsed", tok.verb)
+		}
+		if tok.nopad {
+			b.WriteString(element[1])
+		} else {
+			b.WriteString(element[0])
+		}
+	}
+	return b.String(), nil
+}
+
+func parseStrftime(pattern string) ([]strftimeToken, error) {
+	var tokens []strftimeToken
+	for len(pattern) > 0 {
+		i := strings.IndexByte(pattern, '%')
+		if i < 0 {
+			tokens = append(tokens, strftimeToken{literal: pattern})
+			break
+		}
+		if i > 0 {
+			tokens = append(tokens, strftimeToken{literal: pattern[:i]})
+		}
+		pattern = pattern[i+1:]
+
+		var token strftimeToken
+		if strings.HasPrefix(pattern, "-") {
+			token.nopad = true
+			pattern = pattern[1:]
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("strftime pattern ends with %%")
+		}
+		token.verb = pattern[0]
+		pattern = pattern[1:]
+		if !strings.ContainsRune("YymdeHIMSpbBaAjzZFT%", rune(token.verb)) {
+			return nil, fmt.Errorf("unsupported strftime directive %%%c", token.verb)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func appendStrftime(dst []byte, tokens []strftimeToken, t time.Time) []byte {
+	number := func(dst []byte, n, width int, nopad bool, pad byte) []byte {
+		s := strconv.Itoa(n)
+		for i := len(s); i < width && !nopad; i++ {
+			dst = append(dst, pad)
+		}
+		return append(dst, s...)
+	}
+
+	for _, tok := range tokens {
+		if tok.verb == 0 {
+			dst = append(dst, tok.literal...)
+			continue
+		}
+		switch tok.verb {
+		case 'Y':
+			dst = number(dst, t.Year(), 4, tok.nopad, '0')
+		case 'y':
+			dst = number(dst, t.Year()%100, 2, tok.nopad, '0')
+		case 'm':
+			dst = number(dst, int(t.Month()), 2, tok.nopad, '0')
+		case 'd':
+			dst = number(dst, t.Day(), 2, tok.nopad, '0')
+		case 'e':
+			dst = number(dst, t.Day(), 2, tok.nopad, ' ')
+		case 'H':
+			dst = number(dst, t.Hour(), 2, tok.nopad, '0')
+		case 'I':
+			hour := t.Hour() % 12
+			if hour == 0 {
+				hour = 12
+			}
+			dst = number(dst, hour, 2, tok.nopad, '0')
+		case 'M':
+			dst = number(dst, t.Minute(), 2, tok.nopad, '0')
+		case 'S':
+			dst = number(dst, t.Second(), 2, tok.nopad, '0')
+		case 'j':
+			dst = number(dst, t.YearDay(), 3, tok.nopad, '0')
+		case 'p':
+			dst = append(dst, t.Format("PM")...)
+		case 'b':
+			dst = append(dst, t.Format("Jan")...)
+		case 'B':
+			dst = append(dst, t.Format("January")...)
+		case 'a':
+			dst = append(dst, t.Format("Mon")...)
+		case 'A':
+			dst = append(dst, t.Format("Monday")...)
+		case 'z':
+			dst = append(dst, t.Format("-0700")...)
+		case 'Z':
+			dst = append(dst, t.Format("MST")...)
+		case 'F':
+			dst = append(dst, t.Format("2006-01-02")...)
+		case 'T':
+			dst = append(dst, t.Format("15:04:05")...)
+		case '%':
+			dst = append(dst, '%')
+		}
+	}
+	return dst
+}
+
+// Transition is a change of the UTC offset of a zone.
+type Transition struct {
+	At time.Time
+	// Offsets before and after, in seconds east of UTC, and the zone
+	// abbreviation before.
+	Before, After int
+	BeforeName    string
+}
+
+// Transitions returns the offset changes of loc from start until end.
+func Transitions(loc *time.Location, start, end time.Time) []Transition {
+	var transitions []Transition
+	_, offset := start.In(loc).Zone()
+	for t := start; t.Before(end); {
+		next := t.Add(time.Hour)
+		if _, o := next.In(loc).Zone(); o != offset {
+			// Narrow down to the second of the change.
+			lo, hi := t, next
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2)
+				if _, o := mid.In(loc).Zone(); o == offset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			name, _ := lo.In(loc).Zone()
+			transitions = append(transitions, Transition{At: hi, Before: offset, After: o, BeforeName: name})
+			offset = o
+		}
+		t = next
+	}
+	return transitions
+}
+
+// stamps formats the send dates of Options with custom formats.
+type stamps struct {
+	formats []*TimestampFormat
+	dstRate float64
+	// Transitions of the DST mode within the window.
+	dst []Transition
+	gap bool
+}
+
+// newStamps returns the stamps of opts, or nil for FormatDate.
+func newStamps(opts Options) *stamps {
+	if len(opts.Formats) == 0 && opts.DST == "" {
+		return nil
+	}
+	s := &stamps{formats: opts.Formats, dstRate: opts.DSTRate, gap: opts.DST == DSTGap}
+	if len(s.formats) == 0 {
+		s.formats = []*TimestampFormat{{Layout: DefaultLayout, Location: time.UTC, strftime: mustStrftime(DefaultLayout)}}
+	}
+
+	if opts.DST != "" {
+		for _, tr := range Transitions(s.formats[0].Location, opts.Start, opts.End) {
+			if (tr.After > tr.Before) == s.gap {
+				s.dst = append(s.dst, tr)
+			}
+		}
+	}
+	return s
+}
+
+func mustStrftime(pattern string) []strftimeToken {
+	tokens, err := parseStrftime(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return tokens
+}
+
+// stamp returns the send date and its timestamp for date, drawing the format
+// and DST dates from rnd.
+func (s *stamps) stamp(rnd *rand.Rand, date time.Time) (time.Time, string) {
+	f := s.formats[0]
+	if len(s.formats) > 1 {
+		f = s.formats[rnd.Intn(len(s.formats))]
+	}
+	if len(s.dst) == 0 || s.dstRate <= 0 || rnd.Float64() >= s.dstRate {
+		return date, f.Format(date)
+	}
+
+	tr := s.dst[rnd.Intn(len(s.dst))]
+	if s.gap {
+		// A wall clock time of the gap, as a clock not moved forward shows it.
+		gap := int64(tr.After-tr.Before) / 60
+		date = tr.At.Add(time.Duration(rnd.Int63n(gap)) * time.Minute)
+		return date, f.format(date.In(time.FixedZone(tr.BeforeName, tr.Before)))
+	}
+	// Either occurrence of a repeated wall clock time.
+	overlap := int64(tr.Before-tr.After) / 60
+	date = tr.At.Add(time.Duration(rnd.Int63n(2*overlap)-overlap) * time.Minute)
+	return date, f.Format(date)
+}
@@ -0,0 +1,193 @@
+package usagegen
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampFormat(t *testing.T) {
+	date := time.Date(2018, time.October, 4, 7, 6, 5, 0, time.UTC)
+	tests := []struct {
+		layout string
+		zone   string
+		offset bool
+		want   string
+	}{
+		{"", "", false, FormatDate(date)},
+		{DefaultLayout, "", false, "4/10/2018 7:6"},
+		{"%d/%m/%Y %H:%M:%S", "", false, "04/10/2018 07:06:05"},
+		{"%m/%d/%y %I:%M %p", "", false, "10/04/18 07:06 AM"},
+		{"%e %b %Y, %A day %j %%", "", false, " 4 Oct 2018, Thursday day 277 %"},
+		{"%F %T %Z %z", "Europe/Paris", false, "2018-10-04 09:06:05 CEST +0200"},
+		{time.RFC3339, "America/New_York", false, "2018-10-04T03:06:05-04:00"},
+		{"2 Jan 2006 15:04", "Asia/Kolkata", true, "4 Oct 2018 12:36 +05:30"},
+	}
+	for _, tt := range tests {
+		f, err := NewTimestampFormat(tt.layout, tt.zone, tt.offset)
+		if err != nil {
+			t.Errorf("NewTimestampFormat(%q, %q): %v", tt.layout, tt.zone, err)
+			continue
+		}
+		if got := f.Format(date); got != tt.want {
+			t.Errorf("%q in %q: %q, want %q", tt.layout, tt.zone, got, tt.want)
+		}
+	}
+
+	for _, layout := range []string{"%Q", "%Y %", "no elements"} {
+		if _, err := NewTimestampFormat(layout, "", false); err == nil {
+			t.Errorf("layout %q accepted", layout)
+		}
+	}
+	if _, err := NewTimestampFormat("", "Mars/Olympus_Mons", false); err == nil {
+		t.Error("unknown zone accepted")
+	}
+}
+
+func TestTimestampFormat_Parse(t *testing.T) {
+	date := time.Date(2018, time.October, 14, 17, 6, 5, 0, time.UTC)
+	for _, zone := range []string{"", "Europe/Paris"} {
+		formats, err := MixedFormats(zone, zone != "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range formats {
+			got, err := f.Parse(f.Format(date))
+			if err != nil || !got.Equal(date.Truncate(time.Minute)) && !got.Equal(date) {
+				t.Errorf("%q in %q: parsed %q as %v, %v", f.Layout, zone, f.Format(date), got, err)
+			}
+		}
+	}
+
+	f, _ := NewTimestampFormat("", "", false)
+	if _, err := f.Parse("31/9/2018 5:0"); err == nil {
+		t.Error("invalid date parsed")
+	}
+	f, _ = NewTimestampFormat("day %j", "", false)
+	if _, err := f.Parse("day 277"); err == nil {
+		t.Error("day of year parsed")
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	tests := []struct {
+		zone          string
+		at            time.Time
+		before, after int
+	}{
+		{"Europe/Paris", time.Date(2018, time.October, 28, 1, 0, 0, 0, time.UTC), 7200, 3600},
+		{"Australia/Sydney", time.Date(2018, time.October, 6, 16, 0, 0, 0, time.UTC), 36000, 39600},
+	}
+	for _, tt := range tests {
+		loc, err := time.LoadLocation(tt.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := Transitions(loc, WindowStart, WindowEnd)
+		if len(got) != 1 || !got[0].At.Equal(tt.at) || got[0].Before != tt.before || got[0].After != tt.after {
+			t.Errorf("%s: %+v", tt.zone, got)
+		}
+	}
+	if got := Transitions(time.UTC, WindowStart, WindowEnd); len(got) != 0 {
+		t.Errorf("UTC: %+v", got)
+	}
+}
+
+func TestGenerator_DST(t *testing.T) {
+	tests := []struct {
+		zone string
+		mode string
+		// Every timestamp matches, as the DST rate is 1.
+		want *regexp.Regexp
+	}{
+		// Sydney clocks jump from 2:00 to 3:00 on 7 October.
+		{"Australia/Sydney", DSTGap, regexp.MustCompile(`^7/10/2018 2:\d+$`)},
+		// Paris clocks go back from 3:00 to 2:00 on 28 October.
+		{"Europe/Paris", DSTOverlap, regexp.MustCompile(`^28/10/2018 2:\d+$`)},
+	}
+	for _, tt := range tests {
+		f, err := NewTimestampFormat("", tt.zone, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets := map[string]bool{}
+		g := New(Options{Rows: 200, Seed: 1, Formats: []*TimestampFormat{f}, DST: tt.mode, DSTRate: 1})
+		for g.Next() {
+			row := g.Row()
+			if !tt.want.MatchString(row.Record[2]) {
+				t.Fatalf("%s %s: timestamp %q", tt.zone, tt.mode, row.Record[2])
+			}
+			_, offset := row.Date.In(f.Location).Zone()
+			offsets[time.Duration(offset*int(time.Second)).String()] = true
+		}
+		// Overlapping times come from both sides of the transition.
+		if tt.mode == DSTOverlap && len(offsets) != 2 {
+			t.Errorf("%s: offsets %v", tt.zone, offsets)
+		}
+	}
+}
+
+func TestGenerator_Formats(t *testing.T) {
+	formats, err := MixedFormats("Europe/Paris", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Rows: 500, Seed: 4, Senders: 20, Domains: 20}
+	plain := New(opts)
+	opts.Formats = formats
+	mixed := New(opts)
+
+	shapes := map[string]bool{}
+	digits := regexp.MustCompile(`\d`)
+	for plain.Next() && mixed.Next() {
+		p, m := plain.Row(), mixed.Row()
+		// Formats draw from their own source: the other columns are unchanged.
+		if p.Record[0] != m.Record[0] || p.Record[3] != m.Record[3] || !p.Date.Equal(m.Date) {
+			t.Fatalf("row %d: %v, with formats %v", p.Number, p.Record, m.Record)
+		}
+		shapes[digits.ReplaceAllString(m.Record[2], "0")] = true
+	}
+	if len(shapes) < len(MixedLayouts) {
+		t.Errorf("%d timestamp shapes: %v", len(shapes), shapes)
+	}
+
+	// Commas and leading spaces are quoted in the CSV.
+	var buf strings.Builder
+	if _, err := WriteCSV(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `,"Oct `) {
+		t.Errorf("no quoted timestamp in:\n%.300s", buf.String())
+	}
+}
+
+func TestCheckDST(t *testing.T) {
+	sydney, err := ParseFormats("", "Australia/Sydney", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{Options{}, false},
+		{Options{Formats: sydney, DST: DSTGap, DSTRate: 0.1}, false},
+		{Options{Formats: sydney, DST: DSTOverlap, DSTRate: 0.1}, true},
+		{Options{Formats: sydney, DST: "spring", DSTRate: 0.1}, true},
+		{Options{Formats: sydney, DST: DSTGap}, true},
+		{Options{DST: DSTGap, DSTRate: 1}, true},
+	}
+	for _, tt := range tests {
+		if err := CheckDST(tt.opts); (err != nil) != tt.wantErr {
+			t.Errorf("CheckDST(%s, %v) = %v", tt.opts.DST, tt.opts.DSTRate, err)
+		}
+	}
+
+	if formats, err := ParseFormats("", "", false, false); formats != nil || err != nil {
+		t.Errorf("default formats %v, %v", formats, err)
+	}
+	if _, err := ParseFormats("%Y", "", false, true); err == nil {
+		t.Error("layout accepted with mixed formats")
+	}
+}
@@ -0,0 +1,315 @@
+// Package usagegen generates mock Zix usage rows, as written by file-creator
+// and served by file-server, for tests that need fixtures in-process.
+//
+//	g := usagegen.New(usagegen.Options{Rows: 100, Seed: 42, Spams: 5, SpamStart: 10})
+//	for g.Next() {
+//		row := g.Row()
+//		...
+//	}
+package usagegen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	SenderAddress   = "sender%d@sender%d.com"
+	ReceiverAddress = "receiver%d@receiver%d.com"
+	DateFormat      = "%d/%d/%d %d:%d"
+	Subject         = "Hello %d"
+	PolicyTypes     = "PolicyType1, PolicyType2"
+	PolicyNames     = "PolicyName1, PolicyName2"
+	DeliveryMethod  = "ZixPort"
+)
+
+var (
+	// Header holds the columns of a usage file.
+	Header = []string{"senderAddress", "recipientAddress", "sentTimestamp", "subject", "policyTypes", "policyNames", "deliveryMethod"}
+
+	// Default time window of the send dates, end exclusive.
+	WindowStart = time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	WindowEnd   = time.Date(2018, time.October, 31, 0, 0, 0, 0, time.UTC)
+
+	// datePattern matches DateFormat: day/month/year hour:minute.
+	datePattern = regexp.MustCompile(`^(\d{1,2})/(\d{1,2})/(\d{4}) (\d{1,2}):(\d{1,2})$`)
+)
+
+// Record is a usage row, in the order of Header.
+type Record []string
+
+func (r Record) String() string {
+	var buffer bytes.Buffer
+	for _, column := range r {
+		buffer.WriteString(column)
+	}
+	return buffer.String()
+}
+
+// NewRecord returns the record of a sender of a domain at sendDate.
+func NewRecord(sender, domain int, sendDate string) Record {
+	return Record{
+		fmt.Sprintf(SenderAddress, sender, domain),
+		fmt.Sprintf(ReceiverAddress, domain, sender),
+		sendDate,
+		fmt.Sprintf(Subject, domain),
+		PolicyTypes,
+		PolicyNames,
+		DeliveryMethod,
+	}
+}
+
+// FormatDate formats t as DateFormat, to the minute.
+func FormatDate(t time.Time) string {
+	return fmt.Sprintf(DateFormat, t.Day(), int(t.Month()), t.Year(), t.Hour(), t.Minute())
+}
+
+// ParseDate parses a DateFormat timestamp of an existing date and time, in UTC.
+func ParseDate(s string) (time.Time, error) {
+	m := datePattern.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("timestamp does not match day/month/year hour:minute")
+	}
+
+	n := make([]int, len(m))
+	for i := 1; i < len(m); i++ {
+		n[i], _ = strconv.Atoi(m[i])
+	}
+	day, month, year, hour, minute := n[1], n[2], n[3], n[4], n[5]
+
+	t := time.Date(year, time.Month(month), day, hour, minute, 0, 0, time.UTC)
+	if t.Day() != day || int(t.Month()) != month || t.Hour() != hour || t.Minute() != minute {
+		return time.Time{}, fmt.Errorf("timestamp is not a valid date and time")
+	}
+	return t, nil
+}
+
+// Options configure a Generator.
+type Options struct {
+	// Rows generated, spam included.
+	Rows int
+
+	// Seed of the random source; the same options generate the same rows.
+	Seed int64
+
+	// Spam rows, all repeating the row at index SpamStart, counted from 1.
+	Spams     int
+	SpamStart int
+
+	// Index of the first row, to continue a file. Defaults to 1.
+	FirstIndex int
+
+	// Rows to skip, to generate a range of a larger file. The skipped rows
+	// draw no random numbers.
+	Skip int
+
+	// Senders and Domains are picked at random among this many if set;
+	// otherwise both are the row index, so every row is distinct.
+	Senders int
+	Domains int
+
+	// Window of the send dates, end exclusive. If neither is set, the dates
+	// are drawn as file-creator always has: day 1 to 30 of October 2018,
+	// hour 1 to 12 and minute 0 to 58.
+	Start time.Time
+	End   time.Time
+
+	// Formats of the send dates, one picked at random per row if several;
+	// FormatDate if none.
+	Formats []*TimestampFormat
+
+	// DST, DSTGap or DSTOverlap, moves a DSTRate share of the send dates
+	// into the DST transitions of the zone of the first format within the
+	// window, if any.
+	DST     string
+	DSTRate float64
+
+	// Addresses mixes edge-case addresses into the sender and recipient
+	// columns, plain if nil.
+	Addresses AddressMix
+
+	// Dialect of the files of WriteCSV and WriteCSVParallel.
+	Dialect Dialect
+}
+
+// Formats and DST dates draw from a source of their own, so that they do not
+// change the other columns; its seed is the options seed xor stampSalt.
+const stampSalt = 0x5354414d50
+
+// Address kinds draw from a source of their own too, seeded with the options
+// seed xor addressSalt.
+const addressSalt = 0x41444452
+
+// Row is a generated row.
+type Row struct {
+	// Position of the row, counted from 1 with the skipped rows.
+	Number int
+
+	// Row index; spam rows repeat the same index.
+	Index int
+	Spam  bool
+
+	Sender int
+	Domain int
+	Date   time.Time
+	Record Record
+}
+
+// Generator generates the rows of Options one at a time.
+type Generator struct {
+	opts    Options
+	rnd     *rand.Rand
+	minutes int64
+	next    int
+	row     Row
+
+	stamps   *stamps
+	stampRnd *rand.Rand
+	addrRnd  *rand.Rand
+}
+
+// New constructs a Generator.
+func New(opts Options) *Generator {
+	if opts.FirstIndex <= 0 {
+		opts.FirstIndex = 1
+	}
+	// No minutes in the window stands for the legacy dates.
+	var minutes int64
+	if opts.Start.IsZero() && opts.End.IsZero() {
+		opts.Start, opts.End = WindowStart, WindowEnd
+	} else {
+		if opts.Start.IsZero() {
+			opts.Start = WindowStart
+		}
+		if opts.End.IsZero() {
+			opts.End = WindowEnd
+		}
+		minutes = int64(opts.End.Sub(opts.Start) / time.Minute)
+		if minutes < 1 {
+			minutes = 1
+		}
+	}
+
+	return &Generator{
+		opts:     opts,
+		rnd:      rand.New(rand.NewSource(opts.Seed)),
+		minutes:  minutes,
+		next:     opts.Skip,
+		stamps:   newStamps(opts),
+		stampRnd: rand.New(rand.NewSource(opts.Seed ^ stampSalt)),
+		addrRnd:  rand.New(rand.NewSource(opts.Seed ^ addressSalt)),
+	}
+}
+
+// Next generates the next row, reporting false after the last one.
+func (g *Generator) Next() bool {
+	if g.next >= g.opts.Rows {
+		return false
+	}
+	r := g.next
+	g.next++
+
+	index := RowIndex(r, g.opts.Spams, g.opts.SpamStart) + g.opts.FirstIndex - 1
+	spam := g.opts.Spams > 0 && index == g.opts.SpamStart+g.opts.FirstIndex-1
+
+	// Spam rows after the first repeat it, send date included.
+	if spam && g.row.Index == index && g.row.Record != nil {
+		g.row.Number = r + 1
+		return true
+	}
+
+	date := drawDate(g.rnd, g.opts.Start, g.minutes)
+	sender, domain := index, index
+	if g.opts.Domains > 0 {
+		domain = g.rnd.Intn(g.opts.Domains) + 1
+	}
+	if g.opts.Senders > 0 {
+		sender = g.rnd.Intn(g.opts.Senders) + 1
+	}
+
+	var stamp string
+	if g.stamps != nil {
+		date, stamp = g.stamps.stamp(g.stampRnd, date)
+	} else {
+		stamp = FormatDate(date)
+	}
+
+	g.row = Row{
+		Number: r + 1,
+		Index:  index,
+		Spam:   spam,
+		Sender: sender,
+		Domain: domain,
+		Date:   date,
+		Record: NewRecord(sender, domain, stamp),
+	}
+	if g.opts.Addresses != nil {
+		g.row.Record[0], g.row.Record[1] = g.opts.Addresses.addresses(g.addrRnd, sender, domain)
+	}
+	return true
+}
+
+// drawDate draws a send date among the minutes from start, or a legacy date
+// if minutes is 0.
+func drawDate(rnd *rand.Rand, start time.Time, minutes int64) time.Time {
+	if minutes == 0 {
+		day := rnd.Intn(30) + 1
+		hour := rnd.Intn(12) + 1
+		minute := rnd.Intn(59)
+		return time.Date(2018, time.October, day, hour, minute, 0, 0, time.UTC)
+	}
+	return start.Add(time.Duration(rnd.Int63n(minutes)) * time.Minute)
+}
+
+// Row returns the row generated by the last call to Next. Spam rows share
+// their Record, which must not be modified.
+func (g *Generator) Row() Row {
+	return g.row
+}
+
+// RowIndex returns the index of the 0-based row r: rows are numbered from 1,
+// except the spam rows which all repeat the index spamStart.
+func RowIndex(r, spams, spamStart int) int {
+	switch {
+	case spams <= 0 || r+1 < spamStart:
+		return r + 1
+	case r+1 < spamStart+spams:
+		return spamStart
+	default:
+		return r + 1 - (spams - 1)
+	}
+}
+
+// WriteCSV writes the rows of opts to w as a usage file, header included, and
+// returns the number of rows written.
+func WriteCSV(w io.Writer, opts Options) (int, error) {
+	var cw interface {
+		Write([]string) error
+		Flush()
+		Error() error
+	}
+	if opts.Dialect.IsDefault() {
+		cw = csv.NewWriter(w)
+	} else {
+		cw = opts.Dialect.NewWriter(w)
+	}
+	if err := cw.Write(Header); err != nil {
+		return 0, err
+	}
+
+	rows := 0
+	for g := New(opts); g.Next(); rows++ {
+		if err := cw.Write(g.Row().Record); err != nil {
+			return rows, err
+		}
+	}
+
+	cw.Flush()
+	return rows, cw.Error()
+}
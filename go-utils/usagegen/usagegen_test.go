@@ -0,0 +1,209 @@
+package usagegen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func generate(opts Options) []Row {
+	var rows []Row
+	for g := New(opts); g.Next(); {
+		rows = append(rows, g.Row())
+	}
+	return rows
+}
+
+func TestRowIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		spams     int
+		spamStart int
+		want      []int
+	}{
+		{"no spam", 0, 1, []int{1, 2, 3, 4, 5}},
+		{"spam at start", 3, 1, []int{1, 1, 1, 2, 3}},
+		{"spam in the middle", 2, 3, []int{1, 2, 3, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for r, want := range tt.want {
+				if got := RowIndex(r, tt.spams, tt.spamStart); got != want {
+					t.Errorf("RowIndex(%d) = %d, want %d", r, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  Options
+		index []int
+		spam  []int // rows numbers of the spam rows
+	}{
+		{"indexed", Options{Rows: 4, Seed: 1}, []int{1, 2, 3, 4}, nil},
+		{"spam", Options{Rows: 6, Seed: 1, Spams: 3, SpamStart: 2}, []int{1, 2, 2, 2, 3, 4}, []int{2, 3, 4}},
+		{"spam past the last row", Options{Rows: 3, Seed: 1, Spams: 5, SpamStart: 2}, []int{1, 2, 2}, []int{2, 3}},
+		{"continued", Options{Rows: 4, Seed: 1, Spams: 2, SpamStart: 1, FirstIndex: 11}, []int{11, 11, 12, 13}, []int{1, 2}},
+		{"skipped", Options{Rows: 5, Skip: 2, Seed: 1, Spams: 2, SpamStart: 2}, []int{2, 3, 4}, []int{3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := generate(tt.opts)
+			if len(rows) != len(tt.index) {
+				t.Fatalf("%d rows, want %d", len(rows), len(tt.index))
+			}
+
+			var spam []int
+			for i, row := range rows {
+				if row.Number != tt.opts.Skip+i+1 {
+					t.Errorf("row %d: number %d", i, row.Number)
+				}
+				if row.Index != tt.index[i] || row.Sender != row.Index || row.Domain != row.Index {
+					t.Errorf("row %d: index %d, sender %d, domain %d, want %d", row.Number, row.Index, row.Sender, row.Domain, tt.index[i])
+				}
+				if row.Spam {
+					spam = append(spam, row.Number)
+				}
+				want := NewRecord(row.Index, row.Index, FormatDate(row.Date))
+				if !reflect.DeepEqual(row.Record, want) {
+					t.Errorf("row %d: %v, want %v", row.Number, row.Record, want)
+				}
+			}
+			if !reflect.DeepEqual(spam, tt.spam) {
+				t.Errorf("spam rows %v, want %v", spam, tt.spam)
+			}
+
+			// Spam rows repeat the same row, send date included.
+			for i := 1; i < len(rows); i++ {
+				if rows[i].Spam && rows[i-1].Spam && !reflect.DeepEqual(rows[i].Record, rows[i-1].Record) {
+					t.Errorf("row %d: spam differs from the previous row", rows[i].Number)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerator_Seed(t *testing.T) {
+	opts := Options{Rows: 50, Seed: 7, Senders: 5, Domains: 3}
+	if !reflect.DeepEqual(generate(opts), generate(opts)) {
+		t.Error("the same seed generated different rows")
+	}
+
+	opts.Seed = 8
+	if reflect.DeepEqual(generate(opts), generate(Options{Rows: 50, Seed: 7, Senders: 5, Domains: 3})) {
+		t.Error("different seeds generated the same rows")
+	}
+}
+
+func TestGenerator_Random(t *testing.T) {
+	start := time.Date(2019, time.March, 30, 22, 0, 0, 0, time.UTC)
+	end := start.Add(3 * time.Hour)
+
+	for _, row := range generate(Options{Rows: 500, Seed: 3, Senders: 4, Domains: 2, Start: start, End: end}) {
+		if row.Sender < 1 || row.Sender > 4 || row.Domain < 1 || row.Domain > 2 {
+			t.Errorf("row %d: sender %d, domain %d", row.Number, row.Sender, row.Domain)
+		}
+		if row.Date.Before(start) || !row.Date.Before(end) || row.Date.Second() != 0 {
+			t.Errorf("row %d: date %v outside [%v, %v)", row.Number, row.Date, start, end)
+		}
+	}
+}
+
+func TestGenerator_LegacyDates(t *testing.T) {
+	// Without a window, the dates keep the distribution of the first
+	// file-creator: day 1 to 30, hour 1 to 12, minute 0 to 58.
+	var days, hours, minutes [60]int
+	for _, row := range generate(Options{Rows: 5000, Seed: 3}) {
+		d := row.Date
+		if d.Year() != 2018 || d.Month() != time.October || d.Day() > 30 || d.Hour() < 1 || d.Hour() > 12 || d.Minute() > 58 {
+			t.Fatalf("row %d: date %v out of the legacy distribution", row.Number, d)
+		}
+		if row.Record[2] != FormatDate(d) {
+			t.Errorf("row %d: timestamp %q, want %q", row.Number, row.Record[2], FormatDate(d))
+		}
+		days[d.Day()]++
+		hours[d.Hour()]++
+		minutes[d.Minute()]++
+	}
+	if days[1] == 0 || days[30] == 0 || hours[1] == 0 || hours[12] == 0 || minutes[0] == 0 || minutes[58] == 0 {
+		t.Errorf("bounds never drawn: days %v, hours %v, minutes %v", days, hours, minutes)
+	}
+
+	var stamps []string
+	for _, row := range generate(Options{Rows: 3, Seed: 3}) {
+		stamps = append(stamps, row.Record[2])
+	}
+	if want := []string{"29/10/2018 6:42", "1/10/2018 6:54", "7/10/2018 10:45"}; !reflect.DeepEqual(stamps, want) {
+		t.Errorf("timestamps %q, want %q", stamps, want)
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"9/10/2018 5:0", time.Date(2018, time.October, 9, 5, 0, 0, 0, time.UTC), false},
+		{"31/12/2018 23:59", time.Date(2018, time.December, 31, 23, 59, 0, 0, time.UTC), false},
+		{"31/9/2018 5:0", time.Time{}, true},
+		{"9/10/2018 24:0", time.Time{}, true},
+		{"2018-10-09 05:00", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDate(tt.in)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("ParseDate(%q) = %v, %v", tt.in, got, err)
+		}
+		if err == nil && FormatDate(got) != tt.in {
+			t.Errorf("FormatDate(%v) = %q, want %q", got, FormatDate(got), tt.in)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	rows, err := WriteCSV(&buf, Options{Rows: 10, Seed: 1, Spams: 2, SpamStart: 4})
+	if err != nil || rows != 10 {
+		t.Fatalf("WriteCSV = %d, %v", rows, err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 11 || !reflect.DeepEqual(records[0], Header) {
+		t.Fatalf("%d records, header %v", len(records), records[0])
+	}
+	for i, row := range generate(Options{Rows: 10, Seed: 1, Spams: 2, SpamStart: 4}) {
+		if !reflect.DeepEqual(records[i+1], []string(row.Record)) {
+			t.Errorf("line %d: %v, want %v", i+2, records[i+1], row.Record)
+		}
+	}
+}
+
+func BenchmarkGenerator(b *testing.B) {
+	g := New(Options{Rows: b.N, Seed: 1, Senders: 150, Domains: 150})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for g.Next() {
+	}
+}
+
+func BenchmarkWriteCSV(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := WriteCSV(ioutil.Discard, Options{Rows: 1000, Seed: int64(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}